@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	crdclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -11,6 +12,7 @@ import (
 	apiserviceclient "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
 	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/initializer"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/version"
 )
 
@@ -18,6 +20,10 @@ const (
 	initializerUserAgent = "storage-version-migration-initializer"
 )
 
+var (
+	policyFile = pflag.String("policy-file", "", "path to a YAML file with the rules selecting the resources to migrate. If unset, all resources but events are migrated.")
+)
+
 func NewInitializerCommand(ctx context.Context) *cobra.Command {
 	c := &cobra.Command{
 		Use:  "kube-storage-migrator-initializer",
@@ -32,6 +38,10 @@ func NewInitializerCommand(ctx context.Context) *cobra.Command {
 }
 
 func run(ctx context.Context) error {
+	resourcePolicy, err := policy.Load(*policyFile)
+	if err != nil {
+		return err
+	}
 	// creates the in-cluster config
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -60,6 +70,7 @@ func run(ctx context.Context) error {
 		apiservice.ApiregistrationV1().APIServices(),
 		clientset.CoreV1().Namespaces(),
 		migration.MigrationV1alpha1(),
+		resourcePolicy,
 	)
 	return init.Initialize(ctx)
 }
@@ -0,0 +1,267 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+)
+
+// migrateOptions are the flags of the migrate command.
+type migrateOptions struct {
+	checkpoint    string
+	chunkSize     int64
+	concurrency   int
+	namespaces    []string
+	labelSelector string
+	fieldSelector string
+	strategy      string
+	maxFailures   int32
+	// objectsPerSecond, bytesPerSecond and adaptiveBackpressure limit the
+	// write rate.
+	objectsPerSecond     float64
+	bytesPerSecond       int64
+	adaptiveBackpressure bool
+}
+
+func newMigrateCommand() *cobra.Command {
+	o := &migrateOptions{}
+	c := &cobra.Command{
+		Use:   "migrate RESOURCE",
+		Short: "Migrate a resource once, without the StorageVersionMigration API",
+		Long: `Migrate rewrites all the objects of a resource, e.g., "deployments.v1.apps" or "deployments.apps", so that they are stored in the current storage version, and exits.
+
+The progress is printed after every chunk. The command exits with a non-zero status if the migration fails. With --checkpoint, the progress is recorded in a local file, and running the command again with the same file and the same --namespace, --selector and --field-selector resumes an interrupted migration. The file is removed once the migration completes or fails.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMigrate(cmd.Context(), cmd.OutOrStdout(), args[0], o)
+		},
+	}
+	c.Flags().StringVar(&o.checkpoint, "checkpoint", "", "A local file to record the progress of the migration in, and to resume it from.")
+	c.Flags().Int64Var(&o.chunkSize, "chunk-size", 500, "The number of objects listed in one request.")
+	c.Flags().IntVar(&o.concurrency, "concurrency", 1, "The number of objects migrated concurrently.")
+	c.Flags().StringSliceVar(&o.namespaces, "namespace", nil, "The namespaces to migrate, one after another. If unset, all namespaces are migrated.")
+	c.Flags().StringVar(&o.labelSelector, "selector", "", "A label selector of the objects to migrate.")
+	c.Flags().StringVar(&o.fieldSelector, "field-selector", "", "A field selector of the objects to migrate.")
+	c.Flags().StringVar(&o.strategy, "strategy", string(migrationv1alpha1.UpdateWriteStrategy), "How the objects are written: Update, MergePatch or Apply.")
+	c.Flags().Int32Var(&o.maxFailures, "max-failures", 0, "The number of objects that may fail to migrate before the migration fails.")
+	c.Flags().Float64Var(&o.objectsPerSecond, "objects-per-second", 0, "The maximum number of objects written per second. 0 means no limit.")
+	c.Flags().Int64Var(&o.bytesPerSecond, "bytes-per-second", 0, "The maximum number of bytes written per second, measured by the size of the JSON encoding of the objects. 0 means no limit.")
+	c.Flags().BoolVar(&o.adaptiveBackpressure, "adaptive-backpressure", false, "Adapt the write rate and concurrency to the apiserver latency, throttling and error rate, between 1 object per second and --kube-api-qps.")
+	return c
+}
+
+func runMigrate(ctx context.Context, out io.Writer, arg string, o *migrateOptions) error {
+	if o.chunkSize < 1 {
+		return fmt.Errorf("--chunk-size must be positive, got %d", o.chunkSize)
+	}
+	if o.concurrency < 1 {
+		return fmt.Errorf("--concurrency must be positive, got %d", o.concurrency)
+	}
+	if o.maxFailures < 0 {
+		return fmt.Errorf("--max-failures must not be negative, got %d", o.maxFailures)
+	}
+	strategy, err := writeStrategy(migrationv1alpha1.WriteStrategy(o.strategy))
+	if err != nil {
+		return err
+	}
+	config, err := restConfig()
+	if err != nil {
+		return err
+	}
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	resource, namespaced, err := resolveResource(disco, arg)
+	if err != nil {
+		return err
+	}
+	if len(o.namespaces) != 0 && !namespaced {
+		return fmt.Errorf("--namespace is set, but %s is not namespaced", resource.GroupResource())
+	}
+	// Only the writes of the objects feed the backpressure, not the
+	// discovery.
+	var backpressure *migrator.Backpressure
+	if o.adaptiveBackpressure {
+		backpressure = migrator.NewBackpressure(migrator.BackpressureConfig{
+			MaxRate:     float64(config.QPS),
+			MaxInFlight: o.concurrency,
+		})
+		config.Wrap(backpressure.WrapTransport)
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, out, client, resource, strategy, backpressure, o)
+}
+
+// migrate migrates the objects of resource with client, writing them with
+// strategy.
+func migrate(ctx context.Context, out io.Writer, client dynamic.Interface, resource schema.GroupVersionResource, strategy migrator.Strategy, backpressure *migrator.Backpressure, o *migrateOptions) error {
+	scope := migrator.Scope{
+		Namespaces:    o.namespaces,
+		LabelSelector: o.labelSelector,
+		FieldSelector: o.fieldSelector,
+	}
+	var store progressStore = migrator.NewMemoryProgressStore()
+	if len(o.checkpoint) != 0 {
+		fileStore, err := migrator.NewFileProgressStore(o.checkpoint, resource.GroupResource(), scope)
+		if err != nil {
+			return err
+		}
+		if progress, _ := fileStore.Progress(); progress.Migrated+progress.Failed > 0 {
+			fmt.Fprintf(out, "resuming the migration of %s from %s\n", resource.GroupResource(), o.checkpoint)
+		}
+		store = fileStore
+	}
+	printer := &progressPrinter{
+		progressStore: store,
+		out:           out,
+		resource:      resource.GroupResource().String(),
+		start:         time.Now(),
+	}
+	m := migrator.NewMigrator(resource, client, printer,
+		migrator.WithChunkSize(o.chunkSize),
+		migrator.WithConcurrency(o.concurrency),
+		migrator.WithRateLimiter(migrator.NewRateLimiter(o.objectsPerSecond, float64(o.bytesPerSecond))),
+		migrator.WithBackpressure(backpressure),
+		migrator.WithScope(scope),
+		migrator.WithStrategy(strategy),
+		migrator.WithFailurePolicy(&migrationv1alpha1.FailurePolicy{MaxFailures: o.maxFailures}),
+	)
+	fmt.Fprintf(out, "migrating %s\n", resource)
+	err := m.Run(ctx)
+	printer.printFailures()
+	var tolerated *migrator.ErrToleratedFailures
+	switch {
+	case err == nil || errors.As(err, &tolerated):
+		printer.print("completed")
+	case ctx.Err() != nil:
+		if len(o.checkpoint) != 0 {
+			return fmt.Errorf("the migration of %s was interrupted, run the command again with --checkpoint %s to resume it", resource.GroupResource(), o.checkpoint)
+		}
+		return fmt.Errorf("the migration of %s was interrupted", resource.GroupResource())
+	default:
+		if len(o.checkpoint) != 0 {
+			// The next run starts over rather than resuming, so that
+			// the objects that failed do not count against
+			// --max-failures again.
+			if err := os.Remove(o.checkpoint); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return fmt.Errorf("the migration of %s failed: %v", resource.GroupResource(), err)
+	}
+	if len(o.checkpoint) != 0 {
+		if err := os.Remove(o.checkpoint); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStrategy returns the migrator.Strategy of a --strategy.
+func writeStrategy(s migrationv1alpha1.WriteStrategy) (migrator.Strategy, error) {
+	switch s {
+	case migrationv1alpha1.UpdateWriteStrategy:
+		return migrator.NewUpdateStrategy(), nil
+	case migrationv1alpha1.MergePatchWriteStrategy:
+		return migrator.NewMergePatchStrategy(), nil
+	case migrationv1alpha1.ApplyWriteStrategy:
+		return migrator.NewApplyStrategy(migrator.DefaultFieldManager), nil
+	default:
+		return nil, fmt.Errorf("unknown --strategy %q", s)
+	}
+}
+
+// resolveResource returns the resource arg names, as resource.version.group,
+// resource.group, or resource for the core group, and whether it is
+// namespaced. Without a version, the preferred version of the group is used.
+func resolveResource(client discovery.DiscoveryInterface, arg string) (schema.GroupVersionResource, bool, error) {
+	gvr, gr := schema.ParseResourceArg(arg)
+	var candidates []schema.GroupVersionResource
+	if gvr != nil {
+		candidates = append(candidates, *gvr)
+	}
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return schema.GroupVersionResource{}, false, err
+	}
+	for _, g := range groups.Groups {
+		if g.Name == gr.Group {
+			candidates = append(candidates, gr.WithVersion(g.PreferredVersion.Version))
+		}
+	}
+	for _, c := range candidates {
+		l, err := client.ServerResourcesForGroupVersion(c.GroupVersion().String())
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return schema.GroupVersionResource{}, false, err
+		}
+		for _, r := range l.APIResources {
+			if r.Name == c.Resource {
+				return c, r.Namespaced, nil
+			}
+		}
+	}
+	return schema.GroupVersionResource{}, false, fmt.Errorf("the server does not serve the resource %q", arg)
+}
+
+// progressStore is a migrator.ProgressStore that reports the progress.
+type progressStore interface {
+	migrator.ProgressStore
+	Progress() (migrationv1alpha1.MigrationProgress, []migrationv1alpha1.FailedObject)
+}
+
+// progressPrinter prints the progress of the migration after every chunk.
+type progressPrinter struct {
+	progressStore
+	out      io.Writer
+	resource string
+	start    time.Time
+}
+
+func (p *progressPrinter) Observe(ctx context.Context, result migrator.ChunkResult) error {
+	err := p.progressStore.Observe(ctx, result)
+	p.print("in progress")
+	return err
+}
+
+func (p *progressPrinter) print(state string) {
+	progress, _ := p.Progress()
+	fmt.Fprintf(p.out, "%s: %s, %d objects migrated, %d failed", p.resource, state, progress.Migrated, progress.Failed)
+	if progress.Remaining != nil {
+		fmt.Fprintf(p.out, ", %d remaining", *progress.Remaining)
+	}
+	if progress.Percent != nil {
+		fmt.Fprintf(p.out, " (%d%%)", *progress.Percent)
+	}
+	fmt.Fprintf(p.out, ", %v elapsed\n", time.Since(p.start).Round(time.Second))
+}
+
+// printFailures prints the objects that failed to migrate.
+func (p *progressPrinter) printFailures() {
+	_, failed := p.Progress()
+	for _, f := range failed {
+		name := f.Name
+		if len(f.Namespace) != 0 {
+			name = f.Namespace + "/" + name
+		}
+		fmt.Fprintf(p.out, "failed to migrate %s: %s\n", name, f.Reason)
+	}
+}
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	clitesting "k8s.io/client-go/testing"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+)
+
+func TestMigrateStartsOverAfterFailure(t *testing.T) {
+	var nodes []runtime.Object
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node%d", i)}})
+	}
+	client := fake.NewSimpleDynamicClient(scheme.Scheme, nodes...)
+	reject := true
+	client.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		obj, err := meta.Accessor(a.(clitesting.UpdateAction).GetObject())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reject && obj.GetName() == "node3" {
+			return true, nil, errors.NewForbidden(v1.Resource("nodes"), obj.GetName(), fmt.Errorf("denied by the webhook"))
+		}
+		return false, nil, nil
+	})
+	o := &migrateOptions{
+		checkpoint:  filepath.Join(t.TempDir(), "nodes.json"),
+		chunkSize:   5,
+		concurrency: 1,
+	}
+	resource := v1.SchemeGroupVersion.WithResource("nodes")
+
+	var out bytes.Buffer
+	if err := migrate(context.TODO(), &out, client, resource, migrator.NewUpdateStrategy(), nil, o); err == nil {
+		t.Fatalf("expected the migration to fail, got %s", out.String())
+	}
+	if _, err := os.Stat(o.checkpoint); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint of the failed migration to be removed, got %v", err)
+	}
+
+	// Once the object is fixed, the migration succeeds.
+	reject = false
+	out.Reset()
+	if err := migrate(context.TODO(), &out, client, resource, migrator.NewUpdateStrategy(), nil, o); err != nil {
+		t.Fatalf("expected the migration to succeed, got %v: %s", err, out.String())
+	}
+	if !bytes.Contains(out.Bytes(), []byte("completed, 10 objects migrated, 0 failed")) {
+		t.Errorf("expected all objects to be migrated, got %s", out.String())
+	}
+}
@@ -2,20 +2,28 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/component-base/cli"
 	"k8s.io/component-base/cli/flag"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/leaderelection"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/version"
 )
 
@@ -24,9 +32,40 @@ const (
 )
 
 var (
-	kubeconfigPath = pflag.String("kubeconfig", "", "absolute path to the kubeconfig file specifying the apiserver instance. If unspecified, fallback to in-cluster configuration")
-	kubeAPIQPS     = pflag.Float32("kube-api-qps", rest.DefaultQPS, "QPS to use while talking with kubernetes apiserver.")
-	kubeAPIBurst   = pflag.Int("kube-api-burst", rest.DefaultBurst, "Burst to use while talking with kubernetes apiserver.")
+	// clientFlags configure the apiserver client, and are shared by all
+	// commands.
+	clientFlags = pflag.NewFlagSet("client", pflag.ExitOnError)
+
+	kubeconfigPath = clientFlags.String("kubeconfig", "", "absolute path to the kubeconfig file specifying the apiserver instance. If unspecified, fallback to in-cluster configuration")
+	kubeAPIQPS     = clientFlags.Float32("kube-api-qps", rest.DefaultQPS, "QPS to use while talking with kubernetes apiserver.")
+	kubeAPIBurst   = clientFlags.Int("kube-api-burst", rest.DefaultBurst, "Burst to use while talking with kubernetes apiserver.")
+
+	// daemonFlags configure the migration controller, and are only
+	// accepted by the root command.
+	daemonFlags = pflag.NewFlagSet("daemon", pflag.ExitOnError)
+
+	maxConcurrentMigrations = daemonFlags.Int("max-concurrent-migrations", 1, "The maximum number of migrations that run at the same time. Migrations of the same resource never run at the same time.")
+	defaultConcurrency      = daemonFlags.Int("default-concurrency", 1, "The number of objects a migration migrates concurrently, unless the migration sets .spec.concurrency.")
+	maxConcurrency          = daemonFlags.Int("max-concurrency", 16, "The maximum number of objects all migrations together migrate concurrently. A larger .spec.concurrency is capped at this value. 0 means no limit.")
+	objectsPerSecond        = daemonFlags.Float64("objects-per-second", 0, "The maximum number of objects all migrations together write per second. 0 means no limit.")
+	bytesPerSecond          = daemonFlags.Int64("bytes-per-second", 0, "The maximum number of bytes all migrations together write per second, measured by the size of the JSON encoding of the objects. 0 means no limit.")
+	adaptiveBackpressure    = daemonFlags.Bool("adaptive-backpressure", false, "Adapt the write rate and concurrency of all migrations to the apiserver latency, throttling and error rate.")
+	backpressureLatency     = daemonFlags.Duration("backpressure-target-latency", time.Second, "The write latency above which the adaptive backpressure slows down.")
+	backpressureMinRate     = daemonFlags.Float64("backpressure-min-rate", 1, "The minimum number of objects per second the adaptive backpressure slows down to.")
+	backpressureMaxRate     = daemonFlags.Float64("backpressure-max-rate", 0, "The maximum number of objects per second the adaptive backpressure speeds up to. 0 means --kube-api-qps.")
+	defaultChunkSize        = daemonFlags.Int64("default-chunk-size", 500, "The number of objects a migration lists in one request, unless the migration sets .spec.chunkSize.")
+	maintenanceWindows      = daemonFlags.StringArray("maintenance-window", nil, "A maintenance window, as a cron expression of its start and a duration separated by a semicolon, e.g., \"0 22 * * 1-5;8h\". Migrations that do not set .spec.schedule only run within these windows. Repeat the flag for several windows. If unset, migrations run at any time.")
+	maintenanceTimeZone     = daemonFlags.String("maintenance-time-zone", "", "The IANA time zone of the --maintenance-window start times, e.g., Europe/Paris. Defaults to UTC.")
+
+	leaderElect                  = daemonFlags.Bool("leader-elect", false, "Only migrate while holding a Lease, so that a single replica of the migrator runs at a time. A replica that loses the Lease saves the continue tokens of its running migrations and exits. Requires permission to manage Leases in the namespace of the Lease.")
+	leaderElectLeaseDuration     = daemonFlags.Duration("leader-elect-lease-duration", leaderelection.DefaultLeaseDuration, "How long the other replicas wait after the leader last renewed the Lease before they take it over.")
+	leaderElectRenewDeadline     = daemonFlags.Duration("leader-elect-renew-deadline", leaderelection.DefaultRenewDeadline, "How long the leader keeps trying to renew the Lease before it stops migrating. Must be less than --leader-elect-lease-duration.")
+	leaderElectRetryPeriod       = daemonFlags.Duration("leader-elect-retry-period", leaderelection.DefaultRetryPeriod, "How long the replicas wait between two attempts to acquire or renew the Lease.")
+	leaderElectResourceName      = daemonFlags.String("leader-elect-resource-name", "storage-version-migration-migrator", "The name of the Lease.")
+	leaderElectResourceNamespace = daemonFlags.String("leader-elect-resource-namespace", "", "The namespace of the Lease. Defaults to the namespace of the pod.")
+
+	sharding      = daemonFlags.Bool("sharding", false, "Share the migrations between all replicas of the migrator, instead of electing a leader. Each replica claims the migrations it runs in .status.claim. --leader-elect is ignored.")
+	claimDuration = daemonFlags.Duration("claim-duration", 30*time.Second, "How long after a replica last renewed its claim on a migration other replicas take the migration over. Only used with --sharding.")
 )
 
 func NewMigratorCommand(ctx context.Context) *cobra.Command {
@@ -38,35 +77,133 @@ func NewMigratorCommand(ctx context.Context) *cobra.Command {
 			return run(cmd.Context())
 		},
 	}
+	c.PersistentFlags().AddFlagSet(clientFlags)
+	c.Flags().AddFlagSet(daemonFlags)
+	c.AddCommand(newMigrateCommand())
+	c.AddCommand(newReadinessCommand())
 	c.SetContext(ctx)
 	return c
 }
 
-func run(ctx context.Context) error {
-	http.Handle("/metrics", promhttp.Handler())
-	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "ok")
-	})
-	http.HandleFunc("/healthz", livenessHandler)
-	go func() { http.ListenAndServe(":2112", nil) }()
+// Run runs the command with cli.Run, and returns the exit status of the
+// process: the status of the exitError the command failed with, if any, or
+// else the status of cli.Run.
+func Run(c *cobra.Command) int {
+	var failure error
+	captureErrors(c, &failure)
+	status := cli.Run(c)
+	var exit *exitError
+	if status != 0 && errors.As(failure, &exit) {
+		return exit.status
+	}
+	return status
+}
 
-	var err error
+// exitError makes the process exit with its status, rather than the status 1
+// of other errors.
+type exitError struct {
+	status int
+	error
+}
+
+// captureErrors records the error the command or one of its subcommands
+// fails with in failure.
+func captureErrors(c *cobra.Command, failure *error) {
+	if runE := c.RunE; runE != nil {
+		c.RunE = func(cmd *cobra.Command, args []string) error {
+			*failure = runE(cmd, args)
+			return *failure
+		}
+	}
+	for _, sub := range c.Commands() {
+		captureErrors(sub, failure)
+	}
+}
+
+// restConfig returns the client configuration of --kubeconfig, or the
+// in-cluster configuration.
+func restConfig() (*rest.Config, error) {
 	var config *rest.Config
+	var err error
 	if *kubeconfigPath != "" {
 		config, err = clientcmd.BuildConfigFromFlags("", *kubeconfigPath)
 		if err != nil {
-			log.Fatalf("Error initializing client config: %v for kubeconfig: %v", err.Error(), *kubeconfigPath)
+			return nil, fmt.Errorf("error initializing client config for kubeconfig %v: %v", *kubeconfigPath, err)
 		}
 	} else {
 		config, err = rest.InClusterConfig()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	config.QPS = *kubeAPIQPS
 	config.Burst = *kubeAPIBurst
 	config.UserAgent = migratorUserAgent + "/" + version.VERSION
-	dynamic, err := dynamic.NewForConfig(config)
+	return config, nil
+}
+
+func run(ctx context.Context) error {
+	if *maxConcurrentMigrations < 1 {
+		return fmt.Errorf("--max-concurrent-migrations must be positive, got %d", *maxConcurrentMigrations)
+	}
+	if *defaultConcurrency < 1 {
+		return fmt.Errorf("--default-concurrency must be positive, got %d", *defaultConcurrency)
+	}
+	if *defaultChunkSize < 1 {
+		return fmt.Errorf("--default-chunk-size must be positive, got %d", *defaultChunkSize)
+	}
+	if *maxConcurrency < 0 {
+		return fmt.Errorf("--max-concurrency must not be negative, got %d", *maxConcurrency)
+	}
+	if *sharding && *claimDuration < 3*time.Second {
+		return fmt.Errorf("--claim-duration must be at least 3s, got %v", *claimDuration)
+	}
+	schedule, err := maintenanceSchedule(*maintenanceWindows, *maintenanceTimeZone)
+	if err != nil {
+		return err
+	}
+	var identity string
+	if *sharding {
+		identity, err = leaderelection.Identity()
+		if err != nil {
+			return err
+		}
+	}
+	http.Handle("/metrics", promhttp.Handler())
+	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+	http.HandleFunc("/healthz", livenessHandler)
+	go func() { http.ListenAndServe(":2112", nil) }()
+
+	config, err := restConfig()
+	if err != nil {
+		return err
+	}
+	// The leader election does not share the rate limit and the
+	// backpressure of the migrations, so that it renews the Lease in time.
+	kube, err := kubernetes.NewForConfig(rest.CopyConfig(config))
+	if err != nil {
+		return err
+	}
+	// Only the writes of the objects feed the backpressure, not the
+	// status updates of the migrations.
+	dynamicConfig := rest.CopyConfig(config)
+	var backpressure *migrator.Backpressure
+	if *adaptiveBackpressure {
+		maxRate := *backpressureMaxRate
+		if maxRate <= 0 {
+			maxRate = float64(*kubeAPIQPS)
+		}
+		backpressure = migrator.NewBackpressure(migrator.BackpressureConfig{
+			MinRate:       *backpressureMinRate,
+			MaxRate:       maxRate,
+			MaxInFlight:   *maxConcurrency,
+			TargetLatency: *backpressureLatency,
+		})
+		dynamicConfig.Wrap(backpressure.WrapTransport)
+	}
+	dynamic, err := dynamic.NewForConfig(dynamicConfig)
 	if err != nil {
 		return err
 	}
@@ -77,7 +214,62 @@ func run(ctx context.Context) error {
 	c := controller.NewKubeMigrator(
 		dynamic,
 		migration,
+		controller.KubeMigratorConfig{
+			DefaultConcurrency: *defaultConcurrency,
+			MaxConcurrency:     *maxConcurrency,
+			DefaultChunkSize:   *defaultChunkSize,
+			ObjectsPerSecond:   *objectsPerSecond,
+			BytesPerSecond:     float64(*bytesPerSecond),
+			Backpressure:       backpressure,
+			DefaultSchedule:    schedule,
+			Identity:           identity,
+			ClaimDuration:      *claimDuration,
+		},
 	)
-	c.Run(ctx)
-	panic("unreachable")
+	retry := controller.NewRetryController(migration)
+	run := func(ctx context.Context) {
+		go retry.Run(ctx)
+		c.Run(ctx, *maxConcurrentMigrations)
+	}
+	if *sharding || !*leaderElect {
+		run(ctx)
+		return nil
+	}
+	return leaderelection.Run(ctx, kube, leaderelection.Config{
+		Namespace:     *leaderElectResourceNamespace,
+		Name:          *leaderElectResourceName,
+		LeaseDuration: *leaderElectLeaseDuration,
+		RenewDeadline: *leaderElectRenewDeadline,
+		RetryPeriod:   *leaderElectRetryPeriod,
+	}, run)
+}
+
+// maintenanceSchedule parses the --maintenance-window and
+// --maintenance-time-zone flags.
+func maintenanceSchedule(windows []string, timeZone string) (*migrationv1alpha1.MaintenanceSchedule, error) {
+	if len(windows) == 0 {
+		if len(timeZone) != 0 {
+			return nil, fmt.Errorf("--maintenance-time-zone requires --maintenance-window")
+		}
+		return nil, nil
+	}
+	schedule := &migrationv1alpha1.MaintenanceSchedule{TimeZone: timeZone}
+	for _, w := range windows {
+		i := strings.LastIndex(w, ";")
+		if i < 0 {
+			return nil, fmt.Errorf("--maintenance-window %q must be a cron expression and a duration separated by a semicolon", w)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(w[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("--maintenance-window %q: %v", w, err)
+		}
+		schedule.Windows = append(schedule.Windows, migrationv1alpha1.MaintenanceWindow{
+			Start:    strings.TrimSpace(w[:i]),
+			Duration: metav1.Duration{Duration: d},
+		})
+	}
+	if _, err := migrator.NewSchedule(schedule); err != nil {
+		return nil, fmt.Errorf("invalid maintenance windows: %v", err)
+	}
+	return schedule, nil
 }
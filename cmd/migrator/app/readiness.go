@@ -0,0 +1,91 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/discovery"
+
+	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/readiness"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/trigger"
+)
+
+// ExitNotReady is the exit status of the readiness command if some resources
+// are not ready. It fails with status 1 if the readiness cannot be checked.
+const ExitNotReady = 3
+
+// readinessOptions are the flags of the readiness command.
+type readinessOptions struct {
+	output           string
+	heartbeatTimeout time.Duration
+	policyFile       string
+}
+
+func newReadinessCommand() *cobra.Command {
+	o := &readinessOptions{}
+	c := &cobra.Command{
+		Use:   "readiness",
+		Short: "Check whether all resources are migrated to their current storage version",
+		Long: `Readiness reads all StorageStates and StorageVersionMigrations, and reports for every resource whether its objects are only persisted in the current storage version, whether the trigger controller checked its storage version recently, and whether one of its migrations is pending. The resources the API servers no longer serve are ignored.
+
+The command exits with status 0 if all resources are ready, i.e., it is safe to upgrade or downgrade the API servers, with status 3 if they are not, and with status 1 if the readiness cannot be checked, e.g., because of invalid flags or a failed API call.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runReadiness(cmd.Context(), cmd.OutOrStdout(), o)
+		},
+	}
+	c.Flags().StringVarP(&o.output, "output", "o", readiness.TableFormat, "The output format: table, json or junit.")
+	c.Flags().DurationVar(&o.heartbeatTimeout, "heartbeat-timeout", 2*trigger.DefaultDiscoveryPeriod, "How long after the trigger controller last checked the storage version of a resource its storage state is stale. Should be at least twice the --discovery-period of the trigger controller.")
+	c.Flags().StringVar(&o.policyFile, "policy-file", "", "The --policy-file of the trigger controller. The resources it excludes are ignored. If unset, all resources are checked.")
+	return c
+}
+
+func runReadiness(ctx context.Context, out io.Writer, o *readinessOptions) error {
+	if o.heartbeatTimeout <= 0 {
+		return fmt.Errorf("--heartbeat-timeout must be positive, got %v", o.heartbeatTimeout)
+	}
+	if err := readiness.ValidateFormat(o.output); err != nil {
+		return fmt.Errorf("invalid --output: %v", err)
+	}
+	var resourcePolicy *policy.Policy
+	if len(o.policyFile) > 0 {
+		p, err := policy.Load(o.policyFile)
+		if err != nil {
+			return err
+		}
+		resourcePolicy = p
+	}
+	config, err := restConfig()
+	if err != nil {
+		return err
+	}
+	client, err := migrationclient.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return err
+	}
+	report, err := readiness.Check(ctx, client, disco, resourcePolicy, o.heartbeatTimeout)
+	if err != nil {
+		return err
+	}
+	if err := report.Write(out, o.output, time.Now()); err != nil {
+		return err
+	}
+	if !report.Ready {
+		reasons := report.Reasons
+		if n := report.NotReady(); n > 0 {
+			reasons = append([]string{fmt.Sprintf("%d of %d resources are not ready", n, len(report.Resources))}, reasons...)
+		}
+		return &exitError{status: ExitNotReady, error: fmt.Errorf("%s", strings.Join(reasons, "; "))}
+	}
+	return nil
+}
@@ -4,13 +4,13 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 
-	"k8s.io/component-base/cli"
 	"sigs.k8s.io/kube-storage-version-migrator/cmd/migrator/app"
 )
 
 func main() {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
-	os.Exit(cli.Run(app.NewMigratorCommand(ctx)))
+	os.Exit(app.Run(app.NewMigratorCommand(ctx)))
 }
@@ -8,12 +8,18 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	crdclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/component-base/cli/flag"
+	apiserviceclient "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset"
 
 	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/leaderelection"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/trigger"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/verifier"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/version"
 )
 
@@ -23,6 +29,25 @@ const (
 
 var (
 	kubeconfigPath = pflag.String("kubeconfig", "", "absolute path to the kubeconfig file specifying the apiserver instance. If unspecified, fallback to in-cluster configuration")
+	etcdServers    = pflag.StringSlice("etcd-servers", nil, "the etcd servers of the apiserver. If set, the persisted storage versions of a resource are only refined after reading all objects of the resource from etcd verifies that they are stored in the current storage version. Objects encrypted at rest are not verified.")
+	etcdPrefix     = pflag.String("etcd-prefix", verifier.DefaultPrefix, "the prefix the apiserver stores objects under in etcd.")
+	etcdCAFile     = pflag.String("etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication.")
+	etcdCertFile   = pflag.String("etcd-certfile", "", "SSL certification file used to secure etcd communication.")
+	etcdKeyFile    = pflag.String("etcd-keyfile", "", "SSL key file used to secure etcd communication.")
+
+	policyFile      = pflag.String("policy-file", "", "path to a YAML file with the rules selecting the resources to migrate. If unset, all resources are migrated.")
+	discoveryPeriod = pflag.Duration("discovery-period", trigger.DefaultDiscoveryPeriod, "how often the trigger discovers all resources, in addition to discovering the resources of a group when its CustomResourceDefinitions or APIServices change.")
+	historyLimit    = pflag.Int("history-limit", trigger.DefaultHistoryLimit, "the number of completed migrations recorded in the history of the storage state of a resource. Zero disables the history.")
+	watchAPIs       = pflag.Bool("watch-apis", true, "watch CustomResourceDefinitions and APIServices, and discover the resources of a group as soon as they change. Requires permission to list and watch them; the periodic discovery runs either way. If false, storage version changes are only detected by the periodic discovery.")
+
+	leaderElect                  = pflag.Bool("leader-elect", false, "only run while holding a Lease, so that a single replica of the trigger updates the storage states at a time. Requires permission to manage Leases in the namespace of the Lease.")
+	leaderElectLeaseDuration     = pflag.Duration("leader-elect-lease-duration", leaderelection.DefaultLeaseDuration, "how long the other replicas wait after the leader last renewed the Lease before they take it over.")
+	leaderElectRenewDeadline     = pflag.Duration("leader-elect-renew-deadline", leaderelection.DefaultRenewDeadline, "how long the leader keeps trying to renew the Lease before it stops. Must be less than --leader-elect-lease-duration.")
+	leaderElectRetryPeriod       = pflag.Duration("leader-elect-retry-period", leaderelection.DefaultRetryPeriod, "how long the replicas wait between two attempts to acquire or renew the Lease.")
+	leaderElectResourceName      = pflag.String("leader-elect-resource-name", "storage-version-migration-trigger", "the name of the Lease.")
+	leaderElectResourceNamespace = pflag.String("leader-elect-resource-namespace", "", "the namespace of the Lease. Defaults to the namespace of the pod.")
+
+	storageVersionAPI = pflag.Bool("storage-version-api", false, "read the storage versions of the resources from the StorageVersion API (internal.apiserver.k8s.io), and only launch a migration once all apiservers agree on the storage version. Falls back to the discovery document for resources the API does not report, or if the API is not served.")
 )
 
 func NewTriggerCommand(ctx context.Context) *cobra.Command {
@@ -42,6 +67,9 @@ func NewTriggerCommand(ctx context.Context) *cobra.Command {
 }
 
 func run(ctx context.Context) error {
+	if *discoveryPeriod <= 0 {
+		return fmt.Errorf("--discovery-period must be positive, got %v", *discoveryPeriod)
+	}
 	livenessHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "ok")
 	})
@@ -67,7 +95,55 @@ func run(ctx context.Context) error {
 		return err
 	}
 	migration.DiscoveryClient.UseLegacyDiscovery = true
-	c := trigger.NewMigrationTrigger(migration)
-	c.Run(ctx)
-	panic("unreachable")
+	opts := []trigger.Option{trigger.WithDiscoveryPeriod(*discoveryPeriod), trigger.WithHistoryLimit(*historyLimit)}
+	if len(*policyFile) > 0 {
+		resourcePolicy, err := policy.Load(*policyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, trigger.WithPolicy(resourcePolicy))
+	}
+	if *watchAPIs {
+		crd, err := crdclient.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+		apiservice, err := apiserviceclient.NewForConfig(config)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, trigger.WithAPIWatches(crd.ApiextensionsV1().CustomResourceDefinitions(), apiservice.ApiregistrationV1().APIServices()))
+	}
+	kube, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	if *storageVersionAPI {
+		opts = append(opts, trigger.WithStorageVersionAPI(kube))
+	}
+	if len(*etcdServers) > 0 {
+		etcd, err := verifier.NewEtcdClient(verifier.EtcdConfig{
+			Servers:  *etcdServers,
+			CAFile:   *etcdCAFile,
+			CertFile: *etcdCertFile,
+			KeyFile:  *etcdKeyFile,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to connect to etcd: %v", err)
+		}
+		defer etcd.Close()
+		opts = append(opts, trigger.WithVerifier(verifier.NewVerifier(verifier.NewEtcdKV(etcd), *etcdPrefix)))
+	}
+	c := trigger.NewMigrationTrigger(migration, opts...)
+	if !*leaderElect {
+		c.Run(ctx)
+		return nil
+	}
+	return leaderelection.Run(ctx, kube, leaderelection.Config{
+		Namespace:     *leaderElectResourceNamespace,
+		Name:          *leaderElectResourceName,
+		LeaseDuration: *leaderElectLeaseDuration,
+		RenewDeadline: *leaderElectRenewDeadline,
+		RetryPeriod:   *leaderElectRetryPeriod,
+	}, c.Run)
 }
@@ -61,8 +61,166 @@ type StorageVersionMigrationSpec struct {
 	// migration.
 	// +optional
 	ContinueToken string `json:"continueToken,omitempty"`
-	// TODO: consider recording the storage version hash when the migration
-	// is created. It can avoid races.
+	// The number of objects the migrator migrates concurrently. If unset,
+	// the migrator uses its default. The migrator caps the value at its
+	// configured maximum.
+	// +optional
+	Concurrency int32 `json:"concurrency,omitempty"`
+	// The maximum number of objects the migrator lists in one request. If
+	// unset, the migrator uses its default. The migrator halves the chunk
+	// size when a list request times out or its response is too large.
+	// +optional
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+	// Limits the rate at which the migrator writes objects of the
+	// resource. The limits apply in addition to the migrator-wide limits.
+	// +optional
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// Determines how many objects may fail to migrate before the
+	// migration fails. If unset, the migration fails as soon as a chunk of
+	// objects contains an object that cannot be migrated.
+	// +optional
+	FailurePolicy *FailurePolicy `json:"failurePolicy,omitempty"`
+	// Determines whether and when a failed migration is retried. If unset,
+	// a failed migration is not retried.
+	// +optional
+	RetryPolicy *RetryPolicy `json:"retryPolicy,omitempty"`
+	// Suspend pauses the migration. A running migration stops after the
+	// chunk it is migrating, and resumes from .spec.continueToken once
+	// suspend is set to false.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+	// The namespaces whose objects are migrated, one namespace after
+	// another. If unset, objects in all namespaces are migrated. Must be
+	// unset for cluster-scoped resources.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// The namespaces whose objects are not migrated.
+	// +optional
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// Only the objects matching the label selector are migrated.
+	// +optional
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// Only the objects matching the field selector are migrated. The
+	// fields that can be selected depend on the resource.
+	// +optional
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// How the migrator writes the objects. Defaults to "Update".
+	// +optional
+	Strategy WriteStrategy `json:"strategy,omitempty"`
+	// Determines which objects are known to be stored in the current
+	// storage version already, and are not written. If unset, all objects
+	// are written.
+	// +optional
+	SkipPolicy *SkipPolicy `json:"skipPolicy,omitempty"`
+	// The storage version hash of the resource when the migration was
+	// created. The trigger controller only records that the resource is
+	// stored in the current storage version after the migration succeeds
+	// if the storage version has not changed since.
+	// +optional
+	TargetStorageVersionHash string `json:"targetStorageVersionHash,omitempty"`
+	// Schedule restricts the migration to maintenance windows. The
+	// migration pauses when a window closes, and resumes from
+	// .spec.continueToken when the next one opens. If unset, the default
+	// schedule of the migration controller applies.
+	// +optional
+	Schedule *MaintenanceSchedule `json:"schedule,omitempty"`
+}
+
+// MaintenanceSchedule is a set of time windows.
+type MaintenanceSchedule struct {
+	// The windows in which migrations may run.
+	Windows []MaintenanceWindow `json:"windows"`
+	// The time zone of the windows, as a name of the IANA Time Zone
+	// database, e.g., "Europe/Paris". Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// MaintenanceWindow is a time window that opens on a cron schedule.
+type MaintenanceWindow struct {
+	// When the window opens, in the standard cron format, e.g.,
+	// "0 22 * * 1-5" for 22:00 on weekdays.
+	Start string `json:"start"`
+	// How long the window stays open, e.g., "8h".
+	Duration metav1.Duration `json:"duration"`
+}
+
+// WriteStrategy is how the migrator writes objects to have them stored in the
+// current storage version.
+type WriteStrategy string
+
+const (
+	// The migrator updates the objects with their full content. An update
+	// conflicts if a controller writes the object at the same time, in
+	// which case the migrator gets the object and tries again.
+	UpdateWriteStrategy WriteStrategy = "Update"
+	// The migrator sends empty JSON merge patches, which never conflict.
+	MergePatchWriteStrategy WriteStrategy = "MergePatch"
+	// The migrator server-side applies a configuration without fields,
+	// with its own field manager. An apply that conflicts because the
+	// object has been written since it was listed is not retried.
+	ApplyWriteStrategy WriteStrategy = "Apply"
+)
+
+// Limits on the write rate of a migration.
+type RateLimit struct {
+	// The maximum number of objects written per second. Zero means no
+	// limit.
+	// +optional
+	ObjectsPerSecond int32 `json:"objectsPerSecond,omitempty"`
+	// The maximum number of bytes written per second, measured by the size
+	// of the JSON encoding of the objects. Zero means no limit.
+	// +optional
+	BytesPerSecond int64 `json:"bytesPerSecond,omitempty"`
+}
+
+// The ways to tell an object is stored in the current storage version already.
+// An object is skipped if any of them tells so.
+type SkipPolicy struct {
+	// Objects whose annotationKey annotation is set to annotationValue are
+	// skipped, e.g., because a mutating webhook records the storage
+	// version objects are written in.
+	// +optional
+	AnnotationKey string `json:"annotationKey,omitempty"`
+	// +optional
+	AnnotationValue string `json:"annotationValue,omitempty"`
+	// Objects whose .metadata.managedFields show they have been modified
+	// after the migration was created, with the version of the
+	// targetStorageVersionHash, are skipped. Only set it if all the API
+	// servers stored the resource in that storage version when the
+	// migration was created: the managed fields record the version of the
+	// request, not the storage version of the object, so an object
+	// modified through an API server still using an old storage version
+	// is skipped although it is stored in the old storage version.
+	// Ignored if targetStorageVersionHash is not set.
+	// +optional
+	ManagedFields bool `json:"managedFields,omitempty"`
+}
+
+// The number of objects a migration tolerates failing to migrate. An object
+// fails to migrate if the apiserver rejects the write with a non-retriable
+// error, e.g., a validating webhook rejects the object. A migration fails when
+// either limit is exceeded. If both limits are zero, no failure is tolerated.
+type FailurePolicy struct {
+	// The maximum number of objects that may fail to migrate.
+	// +optional
+	MaxFailures int32 `json:"maxFailures,omitempty"`
+	// The maximum percentage of the processed objects that may fail to
+	// migrate. It is evaluated once all objects have been processed.
+	// +optional
+	MaxFailurePercent int32 `json:"maxFailurePercent,omitempty"`
+}
+
+// The exponential backoff policy for retrying a failed migration. A retry
+// resumes the migration from .spec.continueToken.
+type RetryPolicy struct {
+	// The maximum number of times a failed migration is retried.
+	// +optional
+	MaxRetries int32 `json:"maxRetries,omitempty"`
+	// The delay before the first retry, in seconds. The delay doubles
+	// with every retry. Defaults to 30 seconds.
+	// +optional
+	BackoffSeconds int32 `json:"backoffSeconds,omitempty"`
 }
 
 type MigrationConditionType string
@@ -72,8 +230,22 @@ const (
 	MigrationRunning MigrationConditionType = "Running"
 	// Indicates that the migration has completed successfully.
 	MigrationSucceeded MigrationConditionType = "Succeeded"
+	// Indicates that the migration has completed, but some objects failed
+	// to migrate within the tolerance of the failure policy. Objects that
+	// failed to migrate might still be encoded in old storage versions.
+	MigrationSucceededWithErrors MigrationConditionType = "SucceededWithErrors"
 	// Indicates that the migration has failed.
 	MigrationFailed MigrationConditionType = "Failed"
+	// Indicates that the migration has failed, and has been retried
+	// .spec.retryPolicy.maxRetries times. It will not be retried again.
+	MigrationRetriesExhausted MigrationConditionType = "RetriesExhausted"
+	// Indicates that the migration is paused because .spec.suspend is set.
+	MigrationSuspended MigrationConditionType = "Suspended"
+	// Indicates that the migration succeeded, but the trigger controller
+	// found objects of the resource in etcd that are not stored in the
+	// storage version the migration migrated them to. The trigger
+	// controller launches a new migration at its next discovery.
+	MigrationVerificationFailed MigrationConditionType = "VerificationFailed"
 )
 
 // Describes the state of a migration at a certain point.
@@ -100,6 +272,102 @@ type StorageVersionMigrationStatus struct {
 	// +patchMergeKey=type
 	// +patchStrategy=merge
 	Conditions []MigrationCondition `json:"conditions,omitempty"`
+	// The progress of the migration.
+	// +optional
+	Progress *MigrationProgress `json:"progress,omitempty"`
+	// Objects that failed to migrate. At most 50 objects are listed;
+	// .status.progress.failed counts all of them.
+	// +optional
+	FailedObjects []FailedObject `json:"failedObjects,omitempty"`
+	// The number of times the migration has been retried after failing.
+	// +optional
+	Retries int32 `json:"retries,omitempty"`
+	// The time the failed migration will be retried. Unset if no retry is
+	// scheduled.
+	// +optional
+	NextRetryTime *metav1.Time `json:"nextRetryTime,omitempty"`
+	// The objects the migration covers. Unset until the migration starts
+	// running.
+	// +optional
+	Scope *MigrationScope `json:"scope,omitempty"`
+	// The migrator replica that runs the migration, when the migrations
+	// are shared between several replicas. Unset if no replica runs the
+	// migration.
+	// +optional
+	Claim *MigrationClaim `json:"claim,omitempty"`
+}
+
+// A claim of a migrator replica on a migration. Other replicas take the
+// migration over if the claim is not renewed in time.
+type MigrationClaim struct {
+	// The identity of the replica.
+	Holder string `json:"holder"`
+	// The last time the replica renewed the claim.
+	RenewTime metav1.Time `json:"renewTime"`
+	// How long after renewTime the claim expires.
+	DurationSeconds int32 `json:"durationSeconds"`
+}
+
+// The objects a migration covers. Objects excluded from the scope might still
+// be encoded in an old storage version.
+type MigrationScope struct {
+	// The namespaces the migration covers. Unset if the migration covers
+	// all namespaces.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// The namespaces whose objects have all been migrated. Only set if the
+	// migration covers a list of namespaces.
+	// +optional
+	CompletedNamespaces []string `json:"completedNamespaces,omitempty"`
+	// The namespaces the migration does not cover.
+	// +optional
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// The label selector objects have to match to be covered, in string
+	// form.
+	// +optional
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// The field selector objects have to match to be covered.
+	// +optional
+	FieldSelector string `json:"fieldSelector,omitempty"`
+}
+
+// MaxFailedObjects is the maximum number of objects listed in
+// .status.failedObjects.
+const MaxFailedObjects = 50
+
+// An object that failed to migrate.
+type FailedObject struct {
+	// The namespace of the object. Empty for cluster-scoped objects.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// The name of the object.
+	Name string `json:"name"`
+	// The reason the object failed to migrate.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// Progress of a migration. The remaining count is an estimate provided by the
+// apiserver when the migrator lists a chunk of objects, so objects created or
+// deleted during the migration make the estimates drift.
+type MigrationProgress struct {
+	// The number of objects migrated so far.
+	// +optional
+	Migrated int64 `json:"migrated,omitempty"`
+	// The number of objects that failed to migrate so far.
+	// +optional
+	Failed int64 `json:"failed,omitempty"`
+	// The estimated number of objects that remain to be migrated. Unset if
+	// the apiserver did not provide an estimate.
+	// +optional
+	Remaining *int64 `json:"remaining,omitempty"`
+	// The estimated total number of objects, i.e., migrated + failed +
+	// remaining.
+	// +optional
+	EstimatedTotal *int64 `json:"estimatedTotal,omitempty"`
+	// The estimated percentage of objects processed so far.
+	// +optional
+	Percent *int32 `json:"percent,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -172,6 +440,49 @@ type StorageStateStatus struct {
 	// discovery document and updates this field.
 	// +optional
 	LastHeartbeatTime metav1.Time `json:"lastHeartbeatTime,omitempty"`
+	// The storage versions the API servers encode spec.resource in, as
+	// reported by the StorageVersion API, while they disagree, e.g.,
+	// during a rolling upgrade. The current storage version is only
+	// updated once all API servers agree.
+	// +optional
+	ServerStorageVersions []ServerStorageVersion `json:"serverStorageVersions,omitempty"`
+	// The latest completed migrations of spec.resource, oldest first.
+	// The trigger controller only keeps a limited number of them.
+	// +optional
+	History []MigrationRecord `json:"history,omitempty"`
+}
+
+// A completed storage version migration.
+type MigrationRecord struct {
+	// The name of the storageVersionMigration.
+	MigrationName string `json:"migrationName"`
+	// The storage version hashes the objects might have been encoded in
+	// when the migration completed.
+	// +optional
+	FromStorageVersionHashes []string `json:"fromStorageVersionHashes,omitempty"`
+	// The storage version hash the objects were migrated to.
+	// +optional
+	ToStorageVersionHash string `json:"toStorageVersionHash,omitempty"`
+	// Whether the migration only covered a subset of the objects.
+	// +optional
+	Scoped bool `json:"scoped,omitempty"`
+	// The time the migration was created.
+	// +optional
+	StartTime metav1.Time `json:"startTime,omitempty"`
+	// The time the migration completed.
+	// +optional
+	FinishTime metav1.Time `json:"finishTime,omitempty"`
+	// How the migration completed: Succeeded, SucceededWithErrors or
+	// Failed.
+	Outcome MigrationConditionType `json:"outcome"`
+}
+
+// The storage version an API server encodes a resource in.
+type ServerStorageVersion struct {
+	// The ID of the API server.
+	APIServerID string `json:"apiServerID,omitempty"`
+	// The group/version the API server encodes objects in.
+	EncodingVersion string `json:"encodingVersion,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
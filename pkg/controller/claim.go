@@ -0,0 +1,231 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+)
+
+// releaseTimeout bounds how long a migrator that stops running a migration
+// tries to release its claim.
+const releaseTimeout = 10 * time.Second
+
+// errClaimLost is returned when this replica no longer holds the claim on a
+// migration.
+var errClaimLost = goerrors.New("the claim on the migration was lost")
+
+// sharded returns true if the migrations are shared with other replicas.
+func (km *KubeMigrator) sharded() bool {
+	return len(km.config.Identity) != 0
+}
+
+// claimDuration returns how long the claim lasts after it is renewed.
+func claimDuration(c *migrationv1alpha1.MigrationClaim) time.Duration {
+	return time.Duration(c.DurationSeconds) * time.Second
+}
+
+// observedClaim is the claim of another replica on a migration, and when this
+// replica saw it last change.
+type observedClaim struct {
+	holder    string
+	renewTime time.Time
+	observed  time.Time
+}
+
+// claimObserver times the claims of other replicas with the local clock. As
+// in the leader election of client-go, a claim expires once it has not
+// changed for its duration since this replica observed it, so that the
+// replicas do not depend on each other's clocks.
+type claimObserver struct {
+	sync.Mutex
+	claims map[string]observedClaim
+}
+
+func newClaimObserver() *claimObserver {
+	return &claimObserver{claims: make(map[string]observedClaim)}
+}
+
+// expiry records the claim on the named migration, and returns when it
+// expires.
+func (o *claimObserver) expiry(name string, c *migrationv1alpha1.MigrationClaim, now time.Time) time.Time {
+	o.Lock()
+	defer o.Unlock()
+	seen, ok := o.claims[name]
+	if !ok || seen.holder != c.Holder || !seen.renewTime.Equal(c.RenewTime.Time) {
+		seen = observedClaim{holder: c.Holder, renewTime: c.RenewTime.Time, observed: now}
+		o.claims[name] = seen
+	}
+	return seen.observed.Add(claimDuration(c))
+}
+
+// forget drops the claim recorded for the named migration.
+func (o *claimObserver) forget(name string) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.claims, name)
+}
+
+// claimedElsewhere returns how long until the claims of other replicas on m,
+// and on the other running migrations of the same resource, expire. It
+// returns zero if there are none, in which case this replica can claim m.
+//
+// The other migrations of the resource are read from the informer cache, and
+// claiming m only conflicts with concurrent claims on m itself. Two replicas
+// may thus claim two migrations of the same resource at the same time if
+// neither has seen the claim of the other yet. The trigger controller deletes
+// the previous migrations of a resource before it creates a new one, so this
+// only happens if migrations of the same resource are created by hand.
+func (km *KubeMigrator) claimedElsewhere(m *migrationv1alpha1.StorageVersionMigration, now time.Time) time.Duration {
+	migrations := []*migrationv1alpha1.StorageVersionMigration{m}
+	objs, err := km.migrationInformer.GetIndexer().ByIndex(ResourceIndex, ToIndex(m.Spec.Resource))
+	if err != nil {
+		utilruntime.HandleError(err)
+	}
+	for _, obj := range objs {
+		other, ok := obj.(*migrationv1alpha1.StorageVersionMigration)
+		if !ok || other.Name == m.Name || IsCompleted(other) {
+			continue
+		}
+		migrations = append(migrations, other)
+	}
+	var wait time.Duration
+	for _, other := range migrations {
+		c := other.Status.Claim
+		if c == nil || c.Holder == km.config.Identity {
+			km.claims.forget(other.Name)
+			continue
+		}
+		if d := km.claims.expiry(other.Name, c, now).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// claim claims m for this replica. If another replica holds an unexpired
+// claim on m, or on another migration of the same resource, it returns how
+// long until that claim expires instead. A claim that has expired, e.g.,
+// because its replica died, is taken over.
+func (km *KubeMigrator) claim(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) (*migrationv1alpha1.StorageVersionMigration, time.Duration, error) {
+	now := km.now()
+	if wait := km.claimedElsewhere(m, now); wait > 0 {
+		return m, wait, nil
+	}
+	if c := m.Status.Claim; c != nil && c.Holder != km.config.Identity {
+		klog.Infof("%v: taking over the migration from %s, whose claim was not renewed for %v", m.Name, c.Holder, claimDuration(c))
+	}
+	m = m.DeepCopy()
+	m.Status.Claim = &migrationv1alpha1.MigrationClaim{
+		Holder:          km.config.Identity,
+		RenewTime:       metav1.NewTime(now),
+		DurationSeconds: int32(km.config.ClaimDuration / time.Second),
+	}
+	// The update fails with a conflict if another replica claimed m
+	// meanwhile.
+	m, err := km.migrationClient.MigrationV1alpha1().StorageVersionMigrations().UpdateStatus(ctx, m, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	klog.V(2).Infof("%v: claimed the migration", m.Name)
+	return m, 0, nil
+}
+
+// updateClaim renews the claim of this replica on the migration, or releases
+// it. It returns errClaimLost if this replica does not hold the claim.
+func (km *KubeMigrator) updateClaim(ctx context.Context, name string, release bool) error {
+	client := km.migrationClient.MigrationV1alpha1().StorageVersionMigrations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		m, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if m.Status.Claim == nil || m.Status.Claim.Holder != km.config.Identity {
+			return errClaimLost
+		}
+		if release {
+			m.Status.Claim = nil
+		} else {
+			m.Status.Claim.RenewTime = metav1.NewTime(km.now())
+		}
+		_, err = client.UpdateStatus(ctx, m, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// renewClaim renews the claim on the migration every third of the claim
+// duration until ctx is done. If the claim is lost, or expires because it
+// could not be renewed in time, the migration is cancelled, because another
+// replica may take it over.
+func (km *KubeMigrator) renewClaim(ctx context.Context, name string) {
+	ticker := time.NewTicker(km.config.ClaimDuration / 3)
+	defer ticker.Stop()
+	expiry := km.now().Add(km.config.ClaimDuration)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := km.updateClaim(ctx, name, false)
+		switch {
+		case err == nil:
+			expiry = km.now().Add(km.config.ClaimDuration)
+			continue
+		case ctx.Err() != nil:
+			return
+		case goerrors.Is(err, errClaimLost) || errors.IsNotFound(err):
+			klog.Warningf("%v: lost the claim on the migration, stopping", name)
+		case km.now().Before(expiry):
+			utilruntime.HandleError(fmt.Errorf("%v: failed to renew the claim on the migration: %v", name, err))
+			continue
+		default:
+			klog.Warningf("%v: failed to renew the claim on the migration before it expired, stopping: %v", name, err)
+		}
+		// Another replica may already run the migration, so the
+		// migration is obsolete for this replica, which must not save
+		// its continue token over the one of the other replica.
+		km.running.cancel(name, fmt.Errorf("%w: %w", errClaimLost, migrator.ErrObsolete))
+		return
+	}
+}
+
+// releaseClaim releases the claim on the migration, so that another replica
+// can run it right away if it is not completed.
+func (km *KubeMigrator) releaseClaim(name string) {
+	// The claim is released even if the migrator is shutting down.
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	err := km.updateClaim(ctx, name, true)
+	if err != nil && !goerrors.Is(err, errClaimLost) && !errors.IsNotFound(err) {
+		utilruntime.HandleError(fmt.Errorf("%v: failed to release the claim on the migration: %v", name, err))
+		return
+	}
+	klog.V(2).Infof("%v: released the claim on the migration", name)
+}
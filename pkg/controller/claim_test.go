@@ -0,0 +1,236 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	clitesting "k8s.io/client-go/testing"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+)
+
+func newShardedMigrator(client *fake.Clientset, identity string, now time.Time) *KubeMigrator {
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{Identity: identity, ClaimDuration: 30 * time.Second})
+	km.now = func() time.Time { return now }
+	return km
+}
+
+func TestClaim(t *testing.T) {
+	ctx := context.TODO()
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	client := fake.NewSimpleClientset(pods)
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	a := newShardedMigrator(client, "a", now)
+	m, wait, err := a.claim(ctx, pods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 || m.Status.Claim == nil || m.Status.Claim.Holder != "a" {
+		t.Fatalf("expected a to claim the migration, got wait %v and claim %+v", wait, m.Status.Claim)
+	}
+
+	b := newShardedMigrator(client, "b", now.Add(10*time.Second))
+	if _, wait, err = b.claim(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if wait != 30*time.Second {
+		t.Errorf("expected b to wait 30s from when it saw the claim of a, got %v", wait)
+	}
+
+	b.now = func() time.Time { return now.Add(30 * time.Second) }
+	if _, wait, err = b.claim(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if wait != 10*time.Second {
+		t.Errorf("expected b to wait 10s more for the claim of a to expire, got %v", wait)
+	}
+
+	b.now = func() time.Time { return now.Add(40 * time.Second) }
+	m, wait, err = b.claim(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 0 || m.Status.Claim.Holder != "b" {
+		t.Errorf("expected b to take the expired claim over, got wait %v and claim %+v", wait, m.Status.Claim)
+	}
+	if err := a.updateClaim(ctx, "pods", false); !errors.Is(err, errClaimLost) {
+		t.Errorf("expected a to have lost its claim, got %v", err)
+	}
+}
+
+func TestClaimIgnoresClockSkew(t *testing.T) {
+	ctx := context.TODO()
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	client := fake.NewSimpleClientset(pods)
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	// The clock of a is an hour behind the clock of b.
+	a := newShardedMigrator(client, "a", now.Add(-time.Hour))
+	m, _, err := a.claim(ctx, pods)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newShardedMigrator(client, "b", now)
+	if _, wait, err := b.claim(ctx, m); err != nil || wait != 30*time.Second {
+		t.Fatalf("expected b to wait 30s for the claim of a, got wait %v and error %v", wait, err)
+	}
+
+	// a renews its claim 20s later; b times the claim from the renewal.
+	a.now = func() time.Time { return now.Add(-time.Hour + 20*time.Second) }
+	if err := a.updateClaim(ctx, "pods", false); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = client.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, "pods", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	b.now = func() time.Time { return now.Add(20 * time.Second) }
+	if _, wait, err := b.claim(ctx, m); err != nil || wait != 30*time.Second {
+		t.Errorf("expected b to wait 30s for the renewed claim of a, got wait %v and error %v", wait, err)
+	}
+}
+
+func TestClaimWaitsForSameResource(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	podsv1 := newMigrationForResource("podsv1", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	podsv1.Status.Claim = &migrationv1alpha1.MigrationClaim{Holder: "b", RenewTime: metav1.NewTime(now), DurationSeconds: 30}
+	podsv2 := newMigrationForResource("podsv2", migrationv1alpha1.GroupVersionResource{Version: "v2", Resource: "pods"})
+	client := fake.NewSimpleClientset(podsv1, podsv2)
+
+	a := newShardedMigrator(client, "a", now)
+	for _, m := range []*migrationv1alpha1.StorageVersionMigration{podsv1, podsv2} {
+		if err := a.migrationInformer.GetIndexer().Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, wait, err := a.claim(ctx, podsv2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait != 30*time.Second {
+		t.Errorf("expected a to wait for b to finish migrating pods, got %v", wait)
+	}
+}
+
+func TestRenewAndReleaseClaim(t *testing.T) {
+	ctx := context.TODO()
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	client := fake.NewSimpleClientset(pods)
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	a := newShardedMigrator(client, "a", now)
+	if _, _, err := a.claim(ctx, pods); err != nil {
+		t.Fatal(err)
+	}
+
+	later := now.Add(10 * time.Second)
+	a.now = func() time.Time { return later }
+	if err := a.updateClaim(ctx, "pods", false); err != nil {
+		t.Fatal(err)
+	}
+	m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Status.Claim.RenewTime.Time.Equal(later) {
+		t.Errorf("expected the claim to be renewed at %v, got %v", later, m.Status.Claim.RenewTime)
+	}
+
+	a.releaseClaim("pods")
+	m, err = client.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Status.Claim != nil {
+		t.Errorf("expected the claim to be released, got %+v", m.Status.Claim)
+	}
+}
+
+func TestLosingClaimStopsWithoutSavingToken(t *testing.T) {
+	ctx := context.TODO()
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	client := fake.NewSimpleClientset(pods)
+	dynamic := dynamicfake.NewSimpleDynamicClient(scheme.Scheme)
+	lists := 0
+	dynamic.PrependReactor("list", "pods", func(clitesting.Action) (bool, runtime.Object, error) {
+		lists++
+		chunk := &unstructured.UnstructuredList{Object: map[string]interface{}{"apiVersion": "v1", "kind": "PodList"}}
+		chunk.Items = []unstructured.Unstructured{{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Pod"}}}
+		chunk.Items[0].SetName(fmt.Sprintf("pod%d", lists))
+		chunk.Items[0].SetNamespace("default")
+		chunk.SetContinue(fmt.Sprintf("a%d", lists))
+		return true, chunk, nil
+	})
+	dynamic.PrependReactor("update", "pods", func(a clitesting.Action) (bool, runtime.Object, error) {
+		if lists == 1 {
+			return true, a.(clitesting.UpdateAction).GetObject(), nil
+		}
+		// Another replica takes the migration over during the second
+		// chunk, and advances it.
+		m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, "pods", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status.Claim.Holder != "b" {
+			m.Spec.ContinueToken = "b"
+			if m, err = client.MigrationV1alpha1().StorageVersionMigrations().Update(ctx, m, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			m.Status.Claim.Holder = "b"
+			if _, err := client.MigrationV1alpha1().StorageVersionMigrations().UpdateStatus(ctx, m, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return true, nil, apierrors.NewTooManyRequests("slow down", 60)
+	})
+
+	a := NewKubeMigrator(dynamic, client, KubeMigratorConfig{Identity: "a", ClaimDuration: 300 * time.Millisecond})
+	if err := a.migrationInformer.GetIndexer().Add(pods); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := a.process(ctx, "pods")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the migration to stop once the claim was lost")
+	}
+	m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Spec.ContinueToken != "b" {
+		t.Errorf("expected the continue token of b to be kept, got %q", m.Spec.ContinueToken)
+	}
+}
@@ -17,15 +17,41 @@ limitations under the License.
 package controller
 
 import (
+	"fmt"
+
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
 	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
 )
 
 func HasCondition(m *migrationv1alpha1.StorageVersionMigration, conditionType migrationv1alpha1.MigrationConditionType) bool {
 	return indexOfCondition(m, conditionType) != -1
 }
 
+// IsCompleted returns true if the migration has succeeded, with or without
+// errors, or has failed.
+func IsCompleted(m *migrationv1alpha1.StorageVersionMigration) bool {
+	return HasCondition(m, migrationv1alpha1.MigrationSucceeded) ||
+		HasCondition(m, migrationv1alpha1.MigrationSucceededWithErrors) ||
+		HasCondition(m, migrationv1alpha1.MigrationFailed)
+}
+
+// IsScoped returns true if m only covers a subset of the objects of the
+// resource.
+func IsScoped(m *migrationv1alpha1.StorageVersionMigration) bool {
+	return len(m.Spec.Namespaces) > 0 || len(m.Spec.ExcludeNamespaces) > 0 ||
+		m.Spec.LabelSelector != nil || len(m.Spec.FieldSelector) > 0
+}
+
+// isSuspended returns true if m is suspended and has stopped running.
+func isSuspended(m *migrationv1alpha1.StorageVersionMigration) bool {
+	return m.Spec.Suspend && HasCondition(m, migrationv1alpha1.MigrationSuspended)
+}
+
 func indexOfCondition(m *migrationv1alpha1.StorageVersionMigration, conditionType migrationv1alpha1.MigrationConditionType) int {
 	for i, c := range m.Status.Conditions {
 		if c.Type == conditionType && c.Status == corev1.ConditionTrue {
@@ -35,6 +61,16 @@ func indexOfCondition(m *migrationv1alpha1.StorageVersionMigration, conditionTyp
 	return -1
 }
 
+// StorageStateName returns the name of the storageState of the resource.
+func StorageStateName(resource migrationv1alpha1.GroupVersionResource) string {
+	// TODO: add this rule to the CRD validation
+	// TODO: we might use ResourceID as the name in the future.
+	if resource.Group == "" {
+		return resource.Resource
+	}
+	return resource.Resource + "." + resource.Group
+}
+
 func resource(m *migrationv1alpha1.StorageVersionMigration) schema.GroupVersionResource {
 	return schema.GroupVersionResource{
 		Group:    m.Spec.Resource.Group,
@@ -42,3 +78,66 @@ func resource(m *migrationv1alpha1.StorageVersionMigration) schema.GroupVersionR
 		Resource: m.Spec.Resource.Resource,
 	}
 }
+
+// rateLimiter returns the rate limiter dedicated to m, or nil if m does not
+// limit its write rate.
+func rateLimiter(m *migrationv1alpha1.StorageVersionMigration) *migrator.RateLimiter {
+	if m.Spec.RateLimit == nil {
+		return nil
+	}
+	return migrator.NewRateLimiter(float64(m.Spec.RateLimit.ObjectsPerSecond), float64(m.Spec.RateLimit.BytesPerSecond))
+}
+
+// scope returns the objects m covers. Excluded namespaces are dropped from
+// the namespaces to migrate, or, if m covers all namespaces, excluded by the
+// field selector.
+func scope(m *migrationv1alpha1.StorageVersionMigration) (migrator.Scope, error) {
+	var s migrator.Scope
+	excluded := sets.NewString(m.Spec.ExcludeNamespaces...)
+	for _, namespace := range m.Spec.Namespaces {
+		if !excluded.Has(namespace) {
+			s.Namespaces = append(s.Namespaces, namespace)
+		}
+	}
+	if len(m.Spec.Namespaces) > 0 && len(s.Namespaces) == 0 {
+		return s, fmt.Errorf("all the namespaces of the migration are excluded")
+	}
+	if m.Spec.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(m.Spec.LabelSelector)
+		if err != nil {
+			return s, fmt.Errorf("invalid label selector: %v", err)
+		}
+		s.LabelSelector = selector.String()
+	}
+	var selectors []fields.Selector
+	if len(m.Spec.FieldSelector) > 0 {
+		selector, err := fields.ParseSelector(m.Spec.FieldSelector)
+		if err != nil {
+			return s, fmt.Errorf("invalid field selector: %v", err)
+		}
+		selectors = append(selectors, selector)
+	}
+	if len(s.Namespaces) == 0 {
+		for _, namespace := range excluded.List() {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", namespace))
+		}
+	}
+	if len(selectors) > 0 {
+		s.FieldSelector = fields.AndSelectors(selectors...).String()
+	}
+	return s, nil
+}
+
+// strategy returns how the objects of m are written.
+func strategy(m *migrationv1alpha1.StorageVersionMigration) (migrator.Strategy, error) {
+	switch m.Spec.Strategy {
+	case "", migrationv1alpha1.UpdateWriteStrategy:
+		return migrator.NewUpdateStrategy(), nil
+	case migrationv1alpha1.MergePatchWriteStrategy:
+		return migrator.NewMergePatchStrategy(), nil
+	case migrationv1alpha1.ApplyWriteStrategy:
+		return migrator.NewApplyStrategy(migrator.DefaultFieldManager), nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", m.Spec.Strategy)
+	}
+}
@@ -31,6 +31,7 @@ const (
 	StatusRunning   = "Running"
 	StatusPending   = "Pending"
 	StatusCompleted = "Completed"
+	StatusSuspended = "Suspended"
 
 	ResourceIndex = "Resource"
 )
@@ -41,9 +42,12 @@ func migrationStatusIndexFunc(obj interface{}) ([]string, error) {
 	if !ok {
 		return []string{}, fmt.Errorf("expected StroageVersionMigration, got %#v", reflect.TypeOf(obj))
 	}
-	if HasCondition(m, migration_v1alpha1.MigrationSucceeded) || HasCondition(m, migration_v1alpha1.MigrationFailed) {
+	if IsCompleted(m) {
 		return []string{StatusCompleted}, nil
 	}
+	if HasCondition(m, migration_v1alpha1.MigrationSuspended) {
+		return []string{StatusSuspended}, nil
+	}
 	if HasCondition(m, migration_v1alpha1.MigrationRunning) {
 		return []string{StatusRunning}, nil
 	}
@@ -59,12 +59,13 @@ func TestStatusIndexedInformer(t *testing.T) {
 	running := newMigration("Running", migrationv1alpha1.MigrationRunning)
 	succeeded := newMigration("Succeeded", migrationv1alpha1.MigrationSucceeded)
 	failed := newMigration("Failed", migrationv1alpha1.MigrationFailed)
+	suspended := newMigration("Suspended", migrationv1alpha1.MigrationSuspended)
 	pending := &migrationv1alpha1.StorageVersionMigration{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "Pending",
 		},
 	}
-	client := fake.NewSimpleClientset(running, succeeded, failed, pending)
+	client := fake.NewSimpleClientset(running, succeeded, failed, suspended, pending)
 	informer := NewStatusIndexedInformer(client)
 
 	stopCh := make(chan struct{})
@@ -86,6 +87,13 @@ func TestStatusIndexedInformer(t *testing.T) {
 	if e, a := pending, ret[0]; !reflect.DeepEqual(e, a) {
 		t.Errorf("expected %v, got %v", e, a)
 	}
+	ret, err = informer.GetIndexer().ByIndex(StatusIndex, StatusSuspended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := suspended, ret[0]; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected %v, got %v", e, a)
+	}
 	ret, err = informer.GetIndexer().ByIndex(StatusIndex, StatusCompleted)
 	if err != nil {
 		t.Fatal(err)
@@ -18,16 +18,21 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
@@ -35,60 +40,219 @@ import (
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
 )
 
+// A migration that cannot start because another migration of the same
+// resource is in progress is retried after resourceBusyDelay.
+const resourceBusyDelay = 5 * time.Second
+
+// KubeMigratorConfig holds the settings a KubeMigrator applies to every
+// migration.
+type KubeMigratorConfig struct {
+	// DefaultConcurrency is the number of objects migrated concurrently
+	// when a migration does not set .spec.concurrency.
+	DefaultConcurrency int
+	// MaxConcurrency caps the number of objects migrated concurrently by
+	// all running migrations together, and thus by each of them. Zero
+	// means no cap.
+	MaxConcurrency int
+	// DefaultChunkSize is the number of objects listed in one request
+	// when a migration does not set .spec.chunkSize.
+	DefaultChunkSize int64
+	// ObjectsPerSecond and BytesPerSecond limit the combined write rate
+	// of all migrations. Zero means no limit.
+	ObjectsPerSecond float64
+	BytesPerSecond   float64
+	// Backpressure, if not nil, adapts the write rate and concurrency of
+	// all migrations to the congestion of the apiserver.
+	Backpressure *migrator.Backpressure
+	// DefaultSchedule, if not nil, restricts the migrations that do not
+	// set .spec.schedule to maintenance windows.
+	DefaultSchedule *migrationv1alpha1.MaintenanceSchedule
+	// Identity, if not empty, makes the migrator share the migrations with
+	// other replicas. A replica only runs a migration after claiming it
+	// in .status.claim, and renews the claim while the migration runs.
+	// Other replicas take the migration over if the claim is not renewed
+	// within ClaimDuration.
+	Identity      string
+	ClaimDuration time.Duration
+	// Metrics records the progress and the outcome of the migrations. If
+	// nil, they are recorded in metrics.Metrics.
+	Metrics *metrics.CoreMigratorMetrics
+}
+
 // KubeMigrator monitors storageVersionMigraiton objects, fulfills the
 // migration, and updates the status of the storageVersionMigration objects.
 type KubeMigrator struct {
 	dynamic           dynamic.Interface
 	migrationClient   migrationclient.Interface
 	migrationInformer cache.SharedIndexInformer
+	queue             workqueue.RateLimitingInterface
+	// resources guards against two workers migrating the same resource at
+	// the same time.
+	resources *resourceLock
+	// running holds the cancel functions of the running migrations.
+	running *runningMigrations
+	// claims times the claims of other replicas when the migrations are
+	// sharded.
+	claims *claimObserver
+	config KubeMigratorConfig
+	// rateLimiter and concurrencyLimit are shared by all migrations.
+	rateLimiter      *migrator.RateLimiter
+	concurrencyLimit *migrator.ConcurrencyLimit
+	now              func() time.Time
 }
 
 // NewKubeMigrator creates KubeMigrator.
-func NewKubeMigrator(dynamic dynamic.Interface, migrationClient migrationclient.Interface) *KubeMigrator {
-	informer := NewStatusIndexedInformer(migrationClient)
-	return &KubeMigrator{
+func NewKubeMigrator(dynamic dynamic.Interface, migrationClient migrationclient.Interface, config KubeMigratorConfig) *KubeMigrator {
+	informer := NewStatusAndResourceIndexedInformer(migrationClient)
+	km := &KubeMigrator{
 		dynamic:           dynamic,
 		migrationClient:   migrationClient,
 		migrationInformer: informer,
+		queue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "storage_version_migration_migrator"),
+		resources:         newResourceLock(),
+		running:           newRunningMigrations(),
+		claims:            newClaimObserver(),
+		config:            config,
+		rateLimiter:       migrator.NewRateLimiter(config.ObjectsPerSecond, config.BytesPerSecond),
+		concurrencyLimit:  migrator.NewConcurrencyLimit(config.MaxConcurrency),
+		now:               time.Now,
 	}
+	if km.config.Metrics == nil {
+		km.config.Metrics = metrics.Metrics
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: km.enqueueMigration,
+		UpdateFunc: func(old, obj interface{}) {
+			km.cancelIfObsolete(old, obj)
+			km.enqueueMigration(obj)
+		},
+		DeleteFunc: km.cancelMigration,
+	})
+	return km
 }
 
-func (km *KubeMigrator) Run(ctx context.Context) {
+// Run starts workers that process storageVersionMigrations in parallel.
+// Migrations of the same resource are never processed at the same time.
+// Once ctx is done, Run waits for the running migrations to stop and save
+// their continue tokens before it returns.
+func (km *KubeMigrator) Run(ctx context.Context, workers int) {
 	defer utilruntime.HandleCrash()
+	defer km.queue.ShutDown()
 	go km.migrationInformer.Run(ctx.Done())
 	if !cache.WaitForCacheSync(ctx.Done(), km.migrationInformer.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Unable to sync caches"))
 		return
 	}
-	wait.UntilWithContext(ctx, km.process, time.Second)
+	klog.V(2).Infof("starting %d migration workers", workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			wait.UntilWithContext(ctx, km.runWorker, time.Second)
+		}()
+	}
+	<-ctx.Done()
+	km.queue.ShutDown()
+	wg.Wait()
+	klog.V(2).Infof("migration workers stopped")
 }
 
-func (km *KubeMigrator) process(ctx context.Context) {
-	// KubeMigrator has only one worker, so it doesn't need to use a
-	// workqueue to ensure only there is a single thread processing a
-	// storageVersionMigration.
-
-	// The already "Running" storageVersionMigrations are the priority.
-	runnings, err := km.migrationInformer.GetIndexer().ByIndex(StatusIndex, StatusRunning)
-	if err != nil {
-		utilruntime.HandleError(err)
+func (km *KubeMigrator) enqueueMigration(obj interface{}) {
+	m, ok := obj.(*migrationv1alpha1.StorageVersionMigration)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected StorageVersionMigration, got %#v", reflect.TypeOf(obj)))
 		return
 	}
-	if len(runnings) != 0 {
-		utilruntime.HandleError(km.processOne(ctx, runnings[0]))
+	if IsCompleted(m) || isSuspended(m) {
 		return
 	}
-
-	// The next priority is the pending storageVersionMigrations.
-	pendings, err := km.migrationInformer.GetIndexer().ByIndex(StatusIndex, StatusPending)
+	key, err := cache.MetaNamespaceKeyFunc(m)
 	if err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
-	if len(pendings) != 0 {
-		utilruntime.HandleError(km.processOne(ctx, pendings[0]))
+	km.queue.Add(key)
+}
+
+// cancelIfObsolete interrupts the running migration if the update makes it
+// pointless to continue: the migration has been recreated, retargeted, or
+// completed by someone else.
+func (km *KubeMigrator) cancelIfObsolete(oldObj, obj interface{}) {
+	old, ok := oldObj.(*migrationv1alpha1.StorageVersionMigration)
+	if !ok {
+		return
+	}
+	m, ok := obj.(*migrationv1alpha1.StorageVersionMigration)
+	if !ok {
+		return
+	}
+	if old.UID != m.UID || old.Spec.Resource != m.Spec.Resource || (!IsCompleted(old) && IsCompleted(m)) {
+		km.running.cancel(m.Name, migrator.ErrObsolete)
+	}
+}
+
+// cancelMigration interrupts the running migration that has been deleted.
+func (km *KubeMigrator) cancelMigration(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	m, ok := obj.(*migrationv1alpha1.StorageVersionMigration)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected StorageVersionMigration, got %#v", reflect.TypeOf(obj)))
 		return
 	}
+	km.running.cancel(m.Name, migrator.ErrObsolete)
+	km.claims.forget(m.Name)
+}
+
+func (km *KubeMigrator) runWorker(ctx context.Context) {
+	for km.processNextWorkItem(ctx) {
+	}
+}
+
+func (km *KubeMigrator) processNextWorkItem(ctx context.Context) bool {
+	key, quit := km.queue.Get()
+	if quit {
+		return false
+	}
+	defer km.queue.Done(key)
+
+	requeue, err := km.process(ctx, key.(string))
+	switch {
+	case err != nil:
+		utilruntime.HandleError(fmt.Errorf("failed to process %v: %v", key, err))
+		km.queue.AddRateLimited(key)
+	case requeue:
+		km.queue.AddAfter(key, resourceBusyDelay)
+	default:
+		km.queue.Forget(key)
+	}
+	return true
+}
+
+// process migrates the storageVersionMigration identified by key. It returns
+// true if the migration has to wait for another migration of the same
+// resource to finish.
+func (km *KubeMigrator) process(ctx context.Context, key string) (bool, error) {
+	obj, exists, err := km.migrationInformer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	m, ok := obj.(*migrationv1alpha1.StorageVersionMigration)
+	if !ok {
+		return false, fmt.Errorf("expected StorageVersionMigration, got %#v", reflect.TypeOf(obj))
+	}
+	r := ToIndex(m.Spec.Resource)
+	if !km.resources.tryLock(r) {
+		klog.V(4).Infof("%v: waiting for another migration of %s to finish", m.Name, r)
+		return true, nil
+	}
+	defer km.resources.unlock(r)
+	return false, km.processOne(ctx, m)
 }
 
 func (km *KubeMigrator) processOne(ctx context.Context, obj interface{}) error {
@@ -102,39 +266,335 @@ func (km *KubeMigrator) processOne(ctx context.Context, obj interface{}) error {
 	if err != nil {
 		return err
 	}
-	if HasCondition(m, migrationv1alpha1.MigrationSucceeded) || HasCondition(m, migrationv1alpha1.MigrationFailed) {
+	if IsCompleted(m) {
 		klog.V(2).Infof("%v: migration has already completed", m.Name)
 		return nil
 	}
+	if m.Spec.Suspend {
+		if !HasCondition(m, migrationv1alpha1.MigrationSuspended) {
+			if _, err := km.updateStatus(ctx, m, migrationv1alpha1.MigrationSuspended, ""); err != nil {
+				return err
+			}
+		}
+		klog.V(2).Infof("%v: migration suspended", m.Name)
+		return nil
+	}
+	schedule, err := km.schedule(m)
+	if err != nil {
+		return km.fail(ctx, m, err)
+	}
+	if waiting, err := km.waitForWindow(ctx, m, schedule); err != nil || waiting {
+		return err
+	}
+	if km.sharded() {
+		var wait time.Duration
+		m, wait, err = km.claim(ctx, m)
+		if err != nil {
+			return err
+		}
+		if wait > 0 {
+			klog.V(4).Infof("%v: waiting for another replica to finish the migration", m.Name)
+			key, err := cache.MetaNamespaceKeyFunc(m)
+			if err != nil {
+				return err
+			}
+			km.queue.AddAfter(key, wait)
+			return nil
+		}
+		defer km.releaseClaim(m.Name)
+	}
+	s, err := scope(m)
+	if err != nil {
+		return km.fail(ctx, m, err)
+	}
+	if len(s.Namespaces) > 0 {
+		// Listing a cluster-scoped resource in a namespace is not
+		// found, which would pass for a deleted resource.
+		namespaced, err := km.namespaced(m)
+		if err != nil {
+			return err
+		}
+		if !namespaced {
+			return km.fail(ctx, m, fmt.Errorf(".spec.namespaces is set, but %s is not namespaced", resource(m).GroupResource()))
+		}
+	}
+	writeStrategy, err := strategy(m)
+	if err != nil {
+		return km.fail(ctx, m, err)
+	}
+	m, err = km.recordScope(ctx, m, s)
+	if err != nil {
+		return err
+	}
 	m, err = km.updateStatus(ctx, m, migrationv1alpha1.MigrationRunning, "")
 	klog.V(2).Infof("%v: migration running", m.Name)
 	if err != nil {
 		return err
 	}
-	progressTracker := migrator.NewProgressTracker(km.migrationClient.MigrationV1alpha1().StorageVersionMigrations(), m.Name)
-	core := migrator.NewMigrator(resource(m), km.dynamic, progressTracker)
-	// If the storageVersionMigration object is deleted during Run(), Run()
-	// will return an error when it tries to write the continueToken into the
-	// migration object. Thus, it's not necessary to register a deletion
-	// event handler with the migrationInformer to interrupt the Run().
-	err = core.Run(ctx)
+	// The migration is cancelled if the object is deleted or replaced
+	// while it runs. See cancelIfObsolete and cancelMigration.
+	migrationCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	km.running.add(m.Name, cancel)
+	defer km.running.remove(m.Name)
+	if km.sharded() {
+		go km.renewClaim(migrationCtx, m.Name)
+	}
+	progressTracker := migrator.NewProgressTracker(km.migrationClient.MigrationV1alpha1().StorageVersionMigrations(), m.Name, migrator.WithDefaultSchedule(km.config.DefaultSchedule))
+	opts := []migrator.Option{
+		migrator.WithConcurrency(km.concurrency(m)),
+		migrator.WithConcurrencyLimit(km.concurrencyLimit),
+		migrator.WithChunkSize(km.chunkSize(m)),
+		migrator.WithRateLimiter(km.rateLimiter),
+		migrator.WithRateLimiter(rateLimiter(m)),
+		migrator.WithBackpressure(km.config.Backpressure),
+		migrator.WithFailurePolicy(m.Spec.FailurePolicy),
+		migrator.WithScope(s),
+		migrator.WithStrategy(writeStrategy),
+		migrator.WithLogger(klog.FromContext(ctx).WithValues("migration", m.Name)),
+		migrator.WithMetrics(km.config.Metrics),
+	}
+	for _, checker := range checkers(m) {
+		opts = append(opts, migrator.WithChecker(checker))
+	}
+	core := migrator.NewMigrator(resource(m), km.dynamic, progressTracker, opts...)
+	err = core.Run(migrationCtx)
+	if migrationCtx.Err() != nil {
+		// The migration object is gone or obsolete, or the migrator is
+		// shutting down or lost its leadership. Either way, there is no
+		// status to report.
+		klog.V(2).Infof("%v: migration interrupted: %v", m.Name, err)
+		// The replica that took the claim over resets the migration
+		// itself if needed.
+		if cause := context.Cause(migrationCtx); errors.Is(cause, migrator.ErrObsolete) && !errors.Is(cause, errClaimLost) {
+			return km.resetIfRetargeted(ctx, m)
+		}
+		return nil
+	}
+	if errors.Is(err, migrator.ErrSuspended) {
+		return km.suspend(ctx, m)
+	}
 	utilruntime.HandleError(err)
 	if err == nil {
 		if _, err := km.updateStatus(ctx, m, migrationv1alpha1.MigrationSucceeded, ""); err != nil {
 			utilruntime.HandleError(err)
 		}
-		metrics.Metrics.ObserveSucceededMigration(resource(m).String())
+		km.config.Metrics.ObserveSucceededMigration(resource(m).String())
 		klog.V(2).Infof("%v: migration succeeded", m.Name)
 		return err
 	}
+	var tolerated *migrator.ErrToleratedFailures
+	if errors.As(err, &tolerated) {
+		if _, err := km.updateStatus(ctx, m, migrationv1alpha1.MigrationSucceededWithErrors, tolerated.Error()); err != nil {
+			utilruntime.HandleError(err)
+		}
+		km.config.Metrics.ObserveSucceededWithErrorsMigration(resource(m).String())
+		klog.Warningf("%v: migration succeeded with errors: %v", m.Name, tolerated)
+		return nil
+	}
+	return km.fail(ctx, m, err)
+}
+
+// resetIfRetargeted clears the progress of m if it has been retargeted at
+// another resource since it started: the continue token and the completed
+// namespaces are only valid for the resource they were recorded for, and the
+// counts and failed objects would count against the new resource.
+func (km *KubeMigrator) resetIfRetargeted(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) error {
+	client := km.migrationClient.MigrationV1alpha1().StorageVersionMigrations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := client.Get(ctx, m.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if latest.UID != m.UID || latest.Spec.Resource == m.Spec.Resource {
+			return nil
+		}
+		klog.V(2).Infof("%v: migration retargeted from %v to %v, clearing its progress", m.Name, m.Spec.Resource, latest.Spec.Resource)
+		if len(latest.Spec.ContinueToken) > 0 {
+			latest.Spec.ContinueToken = ""
+			if latest, err = client.Update(ctx, latest, metav1.UpdateOptions{}); err != nil {
+				return err
+			}
+		}
+		latest.Status.Progress = nil
+		latest.Status.FailedObjects = nil
+		if latest.Status.Scope != nil {
+			latest.Status.Scope.CompletedNamespaces = nil
+		}
+		_, err = client.UpdateStatus(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// suspend records that the migration stopped because it was suspended or
+// because its maintenance window closed.
+func (km *KubeMigrator) suspend(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) error {
+	m, err := km.migrationClient.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, m.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !m.Spec.Suspend {
+		schedule, err := km.schedule(m)
+		if err != nil {
+			return km.fail(ctx, m, err)
+		}
+		if waiting, err := km.waitForWindow(ctx, m, schedule); err != nil || waiting {
+			return err
+		}
+		// The schedule changed since, the migration can go on.
+		key, err := cache.MetaNamespaceKeyFunc(m)
+		if err != nil {
+			return err
+		}
+		km.queue.Add(key)
+		return nil
+	}
+	if _, err := km.updateStatus(ctx, m, migrationv1alpha1.MigrationSuspended, ""); err != nil {
+		utilruntime.HandleError(err)
+	}
+	klog.V(2).Infof("%v: migration suspended", m.Name)
+	return nil
+}
+
+// namespaced returns false if the discovery document tells the resource of m
+// is cluster-scoped. A resource the apiserver does not serve is taken as
+// namespaced; migrating it finds it gone.
+func (km *KubeMigrator) namespaced(m *migrationv1alpha1.StorageVersionMigration) (bool, error) {
+	gv := resource(m).GroupVersion()
+	resources, err := km.migrationClient.Discovery().ServerResourcesForGroupVersion(gv.String())
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to discover the resources of %s: %v", gv, err)
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == m.Spec.Resource.Resource {
+			return resource.Namespaced, nil
+		}
+	}
+	return true, nil
+}
+
+// schedule returns the maintenance schedule of m.
+func (km *KubeMigrator) schedule(m *migrationv1alpha1.StorageVersionMigration) (*migrator.Schedule, error) {
+	if m.Spec.Schedule != nil {
+		return migrator.NewSchedule(m.Spec.Schedule)
+	}
+	return migrator.NewSchedule(km.config.DefaultSchedule)
+}
+
+// waitForWindow returns true if m is outside its maintenance windows. The
+// migration is then marked as suspended, and processed again when the next
+// window opens.
+func (km *KubeMigrator) waitForWindow(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration, schedule *migrator.Schedule) (bool, error) {
+	now := km.now()
+	next := schedule.NextOpen(now)
+	if !next.After(now) {
+		return false, nil
+	}
+	key, err := cache.MetaNamespaceKeyFunc(m)
+	if err != nil {
+		return true, err
+	}
+	message := fmt.Sprintf("outside the maintenance windows, resuming at %s", next.Format(time.RFC3339))
+	if i := indexOfCondition(m, migrationv1alpha1.MigrationSuspended); i == -1 || m.Status.Conditions[i].Message != message {
+		if _, err := km.updateStatus(ctx, m, migrationv1alpha1.MigrationSuspended, message); err != nil {
+			return true, err
+		}
+	}
+	klog.V(2).Infof("%v: %s", m.Name, message)
+	km.queue.AddAfter(key, next.Sub(now))
+	return true, nil
+}
+
+// fail marks the migration as failed because of err, and returns err.
+func (km *KubeMigrator) fail(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration, err error) error {
 	klog.Errorf("%v: migration failed: %v", m.Name, err)
 	if _, err := km.updateStatus(ctx, m, migrationv1alpha1.MigrationFailed, err.Error()); err != nil {
 		utilruntime.HandleError(err)
 	}
-	metrics.Metrics.ObserveFailedMigration(resource(m).String())
+	km.config.Metrics.ObserveFailedMigration(resource(m).String())
 	return err
 }
 
+// concurrency returns the number of objects to migrate concurrently for m.
+func (km *KubeMigrator) concurrency(m *migrationv1alpha1.StorageVersionMigration) int {
+	concurrency := km.config.DefaultConcurrency
+	if m.Spec.Concurrency > 0 {
+		concurrency = int(m.Spec.Concurrency)
+	}
+	if km.config.MaxConcurrency > 0 && concurrency > km.config.MaxConcurrency {
+		concurrency = km.config.MaxConcurrency
+	}
+	return concurrency
+}
+
+// chunkSize returns the number of objects to list in one request for m.
+func (km *KubeMigrator) chunkSize(m *migrationv1alpha1.StorageVersionMigration) int64 {
+	if m.Spec.ChunkSize > 0 {
+		return m.Spec.ChunkSize
+	}
+	return km.config.DefaultChunkSize
+}
+
+// checkers returns the checkers that tell which objects of m are stored in
+// the current storage version already. Objects are only skipped by their
+// managed fields if the migration opts in, and records the storage version it
+// migrates to.
+func checkers(m *migrationv1alpha1.StorageVersionMigration) []migrator.Checker {
+	policy := m.Spec.SkipPolicy
+	if policy == nil {
+		return nil
+	}
+	var checkers []migrator.Checker
+	if len(policy.AnnotationKey) > 0 {
+		checkers = append(checkers, migrator.NewAnnotationChecker(policy.AnnotationKey, policy.AnnotationValue))
+	}
+	if policy.ManagedFields {
+		if len(m.Spec.TargetStorageVersionHash) > 0 {
+			checkers = append(checkers, migrator.NewManagedFieldsChecker(m.Spec.TargetStorageVersionHash, m.CreationTimestamp.Time))
+		} else {
+			klog.Warningf("%v: not skipping objects by their managed fields, the migration does not record its target storage version", m.Name)
+		}
+	}
+	return checkers
+}
+
+// recordScope records the objects the migration covers in its status, keeping
+// track of the namespaces that have already been migrated.
+func (km *KubeMigrator) recordScope(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration, s migrator.Scope) (*migrationv1alpha1.StorageVersionMigration, error) {
+	client := km.migrationClient.MigrationV1alpha1().StorageVersionMigrations()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scope := &migrationv1alpha1.MigrationScope{
+			Namespaces:        s.Namespaces,
+			ExcludeNamespaces: m.Spec.ExcludeNamespaces,
+			LabelSelector:     s.LabelSelector,
+			FieldSelector:     m.Spec.FieldSelector,
+		}
+		if m.Status.Scope != nil {
+			scope.CompletedNamespaces = m.Status.Scope.CompletedNamespaces
+		}
+		if reflect.DeepEqual(scope, m.Status.Scope) {
+			return nil
+		}
+		m.Status.Scope = scope
+		updated, err := client.UpdateStatus(ctx, m, metav1.UpdateOptions{})
+		if err == nil {
+			m = updated
+			return nil
+		}
+		if refreshed, getErr := client.Get(ctx, m.Name, metav1.GetOptions{}); getErr == nil {
+			m = refreshed
+		}
+		return err
+	})
+	return m, err
+}
+
 // updateStatus always retries no matter what kind of error is returned by the
 // apiserver, because it's a pity to start over the entire migration merely
 // because a status update failure.
@@ -152,7 +612,9 @@ func (km *KubeMigrator) updateStatus(ctx context.Context, m *migrationv1alpha1.S
 			switch c.Type {
 			case migrationv1alpha1.MigrationRunning:
 			case migrationv1alpha1.MigrationSucceeded:
+			case migrationv1alpha1.MigrationSucceededWithErrors:
 			case migrationv1alpha1.MigrationFailed:
+			case migrationv1alpha1.MigrationSuspended:
 			default:
 				// keeps unknown conditions
 				newConditions = append(newConditions, c)
@@ -179,3 +641,64 @@ func (km *KubeMigrator) updateStatus(ctx context.Context, m *migrationv1alpha1.S
 		return false, nil
 	})
 }
+
+// resourceLock tracks the resources that are being migrated.
+type resourceLock struct {
+	sync.Mutex
+	locked map[string]bool
+}
+
+func newResourceLock() *resourceLock {
+	return &resourceLock{locked: make(map[string]bool)}
+}
+
+// tryLock marks the resource as being migrated. It returns false if the
+// resource is already being migrated.
+func (l *resourceLock) tryLock(resource string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.locked[resource] {
+		return false
+	}
+	l.locked[resource] = true
+	return true
+}
+
+func (l *resourceLock) unlock(resource string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.locked, resource)
+}
+
+// runningMigrations tracks the cancel functions of the running migrations.
+type runningMigrations struct {
+	sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}
+
+func newRunningMigrations() *runningMigrations {
+	return &runningMigrations{cancels: make(map[string]context.CancelCauseFunc)}
+}
+
+func (r *runningMigrations) add(name string, cancel context.CancelCauseFunc) {
+	r.Lock()
+	defer r.Unlock()
+	r.cancels[name] = cancel
+}
+
+func (r *runningMigrations) remove(name string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.cancels, name)
+}
+
+// cancel interrupts the named migration, if it is running. The cause tells
+// the migrator why it stops, see migrator.ErrObsolete.
+func (r *runningMigrations) cancel(name string, cause error) {
+	r.Lock()
+	defer r.Unlock()
+	if cancel, ok := r.cancels[name]; ok {
+		klog.V(2).Infof("%v: cancelling migration: %v", name, cause)
+		cancel(cause)
+	}
+}
@@ -0,0 +1,370 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
+)
+
+func TestProcessWaitsForSameResource(t *testing.T) {
+	podsv1R := migrationv1alpha1.GroupVersionResource{Group: "core", Version: "v1", Resource: "pods"}
+	podsv2R := migrationv1alpha1.GroupVersionResource{Group: "core", Version: "v2", Resource: "pods"}
+	podsv2 := newMigrationForResource("podsv2", podsv2R)
+
+	client := fake.NewSimpleClientset(podsv2)
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{})
+	if err := km.migrationInformer.GetIndexer().Add(podsv2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend a migration of podsv1 is running.
+	if !km.resources.tryLock(ToIndex(podsv1R)) {
+		t.Fatalf("expected to lock %s", ToIndex(podsv1R))
+	}
+	requeue, err := km.process(context.TODO(), "podsv2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !requeue {
+		t.Errorf("expected podsv2 to wait for the running migration of the same resource")
+	}
+	for _, a := range client.Actions() {
+		t.Errorf("unexpected action %v", a)
+	}
+
+	km.resources.unlock(ToIndex(podsv1R))
+	if !km.resources.tryLock(ToIndex(podsv1R)) {
+		t.Errorf("expected %s to be unlocked", ToIndex(podsv1R))
+	}
+}
+
+func TestProcessWaitsForWindow(t *testing.T) {
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	// A window that is open a minute a year, on January 1st.
+	pods.Spec.Schedule = &migrationv1alpha1.MaintenanceSchedule{
+		Windows: []migrationv1alpha1.MaintenanceWindow{
+			{Start: "0 0 1 1 *", Duration: metav1.Duration{Duration: time.Minute}},
+		},
+	}
+
+	client := fake.NewSimpleClientset(pods)
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{})
+	km.now = func() time.Time { return time.Date(2019, time.July, 1, 12, 0, 0, 0, time.UTC) }
+	if err := km.migrationInformer.GetIndexer().Add(pods); err != nil {
+		t.Fatal(err)
+	}
+	requeue, err := km.process(context.TODO(), "pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeue {
+		t.Errorf("expected pods to wait for the window, not for another migration")
+	}
+	m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.TODO(), "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := indexOfCondition(m, migrationv1alpha1.MigrationSuspended)
+	if i == -1 {
+		t.Fatalf("expected the migration to be suspended, got %+v", m.Status.Conditions)
+	}
+	if msg := m.Status.Conditions[i].Message; msg != "outside the maintenance windows, resuming at 2020-01-01T00:00:00Z" {
+		t.Errorf("unexpected message %q", msg)
+	}
+	if HasCondition(m, migrationv1alpha1.MigrationRunning) {
+		t.Errorf("expected the migration not to run outside the window")
+	}
+}
+
+func TestSuspendFailsOnInvalidSchedule(t *testing.T) {
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	// The schedule was edited while the migration ran.
+	pods.Spec.Schedule = &migrationv1alpha1.MaintenanceSchedule{
+		Windows: []migrationv1alpha1.MaintenanceWindow{
+			{Start: "not a cron expression", Duration: metav1.Duration{Duration: time.Minute}},
+		},
+	}
+	client := fake.NewSimpleClientset(pods)
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{})
+	if err := km.suspend(context.TODO(), pods); err == nil {
+		t.Fatal("expected an error")
+	}
+	m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.TODO(), "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HasCondition(m, migrationv1alpha1.MigrationFailed) {
+		t.Errorf("expected the migration to fail, got %+v", m.Status.Conditions)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	km := NewKubeMigrator(nil, fake.NewSimpleClientset(), KubeMigratorConfig{DefaultConcurrency: 2, MaxConcurrency: 8})
+	for _, tc := range []struct {
+		spec int32
+		want int
+	}{
+		{spec: 0, want: 2},
+		{spec: 1, want: 1},
+		{spec: 8, want: 8},
+		{spec: 100, want: 8},
+	} {
+		m := &migrationv1alpha1.StorageVersionMigration{
+			Spec: migrationv1alpha1.StorageVersionMigrationSpec{Concurrency: tc.spec},
+		}
+		if got := km.concurrency(m); got != tc.want {
+			t.Errorf("spec.concurrency %d: expected %d, got %d", tc.spec, tc.want, got)
+		}
+	}
+}
+
+func TestCancelMigration(t *testing.T) {
+	km := NewKubeMigrator(nil, fake.NewSimpleClientset(), KubeMigratorConfig{})
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	pods.UID = "1"
+
+	ctx, cancel := context.WithCancelCause(context.TODO())
+	defer cancel(nil)
+	km.running.add(pods.Name, cancel)
+	km.cancelIfObsolete(pods, pods.DeepCopy())
+	if ctx.Err() != nil {
+		t.Fatalf("expected the migration to keep running after an unrelated update")
+	}
+	recreated := pods.DeepCopy()
+	recreated.UID = "2"
+	km.cancelIfObsolete(pods, recreated)
+	if cause := context.Cause(ctx); cause != migrator.ErrObsolete {
+		t.Errorf("expected the migration to be cancelled as obsolete after it was recreated, got %v", cause)
+	}
+
+	ctx, cancel = context.WithCancelCause(context.TODO())
+	defer cancel(nil)
+	km.running.add(pods.Name, cancel)
+	retargeted := pods.DeepCopy()
+	retargeted.Spec.Resource.Resource = "nodes"
+	km.cancelIfObsolete(pods, retargeted)
+	if cause := context.Cause(ctx); cause != migrator.ErrObsolete {
+		t.Errorf("expected the migration to be cancelled as obsolete after it was retargeted, got %v", cause)
+	}
+
+	ctx, cancel = context.WithCancelCause(context.TODO())
+	defer cancel(nil)
+	km.running.add(pods.Name, cancel)
+	km.cancelMigration(cache.DeletedFinalStateUnknown{Key: pods.Name, Obj: pods})
+	if cause := context.Cause(ctx); cause != migrator.ErrObsolete {
+		t.Errorf("expected the migration to be cancelled as obsolete after it was deleted, got %v", cause)
+	}
+}
+
+func TestResetIfRetargeted(t *testing.T) {
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	pods.UID = "1"
+	retargeted := pods.DeepCopy()
+	retargeted.Spec.Resource.Resource = "nodes"
+	retargeted.Spec.ContinueToken = "pods-token"
+	retargeted.Status.Progress = &migrationv1alpha1.MigrationProgress{Migrated: 10, Failed: 1}
+	retargeted.Status.FailedObjects = []migrationv1alpha1.FailedObject{{Name: "pod"}}
+	retargeted.Status.Scope = &migrationv1alpha1.MigrationScope{
+		Namespaces:          []string{"a", "b"},
+		CompletedNamespaces: []string{"a"},
+	}
+
+	client := fake.NewSimpleClientset(retargeted)
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{})
+	if err := km.resetIfRetargeted(context.TODO(), pods); err != nil {
+		t.Fatal(err)
+	}
+	m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.TODO(), "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Spec.ContinueToken) > 0 {
+		t.Errorf("expected the continue token of pods to be cleared, got %q", m.Spec.ContinueToken)
+	}
+	if m.Status.Progress != nil || len(m.Status.FailedObjects) > 0 || len(m.Status.Scope.CompletedNamespaces) > 0 {
+		t.Errorf("expected the progress of pods to be cleared, got %+v", m.Status)
+	}
+	if !reflect.DeepEqual(m.Status.Scope.Namespaces, []string{"a", "b"}) {
+		t.Errorf("expected the scope to be kept, got %+v", m.Status.Scope)
+	}
+
+	// A migration that still targets the same resource is left alone.
+	m.Spec.ContinueToken = "nodes-token"
+	if _, err := client.MigrationV1alpha1().StorageVersionMigrations().Update(context.TODO(), m, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.resetIfRetargeted(context.TODO(), m); err != nil {
+		t.Fatal(err)
+	}
+	m, err = client.MigrationV1alpha1().StorageVersionMigrations().Get(context.TODO(), "pods", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Spec.ContinueToken != "nodes-token" {
+		t.Errorf("expected the continue token to be kept, got %q", m.Spec.ContinueToken)
+	}
+}
+
+func TestScope(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    migrationv1alpha1.StorageVersionMigrationSpec
+		want    migrator.Scope
+		wantErr bool
+	}{
+		{
+			name: "all objects",
+		},
+		{
+			name: "namespaces",
+			spec: migrationv1alpha1.StorageVersionMigrationSpec{
+				Namespaces:        []string{"a", "b", "c"},
+				ExcludeNamespaces: []string{"b"},
+			},
+			want: migrator.Scope{Namespaces: []string{"a", "c"}},
+		},
+		{
+			name: "excluded namespaces",
+			spec: migrationv1alpha1.StorageVersionMigrationSpec{
+				ExcludeNamespaces: []string{"b", "a"},
+				FieldSelector:     "status.phase=Running",
+			},
+			want: migrator.Scope{FieldSelector: "status.phase=Running,metadata.namespace!=a,metadata.namespace!=b"},
+		},
+		{
+			name: "label selector",
+			spec: migrationv1alpha1.StorageVersionMigrationSpec{
+				LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			},
+			want: migrator.Scope{LabelSelector: "app=web"},
+		},
+		{
+			name: "all namespaces excluded",
+			spec: migrationv1alpha1.StorageVersionMigrationSpec{
+				Namespaces:        []string{"a"},
+				ExcludeNamespaces: []string{"a"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid field selector",
+			spec:    migrationv1alpha1.StorageVersionMigrationSpec{FieldSelector: "a"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := scope(&migrationv1alpha1.StorageVersionMigration{Spec: tc.spec})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %#v, got %#v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNamespacesOfClusterScopedResource(t *testing.T) {
+	nodes := newMigrationForResource("nodes", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "nodes"})
+	nodes.Spec.Namespaces = []string{"a"}
+	client := fake.NewSimpleClientset(nodes)
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "nodes", Namespaced: false},
+				{Name: "pods", Namespaced: true},
+			},
+		},
+	}
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{})
+	if err := km.processOne(context.TODO(), nodes); err == nil {
+		t.Fatal("expected an error")
+	}
+	m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.TODO(), "nodes", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := indexOfCondition(m, migrationv1alpha1.MigrationFailed)
+	if i == -1 {
+		t.Fatalf("expected the migration to fail, got %+v", m.Status.Conditions)
+	}
+	if msg := m.Status.Conditions[i].Message; msg != ".spec.namespaces is set, but nodes is not namespaced" {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+func TestFailRecordsMetrics(t *testing.T) {
+	pods := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	client := fake.NewSimpleClientset(pods)
+	registry := prometheus.NewRegistry()
+	km := NewKubeMigrator(nil, client, KubeMigratorConfig{Metrics: metrics.NewCoreMigratorMetrics(registry)})
+	km.fail(context.TODO(), pods, errors.New("boom"))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := 0.0
+	for _, mf := range families {
+		if mf.GetName() != "storage_migrator_core_migrator_migrations" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			failed += m.GetCounter().GetValue()
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected the failed migration to be recorded in the configured metrics, got %v", failed)
+	}
+}
+
+func TestCheckers(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		policy     *migrationv1alpha1.SkipPolicy
+		targetHash string
+		expected   int
+	}{
+		{name: "no skip policy", targetHash: "hash", expected: 0},
+		{name: "annotation", policy: &migrationv1alpha1.SkipPolicy{AnnotationKey: "key", AnnotationValue: "value"}, targetHash: "hash", expected: 1},
+		{name: "managed fields not opted in", policy: &migrationv1alpha1.SkipPolicy{AnnotationKey: "key"}, targetHash: "hash", expected: 1},
+		{name: "managed fields", policy: &migrationv1alpha1.SkipPolicy{ManagedFields: true}, targetHash: "hash", expected: 1},
+		{name: "managed fields without target", policy: &migrationv1alpha1.SkipPolicy{ManagedFields: true}, expected: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+			m.Spec.SkipPolicy = tc.policy
+			m.Spec.TargetStorageVersionHash = tc.targetHash
+			if e, a := tc.expected, len(checkers(m)); e != a {
+				t.Errorf("expected %d checkers, got %d", e, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
+)
+
+const (
+	defaultRetryBackoff = 30 * time.Second
+	maxRetryBackoff     = 24 * time.Hour
+)
+
+// RetryController retries failed storageVersionMigrations according to
+// their .spec.retryPolicy. It schedules a retry by recording
+// .status.nextRetryTime, and retries by clearing the progress of the failed
+// run and removing the Failed condition, which makes the KubeMigrator start
+// the migration over.
+type RetryController struct {
+	migrationClient   migrationclient.Interface
+	migrationInformer cache.SharedIndexInformer
+	queue             workqueue.RateLimitingInterface
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// NewRetryController creates RetryController.
+func NewRetryController(migrationClient migrationclient.Interface) *RetryController {
+	informer := NewStatusIndexedInformer(migrationClient)
+	rc := &RetryController{
+		migrationClient:   migrationClient,
+		migrationInformer: informer,
+		queue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "storage_version_migration_retry"),
+		now:               time.Now,
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    rc.enqueueMigration,
+		UpdateFunc: func(_, obj interface{}) { rc.enqueueMigration(obj) },
+	})
+	return rc
+}
+
+// Run starts the RetryController. It blocks until ctx is done.
+func (rc *RetryController) Run(ctx context.Context) {
+	defer utilruntime.HandleCrash()
+	defer rc.queue.ShutDown()
+	go rc.migrationInformer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), rc.migrationInformer.HasSynced) {
+		utilruntime.HandleError(fmt.Errorf("Unable to sync caches"))
+		return
+	}
+	go wait.UntilWithContext(ctx, rc.runWorker, time.Second)
+	<-ctx.Done()
+}
+
+func (rc *RetryController) enqueueMigration(obj interface{}) {
+	m, ok := obj.(*migrationv1alpha1.StorageVersionMigration)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected StorageVersionMigration, got %#v", reflect.TypeOf(obj)))
+		return
+	}
+	if !WillRetry(m) {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(m)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	rc.queue.Add(key)
+}
+
+func (rc *RetryController) runWorker(ctx context.Context) {
+	for rc.processNextWorkItem(ctx) {
+	}
+}
+
+func (rc *RetryController) processNextWorkItem(ctx context.Context) bool {
+	key, quit := rc.queue.Get()
+	if quit {
+		return false
+	}
+	defer rc.queue.Done(key)
+
+	after, err := rc.process(ctx, key.(string))
+	switch {
+	case err != nil:
+		utilruntime.HandleError(err)
+		rc.queue.AddRateLimited(key)
+	case after > 0:
+		rc.queue.Forget(key)
+		rc.queue.AddAfter(key, after)
+	default:
+		rc.queue.Forget(key)
+	}
+	return true
+}
+
+// process schedules or performs the retry of the migration. It returns how
+// long to wait before the migration should be processed again, or zero if it
+// needs no further processing.
+func (rc *RetryController) process(ctx context.Context, key string) (time.Duration, error) {
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return 0, err
+	}
+	m, err := rc.migrationClient.MigrationV1alpha1().StorageVersionMigrations().Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !WillRetry(m) {
+		return 0, nil
+	}
+	policy := m.Spec.RetryPolicy
+	now := rc.now()
+	switch {
+	case m.Status.Retries >= policy.MaxRetries:
+		klog.V(2).Infof("migration %s has failed after %d retries, giving up", m.Name, m.Status.Retries)
+		m.Status.NextRetryTime = nil
+		m.Status.Conditions = append(m.Status.Conditions, migrationv1alpha1.MigrationCondition{
+			Type:           migrationv1alpha1.MigrationRetriesExhausted,
+			Status:         corev1.ConditionTrue,
+			LastUpdateTime: metav1.NewTime(now),
+			Message:        fmt.Sprintf("the migration has failed after %d retries", m.Status.Retries),
+		})
+	case m.Status.NextRetryTime == nil:
+		next := now.Add(retryBackoff(policy, m.Status.Retries))
+		klog.V(2).Infof("migration %s has failed, retrying at %v", m.Name, next)
+		m.Status.NextRetryTime = &metav1.Time{Time: next}
+	case now.Before(m.Status.NextRetryTime.Time):
+		return m.Status.NextRetryTime.Sub(now), nil
+	default:
+		klog.V(2).Infof("retrying migration %s", m.Name)
+		// The failures of the failed run must not count against the
+		// retry, so the retry starts over. The continue token is
+		// cleared first, so that the migration never resumes from it
+		// once pending again.
+		if len(m.Spec.ContinueToken) > 0 {
+			m.Spec.ContinueToken = ""
+			if m, err = rc.migrationClient.MigrationV1alpha1().StorageVersionMigrations().Update(ctx, m, metav1.UpdateOptions{}); err != nil {
+				return 0, err
+			}
+		}
+		m.Status.Progress = nil
+		m.Status.FailedObjects = nil
+		if m.Status.Scope != nil {
+			m.Status.Scope.CompletedNamespaces = nil
+		}
+		m.Status.Retries++
+		m.Status.NextRetryTime = nil
+		var conditions []migrationv1alpha1.MigrationCondition
+		for _, c := range m.Status.Conditions {
+			if c.Type != migrationv1alpha1.MigrationFailed {
+				conditions = append(conditions, c)
+			}
+		}
+		m.Status.Conditions = conditions
+	}
+	m, err = rc.migrationClient.MigrationV1alpha1().StorageVersionMigrations().UpdateStatus(ctx, m, metav1.UpdateOptions{})
+	if err != nil {
+		return 0, err
+	}
+	if m.Status.NextRetryTime != nil {
+		return m.Status.NextRetryTime.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// WillRetry returns true if m has failed and is going to be retried according
+// to its retry policy.
+func WillRetry(m *migrationv1alpha1.StorageVersionMigration) bool {
+	return m.Spec.RetryPolicy != nil &&
+		HasCondition(m, migrationv1alpha1.MigrationFailed) &&
+		!HasCondition(m, migrationv1alpha1.MigrationRetriesExhausted)
+}
+
+// retryBackoff returns how long to wait before retrying a migration that has
+// been retried the given number of times.
+func retryBackoff(policy *migrationv1alpha1.RetryPolicy, retries int32) time.Duration {
+	backoff := defaultRetryBackoff
+	if policy.BackoffSeconds > 0 {
+		backoff = time.Duration(policy.BackoffSeconds) * time.Second
+	}
+	for i := int32(0); i < retries && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &migrationv1alpha1.RetryPolicy{MaxRetries: 100, BackoffSeconds: 10}
+	for _, tc := range []struct {
+		retries int32
+		want    time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 20 * time.Second},
+		{3, 80 * time.Second},
+		{100, maxRetryBackoff},
+	} {
+		if got := retryBackoff(policy, tc.retries); got != tc.want {
+			t.Errorf("retryBackoff after %d retries: expected %v, got %v", tc.retries, tc.want, got)
+		}
+	}
+	if got := retryBackoff(&migrationv1alpha1.RetryPolicy{MaxRetries: 1}, 0); got != defaultRetryBackoff {
+		t.Errorf("expected the default backoff %v, got %v", defaultRetryBackoff, got)
+	}
+}
+
+func TestRetryProcess(t *testing.T) {
+	m := newMigrationForResource("pods", migrationv1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"})
+	m.Spec.RetryPolicy = &migrationv1alpha1.RetryPolicy{MaxRetries: 1, BackoffSeconds: 10}
+	m.Spec.ContinueToken = "next"
+	m.Status.Conditions = []migrationv1alpha1.MigrationCondition{{Type: migrationv1alpha1.MigrationFailed, Status: corev1.ConditionTrue}}
+	m.Status.Progress = &migrationv1alpha1.MigrationProgress{Migrated: 4, Failed: 1}
+	m.Status.FailedObjects = []migrationv1alpha1.FailedObject{{Namespace: "default", Name: "pod-1"}}
+	m.Status.Scope = &migrationv1alpha1.MigrationScope{CompletedNamespaces: []string{"default"}}
+	client := fake.NewSimpleClientset(m)
+	rc := NewRetryController(client)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	rc.now = func() time.Time { return now }
+	get := func() *migrationv1alpha1.StorageVersionMigration {
+		m, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.TODO(), "pods", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// The failure schedules a retry.
+	after, err := rc.process(context.TODO(), "pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != 10*time.Second {
+		t.Errorf("expected to process again in 10s, got %v", after)
+	}
+	if next := get().Status.NextRetryTime; next == nil || !next.Time.Equal(now.Add(10*time.Second)) {
+		t.Errorf("expected the next retry at %v, got %v", now.Add(10*time.Second), next)
+	}
+
+	// The retry is not due yet.
+	now = now.Add(5 * time.Second)
+	if after, err = rc.process(context.TODO(), "pods"); err != nil {
+		t.Fatal(err)
+	}
+	if after != 5*time.Second {
+		t.Errorf("expected to process again in 5s, got %v", after)
+	}
+
+	// The retry makes the migration pending again.
+	now = now.Add(5 * time.Second)
+	if after, err = rc.process(context.TODO(), "pods"); err != nil {
+		t.Fatal(err)
+	}
+	if after != 0 {
+		t.Errorf("expected no further processing, got %v", after)
+	}
+	m = get()
+	if IsCompleted(m) || m.Status.Retries != 1 || m.Status.NextRetryTime != nil {
+		t.Errorf("expected a pending migration retried once, got %#v", m.Status)
+	}
+	// The retry starts over, without the failures of the failed run.
+	if len(m.Spec.ContinueToken) != 0 || m.Status.Progress != nil || len(m.Status.FailedObjects) != 0 || len(m.Status.Scope.CompletedNamespaces) != 0 {
+		t.Errorf("expected the progress of the failed run to be cleared, got %q and %#v", m.Spec.ContinueToken, m.Status)
+	}
+
+	// The migration fails again and has no retries left.
+	m.Status.Conditions = append(m.Status.Conditions, migrationv1alpha1.MigrationCondition{Type: migrationv1alpha1.MigrationFailed, Status: corev1.ConditionTrue})
+	if _, err := client.MigrationV1alpha1().StorageVersionMigrations().UpdateStatus(context.TODO(), m, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !WillRetry(get()) {
+		t.Errorf("expected the migration to be considered for a retry until the policy is evaluated")
+	}
+	if _, err = rc.process(context.TODO(), "pods"); err != nil {
+		t.Fatal(err)
+	}
+	m = get()
+	if !HasCondition(m, migrationv1alpha1.MigrationRetriesExhausted) || !HasCondition(m, migrationv1alpha1.MigrationFailed) {
+		t.Errorf("expected the Failed and RetriesExhausted conditions, got %v", m.Status.Conditions)
+	}
+	if WillRetry(m) {
+		t.Errorf("expected no more retries")
+	}
+}
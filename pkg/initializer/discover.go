@@ -27,12 +27,15 @@ import (
 	"k8s.io/client-go/discovery"
 	"k8s.io/klog/v2"
 	apiregistrationv1 "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/typed/apiregistration/v1"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
 )
 
 type migrationDiscovery struct {
 	discoveryClient  discovery.ServerResourcesInterface
 	crdClient        v1.CustomResourceDefinitionInterface
 	apiserviceClient apiregistrationv1.APIServiceInterface
+	policy           *policy.Policy
 }
 
 // NewDiscovery returns a migrationDiscovery struct.
@@ -40,18 +43,16 @@ func NewDiscovery(
 	discoveryClient discovery.ServerResourcesInterface,
 	crdClient v1.CustomResourceDefinitionInterface,
 	apiserviceClient apiregistrationv1.APIServiceInterface,
+	resourcePolicy *policy.Policy,
 ) *migrationDiscovery {
 	return &migrationDiscovery{
 		discoveryClient:  discoveryClient,
 		crdClient:        crdClient,
 		apiserviceClient: apiserviceClient,
+		policy:           resourcePolicy,
 	}
 }
 
-var blackListResources = sets.NewString(
-	"events",
-)
-
 // FindMigratableResources finds all the resources that potentially need
 // migration. Although all migratable resources are accessible via multiple
 // versions, the returned list only include one version.
@@ -60,6 +61,7 @@ var blackListResources = sets.NewString(
 // 1. build a map from resource name to the groupVersions, excluding subresources, custom resources, or aggregated resources.
 // 2. exclude all the resource that is only available from one groupVersions.
 // 3. exclude the resource that does not support "list" and "update" (thus not migratable).
+// Resources the policy excludes are ignored in step 1.
 //
 // Note that the above is based on intuition. There are two potential problems:
 // a. It's possible that a set of objects is accessible from different groups and different resource names,
@@ -101,7 +103,7 @@ func (d *migrationDiscovery) FindMigratableResources(ctx context.Context) ([]sch
 			if strings.Contains(r.Name, "/") {
 				continue
 			}
-			if blackListResources.Has(r.Name) {
+			if !d.policy.Allows(gv.WithResource(r.Name).GroupResource()) {
 				continue
 			}
 			// ignore resources that cannot be listed and updated
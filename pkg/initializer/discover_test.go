@@ -30,6 +30,8 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 	v1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
 	aggregatorfake "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/fake"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
 )
 
 const (
@@ -349,7 +351,7 @@ func TestFindMigratableResources(t *testing.T) {
 
 	crdClient := apiextensionsfake.NewSimpleClientset(fakeCRDs(t)...).ApiextensionsV1().CustomResourceDefinitions()
 	apiserviceClient := aggregatorfake.NewSimpleClientset(fakeAPIServices(t)...).ApiregistrationV1().APIServices()
-	d := NewDiscovery(kubernetes.Discovery(), crdClient, apiserviceClient)
+	d := NewDiscovery(kubernetes.Discovery(), crdClient, apiserviceClient, policy.DefaultPolicy)
 	ctx := context.TODO()
 	got, err := d.FindMigratableResources(ctx)
 	if err != nil {
@@ -32,6 +32,7 @@ import (
 	apiregistrationv1 "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/typed/apiregistration/v1"
 	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/typed/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
 )
 
 type initializer struct {
@@ -47,8 +48,9 @@ func NewInitializer(
 	apiserviceClient apiregistrationv1.APIServiceInterface,
 	namespaceClient corev1.NamespaceInterface,
 	migrationGetter v1alpha1.StorageVersionMigrationsGetter,
+	resourcePolicy *policy.Policy,
 ) *initializer {
-	d := NewDiscovery(disocveryClient, crdClient, apiserviceClient)
+	d := NewDiscovery(disocveryClient, crdClient, apiserviceClient, resourcePolicy)
 	return &initializer{
 		discovery:       d,
 		crdClient:       crdClient,
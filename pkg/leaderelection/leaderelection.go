@@ -0,0 +1,192 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package leaderelection runs the controllers of the storage version migrator
+// in a single replica at a time, the one holding a Lease.
+package leaderelection
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// The default durations of the leader election, the same as the
+	// Kubernetes controller managers.
+	DefaultLeaseDuration = 15 * time.Second
+	DefaultRenewDeadline = 10 * time.Second
+	DefaultRetryPeriod   = 2 * time.Second
+
+	// namespaceFile holds the namespace of the pod, when running in a
+	// cluster.
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// Config configures the leader election.
+type Config struct {
+	// Namespace and Name identify the Lease. If Namespace is empty, the
+	// Lease is in the namespace of the pod.
+	Namespace string
+	Name      string
+	// LeaseDuration is how long the other candidates wait after the
+	// leader last renewed the Lease before they take it over.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps trying to renew the Lease
+	// before it gives up the leadership.
+	RenewDeadline time.Duration
+	// RetryPeriod is how long the candidates wait between two attempts to
+	// acquire or renew the Lease.
+	RetryPeriod time.Duration
+}
+
+// Validate returns an error if the durations are inconsistent.
+func (c Config) Validate() error {
+	if len(c.Name) == 0 {
+		return fmt.Errorf("the name of the lease must not be empty")
+	}
+	if c.RetryPeriod <= 0 {
+		return fmt.Errorf("the retry period must be positive, got %v", c.RetryPeriod)
+	}
+	if c.RenewDeadline <= c.RetryPeriod {
+		return fmt.Errorf("the renew deadline (%v) must be greater than the retry period (%v)", c.RenewDeadline, c.RetryPeriod)
+	}
+	if c.LeaseDuration <= c.RenewDeadline {
+		return fmt.Errorf("the lease duration (%v) must be greater than the renew deadline (%v)", c.LeaseDuration, c.RenewDeadline)
+	}
+	return nil
+}
+
+// Run calls run once this process holds the Lease, and blocks until run
+// returns. The context passed to run is cancelled when ctx is done, or when
+// the leadership is lost. The Lease is released only once run has returned,
+// so that the next leader does not start before this one has stopped. Run
+// returns an error if the leadership was lost, in which case the process is
+// expected to exit.
+func Run(ctx context.Context, client kubernetes.Interface, config Config, run func(context.Context)) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	namespace := config.Namespace
+	if len(namespace) == 0 {
+		namespace = podNamespace()
+	}
+	identity, err := Identity()
+	if err != nil {
+		return err
+	}
+	leading := make(chan context.Context, 1)
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      config.Name,
+			},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   config.LeaseDuration,
+		RenewDeadline:   config.RenewDeadline,
+		RetryPeriod:     config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            config.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				leading <- leaderCtx
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("%s stopped leading %s/%s", identity, namespace, config.Name)
+			},
+			OnNewLeader: func(leader string) {
+				klog.Infof("%s is the leader of %s/%s", leader, namespace, config.Name)
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The elector releases the Lease as soon as its context is done, so it
+	// does not run with ctx.
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+	electionDone := make(chan struct{})
+	go func() {
+		defer close(electionDone)
+		le.Run(electionCtx)
+	}()
+	klog.Infof("%s waiting for the leadership of %s/%s", identity, namespace, config.Name)
+
+	select {
+	case <-ctx.Done():
+		stopElection()
+		<-electionDone
+		return nil
+	case <-electionDone:
+		return fmt.Errorf("the leader election for %s/%s stopped", namespace, config.Name)
+	case leaderCtx := <-leading:
+		runCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-leaderCtx.Done():
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+		run(runCtx)
+		cancel()
+		lost := leaderCtx.Err() != nil && ctx.Err() == nil
+		stopElection()
+		<-electionDone
+		if lost {
+			return fmt.Errorf("lost the leadership of %s/%s", namespace, config.Name)
+		}
+		return nil
+	}
+}
+
+// Identity returns a unique identity for this process.
+func Identity() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	// The hostname alone is not unique if two processes run in the same
+	// pod, e.g., after a container restart.
+	return hostname + "_" + string(uuid.NewUUID()), nil
+}
+
+// podNamespace returns the namespace of the pod the process runs in, or
+// "default" outside of a cluster.
+func podNamespace() string {
+	data, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return metav1.NamespaceDefault
+	}
+	if namespace := strings.TrimSpace(string(data)); len(namespace) > 0 {
+		return namespace
+	}
+	return metav1.NamespaceDefault
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leaderelection
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testConfig() Config {
+	return Config{
+		Namespace:     "ns",
+		Name:          "lease",
+		LeaseDuration: 3 * time.Second,
+		RenewDeadline: 2 * time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		c     func(*Config)
+		valid bool
+	}{
+		{name: "valid", c: func(*Config) {}, valid: true},
+		{name: "no name", c: func(c *Config) { c.Name = "" }},
+		{name: "no retry period", c: func(c *Config) { c.RetryPeriod = 0 }},
+		{name: "renew deadline shorter than retry period", c: func(c *Config) { c.RenewDeadline = c.RetryPeriod }},
+		{name: "lease duration shorter than renew deadline", c: func(c *Config) { c.LeaseDuration = c.RenewDeadline }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := testConfig()
+			tc.c(&c)
+			if err := c.Validate(); (err == nil) != tc.valid {
+				t.Errorf("expected valid to be %v, got error %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestRunReleasesLeaseAfterRun(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	stopped := false
+	err := Run(ctx, client, testConfig(), func(ctx context.Context) {
+		lease, err := client.CoordinationV1().Leases("ns").Get(ctx, "lease", metav1.GetOptions{})
+		if err != nil {
+			t.Error(err)
+		} else if lease.Spec.HolderIdentity == nil || len(*lease.Spec.HolderIdentity) == 0 {
+			t.Errorf("expected the lease to be held while running")
+		}
+		cancel()
+		<-ctx.Done()
+		// Stopping takes a while, e.g., to save the continue tokens.
+		time.Sleep(200 * time.Millisecond)
+		lease, err = client.CoordinationV1().Leases("ns").Get(context.TODO(), "lease", metav1.GetOptions{})
+		if err != nil {
+			t.Error(err)
+		} else if lease.Spec.HolderIdentity == nil || len(*lease.Spec.HolderIdentity) == 0 {
+			t.Errorf("expected the lease to be held until run returns")
+		}
+		stopped = true
+	})
+	if err != nil {
+		t.Fatalf("expected no error once ctx is done, got %v", err)
+	}
+	if !stopped {
+		t.Fatalf("expected run to be called")
+	}
+	lease, err := client.CoordinationV1().Leases("ns").Get(context.TODO(), "lease", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Spec.HolderIdentity != nil && len(*lease.Spec.HolderIdentity) != 0 {
+		t.Errorf("expected the lease to be released, held by %s", *lease.Spec.HolderIdentity)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	flowcontrolv1beta3 "k8s.io/api/flowcontrol/v1beta3"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
+)
+
+const (
+	// Signals received within backpressureCooldown of a decrease are
+	// considered part of the same congestion event, like TCP halves its
+	// window at most once per round trip.
+	backpressureCooldown = time.Second
+	decreaseFactor       = 0.5
+	defaultTargetLatency = time.Second
+)
+
+// BackpressureConfig configures a Backpressure.
+type BackpressureConfig struct {
+	// MinRate and MaxRate bound the write rate, in objects per second.
+	MinRate float64
+	MaxRate float64
+	// MaxInFlight bounds the number of concurrent writes. Zero means no
+	// bound other than the concurrency of the migrators.
+	MaxInFlight int
+	// TargetLatency is the write latency above which the apiserver is
+	// considered congested.
+	TargetLatency time.Duration
+	// Metrics records the rate, the window and the congestion signals. If
+	// nil, they are recorded in metrics.Metrics.
+	Metrics *metrics.CoreMigratorMetrics
+}
+
+// Backpressure adapts the write rate and the write concurrency of migrators
+// to the health of the apiserver, in the spirit of TCP congestion control.
+// While writes are fast and successful, it increases the rate by about one
+// object per second every second, and the number of concurrent writes by
+// about one per window of writes. When a write is slow, throttled (HTTP 429,
+// e.g., rejected by API Priority and Fairness), or fails with a server error,
+// it halves both.
+//
+// A Backpressure observes requests through the round tripper returned by
+// WrapTransport, and is shared by all migrators talking to the same
+// apiserver. Only the writes of the objects, i.e., PUT and PATCH requests,
+// adjust the rate and the window; the lists of the objects go through the
+// round tripper without being observed. Only the client the migrators write
+// the objects with should be wrapped, so that other writes, e.g., status
+// updates of the migrations, do not count as writes of the objects.
+type Backpressure struct {
+	config  BackpressureConfig
+	limiter *rate.Limiter
+
+	mu           sync.Mutex
+	window       float64
+	inFlight     int
+	lastDecrease time.Time
+	// changed is closed when inFlight decreases or window changes.
+	changed chan struct{}
+	// flowSchema and priorityLevel are the UIDs of the API Priority and
+	// Fairness objects the apiserver last classified the requests into.
+	flowSchema    string
+	priorityLevel string
+}
+
+// NewBackpressure returns a Backpressure that starts at the minimum rate and
+// a single write in flight.
+func NewBackpressure(config BackpressureConfig) *Backpressure {
+	if config.MinRate <= 0 {
+		config.MinRate = 1
+	}
+	if config.MaxRate < config.MinRate {
+		config.MaxRate = config.MinRate
+	}
+	if config.MaxInFlight < 1 {
+		config.MaxInFlight = math.MaxInt32
+	}
+	if config.TargetLatency <= 0 {
+		config.TargetLatency = defaultTargetLatency
+	}
+	if config.Metrics == nil {
+		config.Metrics = metrics.Metrics
+	}
+	b := &Backpressure{
+		config:  config,
+		limiter: rate.NewLimiter(rate.Limit(config.MinRate), 1),
+		window:  1,
+		changed: make(chan struct{}),
+	}
+	b.observeState()
+	return b
+}
+
+// WrapTransport returns a round tripper that reports the outcome of every
+// write to the Backpressure. It can be used as a rest.Config wrapper.
+func (b *Backpressure) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &backpressureRoundTripper{backpressure: b, delegate: rt}
+}
+
+type backpressureRoundTripper struct {
+	backpressure *Backpressure
+	delegate     http.RoundTripper
+}
+
+func (t *backpressureRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.delegate.RoundTrip(req)
+	t.backpressure.observe(req.Method, time.Since(start), resp, err)
+	return resp, err
+}
+
+// observe adjusts the rate and the window based on the outcome of a write.
+// Other requests are ignored: lists are slow by nature, and the apiserver
+// might classify them into another priority level than the writes. Requests
+// cancelled by the migrator, e.g., because a migration was suspended or
+// deleted, say nothing about the apiserver.
+func (b *Backpressure) observe(method string, latency time.Duration, resp *http.Response, err error) {
+	if method != http.MethodPut && method != http.MethodPatch {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if resp != nil {
+		b.observeClassification(
+			resp.Header.Get(flowcontrolv1beta3.ResponseHeaderMatchedFlowSchemaUID),
+			resp.Header.Get(flowcontrolv1beta3.ResponseHeaderMatchedPriorityLevelConfigurationUID),
+		)
+	}
+	switch {
+	case err != nil:
+		b.decrease("error")
+	case resp.StatusCode == http.StatusTooManyRequests:
+		b.decrease("throttled")
+	case resp.StatusCode >= http.StatusInternalServerError:
+		b.decrease("error")
+	case latency > b.config.TargetLatency:
+		b.decrease("latency")
+	case resp.StatusCode < http.StatusMultipleChoices:
+		b.increase()
+	}
+}
+
+// observeClassification restarts from the minimum rate and a single write in
+// flight when the apiserver starts classifying the requests into another flow
+// schema or priority level, because the rate the migrator can sustain depends
+// on the priority level it shares with other clients.
+func (b *Backpressure) observeClassification(flowSchema, priorityLevel string) {
+	if len(flowSchema) == 0 && len(priorityLevel) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flowSchema == flowSchema && b.priorityLevel == priorityLevel {
+		return
+	}
+	klog.V(2).Infof("the apiserver classified migrator requests into flow schema %s and priority level %s", flowSchema, priorityLevel)
+	// The first classification is the one the rate is learnt with.
+	reclassified := len(b.flowSchema) != 0 || len(b.priorityLevel) != 0
+	b.flowSchema = flowSchema
+	b.priorityLevel = priorityLevel
+	if !reclassified {
+		return
+	}
+	b.limiter.SetLimit(rate.Limit(b.config.MinRate))
+	b.window = 1
+	b.observeStateLocked()
+}
+
+func (b *Backpressure) increase() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := float64(b.limiter.Limit())
+	r += 1 / r
+	if r > b.config.MaxRate {
+		r = b.config.MaxRate
+	}
+	b.limiter.SetLimit(rate.Limit(r))
+	b.window += 1 / b.window
+	if b.window > float64(b.config.MaxInFlight) {
+		b.window = float64(b.config.MaxInFlight)
+	}
+	b.broadcast()
+	b.observeStateLocked()
+}
+
+func (b *Backpressure) decrease(reason string) {
+	b.config.Metrics.ObserveBackpressureSignal(reason)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.lastDecrease) < backpressureCooldown {
+		return
+	}
+	b.lastDecrease = now
+	r := float64(b.limiter.Limit()) * decreaseFactor
+	if r < b.config.MinRate {
+		r = b.config.MinRate
+	}
+	b.limiter.SetLimit(rate.Limit(r))
+	b.window *= decreaseFactor
+	if b.window < 1 {
+		b.window = 1
+	}
+	klog.V(2).Infof("apiserver congestion (%s), slowing down to %.1f objects per second and %d concurrent writes", reason, r, int(b.window))
+	b.observeStateLocked()
+}
+
+// broadcast must be called with b.mu held.
+func (b *Backpressure) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *Backpressure) observeState() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.observeStateLocked()
+}
+
+func (b *Backpressure) observeStateLocked() {
+	b.config.Metrics.ObserveBackpressure(float64(b.limiter.Limit()), int(b.window))
+}
+
+// acquire blocks until a write is permitted by both the window and the rate.
+// The returned function must be called once the write has completed. It is
+// safe to call acquire on a nil Backpressure.
+func (b *Backpressure) acquire(ctx context.Context) (func(), error) {
+	if b == nil {
+		return func() {}, nil
+	}
+	for {
+		b.mu.Lock()
+		if b.inFlight < int(b.window) {
+			b.inFlight++
+			b.mu.Unlock()
+			break
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.inFlight--
+		b.broadcast()
+	}
+	if err := b.limiter.Wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
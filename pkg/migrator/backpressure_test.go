@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	flowcontrolv1beta3 "k8s.io/api/flowcontrol/v1beta3"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
+)
+
+func response(code int) *http.Response {
+	return &http.Response{StatusCode: code, Header: http.Header{}}
+}
+
+func TestBackpressureAIMD(t *testing.T) {
+	b := NewBackpressure(BackpressureConfig{MinRate: 1, MaxRate: 4, MaxInFlight: 3, TargetLatency: time.Second})
+
+	// Fast successful writes speed up, up to the maxima.
+	for i := 0; i < 100; i++ {
+		b.observe(http.MethodPut, time.Millisecond, response(http.StatusOK), nil)
+	}
+	if r := float64(b.limiter.Limit()); r != 4 {
+		t.Errorf("expected the rate to reach 4, got %v", r)
+	}
+	if b.window != 3 {
+		t.Errorf("expected the window to reach 3, got %v", b.window)
+	}
+
+	// Lists are ignored, even when they are slow, throttled or fail.
+	b.observe(http.MethodGet, time.Minute, response(http.StatusOK), nil)
+	b.observe(http.MethodGet, time.Millisecond, response(http.StatusTooManyRequests), nil)
+	b.observe(http.MethodGet, time.Millisecond, response(http.StatusServiceUnavailable), nil)
+	b.observe(http.MethodGet, time.Millisecond, nil, errors.New("connection reset"))
+	if r := float64(b.limiter.Limit()); r != 4 || b.window != 3 {
+		t.Errorf("expected lists to be ignored, got rate %v and window %v", r, b.window)
+	}
+
+	// A throttled request halves the rate and the window, and the
+	// following signals of the same congestion event are ignored.
+	b.observe(http.MethodPut, time.Millisecond, response(http.StatusTooManyRequests), nil)
+	b.observe(http.MethodPut, 2*time.Second, response(http.StatusOK), nil)
+	if r := float64(b.limiter.Limit()); r != 2 {
+		t.Errorf("expected the rate to be halved to 2, got %v", r)
+	}
+	if b.window != 1.5 {
+		t.Errorf("expected the window to be halved to 1.5, got %v", b.window)
+	}
+}
+
+func TestBackpressureMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	b := NewBackpressure(BackpressureConfig{MinRate: 2, MaxRate: 4, Metrics: metrics.NewCoreMigratorMetrics(registry)})
+	b.observe(http.MethodPut, time.Millisecond, response(http.StatusTooManyRequests), nil)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.GetGauge() != nil:
+				got[mf.GetName()] = m.GetGauge().GetValue()
+			case m.GetCounter() != nil:
+				got[mf.GetName()] += m.GetCounter().GetValue()
+			}
+		}
+	}
+	if r := got["storage_migrator_core_migrator_backpressure_rate"]; r != 2 {
+		t.Errorf("expected the rate 2 to be recorded, got %v", r)
+	}
+	if s := got["storage_migrator_core_migrator_backpressure_signals"]; s != 1 {
+		t.Errorf("expected 1 congestion signal to be recorded, got %v", s)
+	}
+}
+
+func TestBackpressureIgnoresCancellation(t *testing.T) {
+	b := NewBackpressure(BackpressureConfig{MinRate: 1, MaxRate: 4, MaxInFlight: 3})
+	for i := 0; i < 100; i++ {
+		b.observe(http.MethodPut, time.Millisecond, response(http.StatusOK), nil)
+	}
+	// The transport wraps the error of the context.
+	err := &url.Error{Op: "Put", URL: "https://apiserver", Err: context.Canceled}
+	b.observe(http.MethodPut, time.Millisecond, nil, err)
+	if r := float64(b.limiter.Limit()); r != 4 {
+		t.Errorf("expected a cancelled request not to slow down, got rate %v", r)
+	}
+	b.observe(http.MethodPut, time.Millisecond, nil, errors.New("connection reset"))
+	if r := float64(b.limiter.Limit()); r != 2 {
+		t.Errorf("expected a failed request to halve the rate to 2, got %v", r)
+	}
+}
+
+func TestBackpressureReclassification(t *testing.T) {
+	b := NewBackpressure(BackpressureConfig{MinRate: 1, MaxRate: 4, MaxInFlight: 3})
+	classified := func(code int, flowSchema, priorityLevel string) *http.Response {
+		resp := response(code)
+		resp.Header.Set(flowcontrolv1beta3.ResponseHeaderMatchedFlowSchemaUID, flowSchema)
+		resp.Header.Set(flowcontrolv1beta3.ResponseHeaderMatchedPriorityLevelConfigurationUID, priorityLevel)
+		return resp
+	}
+	// The first classification does not reset the rate learnt so far.
+	for i := 0; i < 100; i++ {
+		b.observe(http.MethodPut, time.Millisecond, classified(http.StatusOK, "fs1", "pl1"), nil)
+	}
+	if r := float64(b.limiter.Limit()); r != 4 || b.window != 3 {
+		t.Fatalf("expected the rate and the window to reach 4 and 3, got %v and %v", r, b.window)
+	}
+	// Lists might be classified into another priority level than the
+	// writes.
+	b.observe(http.MethodGet, time.Millisecond, classified(http.StatusOK, "fs2", "pl2"), nil)
+	if r := float64(b.limiter.Limit()); r != 4 || b.window != 3 {
+		t.Fatalf("expected the classification of a list to be ignored, got %v and %v", r, b.window)
+	}
+	// Another priority level restarts slowly. A conflict neither speeds up
+	// nor slows down.
+	b.observe(http.MethodPatch, time.Millisecond, classified(http.StatusConflict, "fs1", "pl2"), nil)
+	if r := float64(b.limiter.Limit()); r != 1 || b.window != 1 {
+		t.Errorf("expected the rate and the window to be reset to 1, got %v and %v", r, b.window)
+	}
+}
+
+func TestBackpressureWindow(t *testing.T) {
+	b := NewBackpressure(BackpressureConfig{MinRate: 1000, MaxRate: 1000, MaxInFlight: 1})
+	release, err := b.acquire(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The window is full, so the second write blocks until it is released
+	// or the context is done.
+	ctx, cancel := context.WithTimeout(context.TODO(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquire(ctx); err == nil {
+		t.Fatalf("expected the second write to block")
+	}
+	release()
+	release, err = b.acquire(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestNilBackpressure(t *testing.T) {
+	var b *Backpressure
+	release, err := b.acquire(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
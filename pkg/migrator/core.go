@@ -18,6 +18,7 @@ package migrator
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
 	"reflect"
 	"sync"
@@ -30,9 +31,11 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/klog/v2"
 
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
 )
 
@@ -40,27 +43,176 @@ var metadataAccessor = meta.NewAccessor()
 
 const (
 	defaultChunkLimit  = 500
+	minChunkLimit      = 10
 	defaultConcurrency = 1
+	// stopTimeout bounds how long a stopping migrator tries to save its
+	// continue token.
+	stopTimeout = 10 * time.Second
 )
 
-type migrator struct {
+// Migrator migrates the objects of a resource to its storage version, by
+// listing them in chunks and writing them back unchanged.
+type Migrator struct {
 	resource    schema.GroupVersionResource
 	client      dynamic.Interface
-	progress    progressInterface
+	progress    ProgressStore
 	concurrency int
+	chunkLimit  int64
+	// rateLimiters throttle the writes. All of them must permit a write.
+	rateLimiters []*RateLimiter
+	// concurrencyLimit is shared with other migrators.
+	concurrencyLimit *ConcurrencyLimit
+	backpressure     *Backpressure
+	// failurePolicy is nil if no failure is tolerated.
+	failurePolicy *migrationv1alpha1.FailurePolicy
+	scope         Scope
+	strategy      Strategy
+	// checkers skip the objects already stored in the current storage
+	// version. An object is skipped if any of them says so.
+	checkers []Checker
+	logger   klog.Logger
+	metrics  *metrics.CoreMigratorMetrics
 }
 
-// NewMigrator creates a migrator that can migrate a single resource type.
-func NewMigrator(resource schema.GroupVersionResource, client dynamic.Interface, progress progressInterface) *migrator {
-	return &migrator{
+// Scope restricts the objects a migrator migrates.
+type Scope struct {
+	// Namespaces are migrated one after another. If empty, objects in all
+	// namespaces are migrated.
+	Namespaces []string
+	// LabelSelector and FieldSelector select the objects to migrate.
+	LabelSelector string
+	FieldSelector string
+}
+
+// Option configures a migrator.
+type Option func(*Migrator)
+
+// WithConcurrency sets the number of objects the migrator migrates
+// concurrently. Non-positive values are ignored.
+func WithConcurrency(concurrency int) Option {
+	return func(m *Migrator) {
+		if concurrency > 0 {
+			m.concurrency = concurrency
+		}
+	}
+}
+
+// WithChunkSize sets the maximum number of objects the migrator lists in one
+// request. Non-positive values are ignored.
+func WithChunkSize(chunkSize int64) Option {
+	return func(m *Migrator) {
+		if chunkSize > 0 {
+			m.chunkLimit = chunkSize
+		}
+	}
+}
+
+// WithRateLimiter throttles the writes of the migrator with the rate limiter.
+// The option can be given several times, e.g., once with a limiter shared by
+// all migrators and once with a limiter dedicated to this migrator. A nil
+// limiter is ignored.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(m *Migrator) {
+		if limiter != nil {
+			m.rateLimiters = append(m.rateLimiters, limiter)
+		}
+	}
+}
+
+// WithConcurrencyLimit bounds the number of objects the migrator migrates
+// concurrently together with the other migrators sharing the limit. A nil
+// limit is ignored.
+func WithConcurrencyLimit(limit *ConcurrencyLimit) Option {
+	return func(m *Migrator) {
+		if limit != nil {
+			m.concurrencyLimit = limit
+		}
+	}
+}
+
+// WithBackpressure adapts the write rate and concurrency of the migrator to
+// the congestion signals observed by the backpressure.
+func WithBackpressure(backpressure *Backpressure) Option {
+	return func(m *Migrator) {
+		m.backpressure = backpressure
+	}
+}
+
+// WithFailurePolicy sets the number of objects that may fail to migrate
+// before Run gives up. By default, Run returns an error once a chunk of
+// objects contains an object that cannot be migrated.
+func WithFailurePolicy(policy *migrationv1alpha1.FailurePolicy) Option {
+	return func(m *Migrator) {
+		m.failurePolicy = policy
+	}
+}
+
+// WithScope restricts the migrator to the objects in the scope.
+func WithScope(scope Scope) Option {
+	return func(m *Migrator) {
+		m.scope = scope
+	}
+}
+
+// WithStrategy sets how the migrator writes objects. By default, it updates
+// them. A nil strategy is ignored.
+func WithStrategy(strategy Strategy) Option {
+	return func(m *Migrator) {
+		if strategy != nil {
+			m.strategy = strategy
+		}
+	}
+}
+
+// WithChecker makes the migrator skip the objects the checker knows to be
+// stored in the current storage version. The option can be given several
+// times. A nil checker is ignored.
+func WithChecker(checker Checker) Option {
+	return func(m *Migrator) {
+		if checker != nil {
+			m.checkers = append(m.checkers, checker)
+		}
+	}
+}
+
+// WithLogger sets the logger of the migrator. By default, it logs with klog.
+func WithLogger(logger klog.Logger) Option {
+	return func(m *Migrator) {
+		m.logger = logger
+	}
+}
+
+// WithMetrics sets the metrics the migrator records its progress in. By
+// default, it records them in metrics.Metrics, which is registered with the
+// default prometheus registerer. A nil value is ignored.
+func WithMetrics(recorder *metrics.CoreMigratorMetrics) Option {
+	return func(m *Migrator) {
+		if recorder != nil {
+			m.metrics = recorder
+		}
+	}
+}
+
+// NewMigrator creates a migrator that can migrate a single resource type. The
+// progress of the migration is persisted in progress.
+func NewMigrator(resource schema.GroupVersionResource, client dynamic.Interface, progress ProgressStore, opts ...Option) *Migrator {
+	m := &Migrator{
 		resource:    resource,
 		client:      client,
 		progress:    progress,
 		concurrency: defaultConcurrency,
+		chunkLimit:  defaultChunkLimit,
+		strategy:    NewUpdateStrategy(),
+		logger:      klog.Background(),
+		metrics:     metrics.Metrics,
+	}
+	for _, opt := range opts {
+		opt(m)
 	}
+	return m
 }
 
-func (m *migrator) get(ctx context.Context, namespace, name string) (*unstructured.Unstructured, error) {
+func (m *Migrator) get(ctx context.Context, namespace, name string) (*unstructured.Unstructured, error) {
 	// if namespace is empty, .Namespace(namespace) is ineffective.
 	return m.client.
 		Resource(m.resource).
@@ -68,42 +220,141 @@ func (m *migrator) get(ctx context.Context, namespace, name string) (*unstructur
 		Get(ctx, name, metav1.GetOptions{})
 }
 
-func (m *migrator) put(ctx context.Context, namespace string, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+func (m *Migrator) put(ctx context.Context, namespace string, obj *unstructured.Unstructured) error {
 	// if namespace is empty, .Namespace(namespace) is ineffective.
-	return m.client.
-		Resource(m.resource).
-		Namespace(namespace).
-		Update(ctx, obj, metav1.UpdateOptions{})
+	return m.strategy.Write(ctx, m.client.Resource(m.resource).Namespace(namespace), obj)
 }
 
-func (m *migrator) list(ctx context.Context, options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+func (m *Migrator) list(ctx context.Context, namespace string, options metav1.ListOptions) (*unstructured.UnstructuredList, error) {
 	return m.client.
 		Resource(m.resource).
-		Namespace(metav1.NamespaceAll).
+		Namespace(namespace).
 		List(ctx, options)
 }
 
 // Run migrates all the instances of the resource type managed by the migrator.
-func (m *migrator) Run(ctx context.Context) error {
-	continueToken, err := m.progress.load(ctx)
+// If some objects failed to migrate within the tolerance of the failure
+// policy, including in earlier Runs of the same migration, it returns an
+// *ErrToleratedFailures.
+func (m *Migrator) Run(ctx context.Context) error {
+	continueToken, progress, err := m.progress.Load(ctx)
 	if err != nil {
 		return err
 	}
+	namespaces, err := m.pendingNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	// The failure policy applies to the whole migration, including the
+	// objects processed before it was suspended or interrupted.
+	var counts runCounts
+	if progress != nil {
+		counts.processed = progress.Migrated + progress.Failed
+		counts.failed = progress.Failed
+	}
+	for i, namespace := range namespaces {
+		last := i == len(namespaces)-1
+		if err := m.runNamespace(ctx, namespace, continueToken, &counts, last); err != nil {
+			return err
+		}
+		if len(m.scope.Namespaces) == 0 {
+			break
+		}
+		// The continue token is only valid in the namespace it was
+		// issued for, so it must be cleared before the namespace is
+		// recorded as completed.
+		continueToken = ""
+		if err := m.progress.Save(ctx, continueToken); err != nil {
+			return err
+		}
+		if err := m.progress.CompleteNamespace(ctx, namespace); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+		if suspended, err := m.progress.Suspended(ctx); err != nil {
+			utilruntime.HandleError(err)
+		} else if suspended {
+			m.logger.V(2).Info("migration suspended after the namespace", "resource", m.resource, "namespace", namespace)
+			return ErrSuspended
+		}
+	}
+	if counts.failed > 0 {
+		return &ErrToleratedFailures{Failed: counts.failed, Processed: counts.processed}
+	}
+	return nil
+}
+
+// runCounts counts the objects processed by the migration.
+type runCounts struct {
+	processed int64
+	failed    int64
+}
+
+// pendingNamespaces returns the namespaces that remain to be migrated, in
+// order. If the migrator is not restricted to a list of namespaces, it
+// returns all namespaces.
+func (m *Migrator) pendingNamespaces(ctx context.Context) ([]string, error) {
+	if len(m.scope.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}, nil
+	}
+	completed, err := m.progress.CompletedNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := sets.NewString(completed...)
+	var pending []string
+	for _, namespace := range m.scope.Namespaces {
+		if !done.Has(namespace) {
+			pending = append(pending, namespace)
+		}
+	}
+	return pending, nil
+}
+
+// runNamespace migrates the objects in the namespace, starting from the
+// continue token. last is true if the namespace is the last one the Run
+// migrates, in which case the failure policy is evaluated in full once all
+// objects have been processed.
+func (m *Migrator) runNamespace(ctx context.Context, namespace, continueToken string, counts *runCounts, last bool) error {
+	defer func() {
+		if ctx.Err() != nil && !goerrors.Is(context.Cause(ctx), ErrObsolete) {
+			m.saveOnStop(continueToken)
+		}
+	}()
+	chunkLimit := m.chunkLimit
 	for {
-		list, listError := m.list(ctx,
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		list, listError := m.list(ctx, namespace,
 			metav1.ListOptions{
-				Limit:    defaultChunkLimit,
-				Continue: continueToken,
+				Limit:         chunkLimit,
+				Continue:      continueToken,
+				LabelSelector: m.scope.LabelSelector,
+				FieldSelector: m.scope.FieldSelector,
 			},
 		)
 		if errors.IsNotFound(listError) {
 			// Fail this migration, we don't want to get stuck on a migration for a resource that does not exist.
 			return fmt.Errorf("failed to list resources: %v", listError)
 		}
+		if listError != nil && isChunkTooLarge(listError) {
+			if smaller, ok := shrinkChunkLimit(chunkLimit); ok {
+				// The continue token does not depend on the limit,
+				// so the next list resumes where this one left off.
+				m.logger.Info("failed to list a chunk, retrying with a smaller chunk size", "resource", m.resource, "chunkSize", chunkLimit, "newChunkSize", smaller, "err", listError)
+				chunkLimit = smaller
+				continue
+			}
+		}
 		if listError != nil && !errors.IsResourceExpired(listError) {
 			if canRetry(listError) {
 				if seconds, delay := errors.SuggestsClientDelay(listError); delay {
-					time.Sleep(time.Duration(seconds) * time.Second)
+					if err := sleep(ctx, time.Duration(seconds)*time.Second); err != nil {
+						return err
+					}
 				}
 				continue
 			}
@@ -115,34 +366,129 @@ func (m *migrator) Run(ctx context.Context) error {
 				return err
 			}
 			continueToken = token
-			err = m.progress.save(ctx, continueToken)
+			err = m.progress.Save(ctx, continueToken)
 			if err != nil {
 				utilruntime.HandleError(err)
 			}
 			continue
 		}
-		if err := m.migrateList(list); err != nil {
+		migrateError := m.migrateList(ctx, list)
+		if err := ctx.Err(); err != nil {
+			// The objects that were interrupted did not fail to
+			// migrate, so the chunk is not recorded.
+			return err
+		}
+		failures, err := objectFailures(migrateError)
+		if err != nil {
 			return err
 		}
 		token, err := metadataAccessor.Continue(list)
 		if err != nil {
 			return err
 		}
-		metrics.Metrics.ObserveObjectsMigrated(len(list.Items), m.resource.String())
-		// TODO: call ObserveObjectsRemaining as well, once https://github.com/kubernetes/kubernetes/pull/75993 is in.
-		if len(token) == 0 {
+		counts.processed += int64(len(list.Items))
+		counts.failed += int64(len(failures))
+		m.metrics.ObserveObjectsMigrated(len(list.Items)-len(failures), m.resource.String())
+		m.metrics.ObserveObjectsFailed(len(failures), m.resource.String())
+		remaining := list.GetRemainingItemCount()
+		switch {
+		case !last:
+			// The apiserver only estimates the remaining items in
+			// this namespace.
+			remaining = nil
+		case len(token) == 0:
+			// The apiserver does not estimate the remaining items in
+			// the last chunk.
+			var zero int64
+			remaining = &zero
+		}
+		if remaining != nil {
+			m.metrics.ObserveObjectsRemaining(int(*remaining), m.resource.String())
+		}
+		result := ChunkResult{
+			Migrated:  int64(len(list.Items) - len(failures)),
+			Remaining: remaining,
+			Failures:  failures,
+		}
+		if err := m.progress.Observe(ctx, result); err != nil {
+			utilruntime.HandleError(err)
+		}
+		done := len(token) == 0
+		if !tolerates(m.failurePolicy, counts.failed, counts.processed, done && last) {
+			if m.failurePolicy == nil && migrateError != nil {
+				return migrateError
+			}
+			// The failures might have been counted by an earlier Run.
+			return fmt.Errorf("%d of %d objects failed to migrate, more than the failure policy tolerates", counts.failed, counts.processed)
+		}
+		if done {
 			return nil
 		}
 		continueToken = token
-		err = m.progress.save(ctx, continueToken)
+		err = m.progress.Save(ctx, continueToken)
 		if err != nil {
 			utilruntime.HandleError(err)
 		}
+		suspended, err := m.progress.Suspended(ctx)
+		if err != nil {
+			utilruntime.HandleError(err)
+		}
+		if suspended {
+			m.logger.V(2).Info("migration suspended", "resource", m.resource, "processed", counts.processed)
+			return ErrSuspended
+		}
+	}
+}
+
+// saveOnStop saves the continue token of the last migrated chunk once the
+// context of the Run is done, e.g., because the migrator lost its leadership
+// or is shutting down, so that the next Run resumes from there. It is not
+// called if the context is cancelled with ErrObsolete. The token is
+// saved after every chunk already, but that save may have been interrupted.
+func (m *Migrator) saveOnStop(continueToken string) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := m.progress.Save(ctx, continueToken); err != nil && !errors.IsNotFound(err) {
+		utilruntime.HandleError(fmt.Errorf("%v: failed to save the continue token: %v", m.resource, err))
+		return
+	}
+	m.logger.V(2).Info("migration stopped, saved the continue token", "resource", m.resource)
+}
+
+// tolerates returns true if the failure policy tolerates failed objects out
+// of processed objects failing to migrate. The percentage limit is only
+// evaluated once all objects have been processed.
+func tolerates(policy *migrationv1alpha1.FailurePolicy, failed, processed int64, done bool) bool {
+	if failed == 0 {
+		return true
+	}
+	if policy == nil || (policy.MaxFailures == 0 && policy.MaxFailurePercent == 0) {
+		return false
+	}
+	if policy.MaxFailures > 0 && failed > int64(policy.MaxFailures) {
+		return false
 	}
+	if done && policy.MaxFailurePercent > 0 && failed*100 > int64(policy.MaxFailurePercent)*processed {
+		return false
+	}
+	return true
 }
 
-func (m *migrator) migrateList(l *unstructured.UnstructuredList) error {
-	ctx, cancel := context.WithCancel(context.Background())
+// shrinkChunkLimit halves the chunk limit, down to minChunkLimit. It returns
+// false if the limit cannot be shrunk any further.
+func shrinkChunkLimit(limit int64) (int64, bool) {
+	if limit <= minChunkLimit {
+		return limit, false
+	}
+	limit /= 2
+	if limit < minChunkLimit {
+		limit = minChunkLimit
+	}
+	return limit, true
+}
+
+func (m *Migrator) migrateList(ctx context.Context, l *unstructured.UnstructuredList) error {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	workc := make(chan *unstructured.Unstructured)
@@ -179,21 +525,45 @@ func (m *migrator) migrateList(l *unstructured.UnstructuredList) error {
 	return utilerrors.NewAggregate(errors)
 }
 
-func (m *migrator) worker(ctx context.Context, workc <-chan *unstructured.Unstructured, errc chan<- error) {
+func (m *Migrator) worker(ctx context.Context, workc <-chan *unstructured.Unstructured, errc chan<- error) {
 	for item := range workc {
-		err := m.migrateOneItem(ctx, item)
+		if ctx.Err() != nil {
+			return
+		}
+		if !m.needsMigration(item) {
+			m.metrics.ObserveObjectSkipped(m.resource.String())
+			continue
+		}
+		release, err := m.concurrencyLimit.acquire(ctx)
 		if err != nil {
-			select {
-			case errc <- err:
-				continue
-			case <-ctx.Done():
-				return
-			}
+			return
+		}
+		err = m.migrateOneItem(ctx, item)
+		release()
+		if err == nil {
+			m.metrics.ObserveObjectRewritten(m.resource.String())
+			continue
+		}
+		select {
+		case errc <- &objectError{namespace: item.GetNamespace(), name: item.GetName(), error: err}:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (m *migrator) migrateOneItem(ctx context.Context, item *unstructured.Unstructured) error {
+// needsMigration returns false if a checker knows the item is stored in the
+// current storage version.
+func (m *Migrator) needsMigration(item *unstructured.Unstructured) bool {
+	for _, c := range m.checkers {
+		if !c.NeedsMigration(item) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Migrator) migrateOneItem(ctx context.Context, item *unstructured.Unstructured) error {
 	namespace, err := metadataAccessor.Namespace(item)
 	if err != nil {
 		return err
@@ -204,23 +574,26 @@ func (m *migrator) migrateOneItem(ctx context.Context, item *unstructured.Unstru
 	}
 	getBeforePut := false
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		getBeforePut, err = m.try(ctx, namespace, name, item, getBeforePut)
 		if err == nil || errors.IsNotFound(err) {
 			return nil
 		}
 		if canRetry(err) {
 			seconds, delay := errors.SuggestsClientDelay(err)
-			switch {
-			case delay && len(namespace) > 0:
-				klog.Warningf("migration of %s, in the %s namespace, will be retried after a %ds delay: %v", name, namespace, seconds, err)
-				time.Sleep(time.Duration(seconds) * time.Second)
-			case delay:
-				klog.Warningf("migration of %s will be retried after a %ds delay: %v", name, seconds, err)
-				time.Sleep(time.Duration(seconds) * time.Second)
-			case !delay && len(namespace) > 0:
-				klog.Warningf("migration of %s, in the %s namespace, will be retried: %v", name, namespace, err)
-			default:
-				klog.Warningf("migration of %s will be retried: %v", name, err)
+			logger := m.logger.WithValues("resource", m.resource, "name", name)
+			if len(namespace) > 0 {
+				logger = logger.WithValues("namespace", namespace)
+			}
+			if delay {
+				logger.Info("migration of the object will be retried after a delay", "delay", time.Duration(seconds)*time.Second, "err", err)
+				if err := sleep(ctx, time.Duration(seconds)*time.Second); err != nil {
+					return err
+				}
+			} else {
+				logger.Info("migration of the object will be retried", "err", err)
 			}
 			continue
 		}
@@ -229,10 +602,24 @@ func (m *migrator) migrateOneItem(ctx context.Context, item *unstructured.Unstru
 	}
 }
 
-// try tries to migrate the single object by PUT. It refreshes the object via
-// GET if "get" is true. If the PUT fails due to conflicts, or the GET fails,
-// the function requests the next try to GET the new object.
-func (m *migrator) try(ctx context.Context, namespace, name string, item *unstructured.Unstructured, get bool) (bool, error) {
+// sleep pauses for the duration d, or until ctx is done, in which case it
+// returns the error of ctx.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// try tries to migrate the single object by writing it with the strategy of
+// the migrator. It refreshes the object via GET if "get" is true. If the write
+// fails due to conflicts, or the GET fails, the function requests the next
+// try to GET the new object.
+func (m *Migrator) try(ctx context.Context, namespace, name string, item *unstructured.Unstructured, get bool) (bool, error) {
 	var err error
 	if get {
 		item, err = m.get(ctx, namespace, name)
@@ -240,17 +627,54 @@ func (m *migrator) try(ctx context.Context, namespace, name string, item *unstru
 			return true, err
 		}
 	}
-	_, err = m.put(ctx, namespace, item)
+	if err := m.throttle(ctx, item); err != nil {
+		return false, ErrNotRetriable{err}
+	}
+	release, err := m.backpressure.acquire(ctx)
+	if err != nil {
+		return false, ErrNotRetriable{err}
+	}
+	err = m.put(ctx, namespace, item)
+	release()
 	if err == nil {
 		return false, nil
 	}
 	return errors.IsConflict(err), err
+}
 
-	// TODO: The oc admin uses a defer function to do bandwidth limiting
-	// after doing all operations. The rate limiter is marked as an alpha
-	// feature.  Is it better than the built-in qps limit in the REST
-	// client? Maybe it's necessary because not all resource types are of
-	// the same size?
+// throttle blocks until all the rate limiters permit writing the item. The
+// REST client's QPS limit alone is not enough, because objects of different
+// resource types vary a lot in size.
+func (m *Migrator) throttle(ctx context.Context, item *unstructured.Unstructured) error {
+	if len(m.rateLimiters) == 0 {
+		return nil
+	}
+	size := 0
+	for _, l := range m.rateLimiters {
+		if !l.limitsBytes() {
+			continue
+		}
+		data, err := item.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		size = len(data)
+		break
+	}
+	start := time.Now()
+	delayed := false
+	for _, l := range m.rateLimiters {
+		d, err := l.wait(ctx, size)
+		if err != nil {
+			return err
+		}
+		delayed = delayed || d
+	}
+	// Writes the limiters permit right away are not throttled.
+	if delayed {
+		m.metrics.ObserveThrottled(time.Since(start), m.resource.String())
+	}
+	return nil
 }
 
 // TODO: move this helper to "k8s.io/apimachinery/pkg/api/errors"
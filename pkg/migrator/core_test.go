@@ -20,7 +20,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	ptype "github.com/prometheus/client_model/go"
@@ -29,10 +32,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/scheme"
 	clitesting "k8s.io/client-go/testing"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
 )
 
@@ -157,7 +163,7 @@ func TestMigrateList(t *testing.T) {
 	})
 
 	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("pods"), client, &progressTracker{})
-	migratorError := migrator.migrateList(toUnstructuredListOrDie(podList))
+	migratorError := migrator.migrateList(context.TODO(), toUnstructuredListOrDie(podList))
 
 	// Validating sent requests.
 	nsSet := sets.NewString()
@@ -207,7 +213,7 @@ func TestMigrateListClusterScoped(t *testing.T) {
 	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
 
 	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &progressTracker{})
-	err := migrator.migrateList(toUnstructuredListOrDie(nodeList))
+	err := migrator.migrateList(context.TODO(), toUnstructuredListOrDie(nodeList))
 	if err != nil {
 		t.Errorf("unexpected migration error, %v", err)
 	}
@@ -241,13 +247,534 @@ func TestMigrateListClusterScoped(t *testing.T) {
 	}
 }
 
+func TestMigrateListConcurrently(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(100)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &progressTracker{}, WithConcurrency(8))
+	if migrator.concurrency != 8 {
+		t.Fatalf("expected concurrency 8, got %d", migrator.concurrency)
+	}
+	if err := migrator.migrateList(context.TODO(), toUnstructuredListOrDie(nodeList)); err != nil {
+		t.Errorf("unexpected migration error, %v", err)
+	}
+	if e, a := 100, len(client.Actions()); e != a {
+		t.Errorf("expected %d updates, got %d", e, a)
+	}
+}
+
+// concurrentStrategy records the maximum number of concurrent writes.
+type concurrentStrategy struct {
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (s *concurrentStrategy) Write(ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.max {
+		s.max = s.inFlight
+	}
+	s.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	return nil
+}
+
+func TestMigrateListSharesConcurrencyLimit(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(50)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	strategy := &concurrentStrategy{}
+	limit := NewConcurrencyLimit(3)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &progressTracker{},
+			WithConcurrency(8), WithConcurrencyLimit(limit), WithStrategy(strategy))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := migrator.migrateList(context.TODO(), toUnstructuredListOrDie(nodeList)); err != nil {
+				t.Errorf("unexpected migration error, %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if strategy.max > 3 {
+		t.Errorf("expected at most 3 concurrent writes across both migrators, got %d", strategy.max)
+	}
+}
+
+func TestThrottledOnlyWhenDelayed(t *testing.T) {
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	registry := prometheus.NewRegistry()
+	// The burst of the limiter covers all the writes.
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &progressTracker{},
+		WithRateLimiter(NewRateLimiter(100, 0)), WithMetrics(metrics.NewCoreMigratorMetrics(registry)))
+	if err := migrator.migrateList(context.TODO(), toUnstructuredListOrDie(nodeList)); err != nil {
+		t.Fatalf("unexpected migration error, %v", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "storage_migrator_core_migrator_throttled_seconds" {
+			t.Errorf("expected no throttled writes, got %v", mf.GetMetric())
+		}
+	}
+}
+
+func TestShrinkChunkLimit(t *testing.T) {
+	for _, tc := range []struct {
+		limit      int64
+		want       int64
+		wantShrunk bool
+	}{
+		{limit: 500, want: 250, wantShrunk: true},
+		{limit: 15, want: minChunkLimit, wantShrunk: true},
+		{limit: minChunkLimit, want: minChunkLimit, wantShrunk: false},
+	} {
+		got, shrunk := shrinkChunkLimit(tc.limit)
+		if got != tc.want || shrunk != tc.wantShrunk {
+			t.Errorf("limit %d: expected (%d, %v), got (%d, %v)", tc.limit, tc.want, tc.wantShrunk, got, shrunk)
+		}
+	}
+}
+
+func TestRunShrinksChunkOnTimeout(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	lists := 0
+	client.Fake.PrependReactor("list", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		lists++
+		if lists == 1 {
+			return true, nil, errors.NewTimeoutError("list took too long", 0)
+		}
+		return false, nil, nil
+	})
+
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &fakeProgress{}, WithChunkSize(100))
+	if err := migrator.Run(context.TODO()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lists != 2 {
+		t.Errorf("expected the list to be retried once, got %d lists", lists)
+	}
+	expectCounterCount(t,
+		"storage_migrator_core_migrator_migrated_objects",
+		map[string]string{
+			"resource": "/v1, Resource=nodes",
+		},
+		10,
+	)
+}
+
+func TestTolerates(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		policy    *migrationv1alpha1.FailurePolicy
+		failed    int64
+		processed int64
+		done      bool
+		want      bool
+	}{
+		{name: "no failure", failed: 0, processed: 10, want: true},
+		{name: "no policy", failed: 1, processed: 10, want: false},
+		{name: "empty policy", policy: &migrationv1alpha1.FailurePolicy{}, failed: 1, processed: 10, want: false},
+		{name: "within max failures", policy: &migrationv1alpha1.FailurePolicy{MaxFailures: 2}, failed: 2, processed: 10, want: true},
+		{name: "above max failures", policy: &migrationv1alpha1.FailurePolicy{MaxFailures: 2}, failed: 3, processed: 10, want: false},
+		{name: "percent not evaluated before done", policy: &migrationv1alpha1.FailurePolicy{MaxFailurePercent: 10}, failed: 5, processed: 10, want: true},
+		{name: "within percent", policy: &migrationv1alpha1.FailurePolicy{MaxFailurePercent: 10}, failed: 1, processed: 10, done: true, want: true},
+		{name: "above percent", policy: &migrationv1alpha1.FailurePolicy{MaxFailurePercent: 10}, failed: 2, processed: 10, done: true, want: false},
+	} {
+		if got := tolerates(tc.policy, tc.failed, tc.processed, tc.done); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestRunToleratesFailures(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	client.Fake.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		name, err := metadataAccessor.Name(a.(clitesting.UpdateAction).GetObject())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "node5" {
+			return true, nil, errors.NewMethodNotSupported(v1.Resource("nodes"), "update")
+		}
+		return false, nil, nil
+	})
+
+	progress := &recordingProgress{}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress,
+		WithFailurePolicy(&migrationv1alpha1.FailurePolicy{MaxFailures: 1}))
+	err := migrator.Run(context.TODO())
+	tolerated, ok := err.(*ErrToleratedFailures)
+	if !ok {
+		t.Fatalf("expected ErrToleratedFailures, got %v", err)
+	}
+	if tolerated.Failed != 1 || tolerated.Processed != 10 {
+		t.Errorf("unexpected counts %+v", tolerated)
+	}
+	if len(progress.failures) != 1 || progress.failures[0].Name != "node5" {
+		t.Errorf("expected node5 to be recorded as failed, got %+v", progress.failures)
+	}
+	if progress.migrated != 9 {
+		t.Errorf("expected 9 migrated objects, got %d", progress.migrated)
+	}
+}
+
+func TestRunRecordsRejectedObjects(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	client.Fake.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		name, err := metadataAccessor.Name(a.(clitesting.UpdateAction).GetObject())
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch name {
+		case "node3":
+			return true, nil, errors.NewInvalid(schema.GroupKind{Kind: "Node"}, name, nil)
+		case "node7":
+			return true, nil, errors.NewForbidden(v1.Resource("nodes"), name, fmt.Errorf("denied by the webhook"))
+		case "node8":
+			return true, nil, errors.NewBadRequest("bad node")
+		}
+		return false, nil, nil
+	})
+
+	progress := &recordingProgress{}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress,
+		WithFailurePolicy(&migrationv1alpha1.FailurePolicy{MaxFailures: 3}))
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Second)
+	defer cancel()
+	err := migrator.Run(ctx)
+	tolerated, ok := err.(*ErrToleratedFailures)
+	if !ok {
+		t.Fatalf("expected the rejected objects to be recorded as failed, got %v", err)
+	}
+	if tolerated.Failed != 3 || tolerated.Processed != 10 {
+		t.Errorf("unexpected counts %+v", tolerated)
+	}
+	failed := sets.NewString()
+	for _, f := range progress.failures {
+		failed.Insert(f.Name)
+	}
+	if e := sets.NewString("node3", "node7", "node8"); !failed.Equal(e) {
+		t.Errorf("expected %v to be recorded as failed, got %v", e.List(), failed.List())
+	}
+}
+
+func TestRunToleratesFailuresAcrossRuns(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	lists := 0
+	client.Fake.PrependReactor("list", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		lists++
+		chunk := newNodeList(10)
+		if lists == 1 {
+			chunk.Items = chunk.Items[:5]
+			chunk.Continue = "next"
+		} else {
+			chunk.Items = chunk.Items[5:]
+		}
+		return true, toUnstructuredListOrDie(chunk), nil
+	})
+	client.Fake.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		name, err := metadataAccessor.Name(a.(clitesting.UpdateAction).GetObject())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "node2" {
+			return true, nil, errors.NewMethodNotSupported(v1.Resource("nodes"), "update")
+		}
+		return false, nil, nil
+	})
+
+	progress := NewMemoryProgressStore()
+	progress.Suspend(true)
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress,
+		WithChunkSize(5), WithFailurePolicy(&migrationv1alpha1.FailurePolicy{MaxFailures: 1}))
+	if err := migrator.Run(context.TODO()); err != ErrSuspended {
+		t.Fatalf("expected ErrSuspended, got %v", err)
+	}
+	progress.Suspend(false)
+	err := migrator.Run(context.TODO())
+	tolerated, ok := err.(*ErrToleratedFailures)
+	if !ok {
+		t.Fatalf("expected the failure before the suspension to be reported, got %v", err)
+	}
+	if tolerated.Failed != 1 || tolerated.Processed != 10 {
+		t.Errorf("unexpected counts %+v", tolerated)
+	}
+}
+
+func TestRunFailsOnFailuresOfEarlierRuns(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+
+	// An earlier Run failed to migrate an object, and no failure is
+	// tolerated.
+	progress := NewMemoryProgressStore()
+	if err := progress.Observe(context.TODO(), ChunkResult{
+		Migrated: 4,
+		Failures: []migrationv1alpha1.FailedObject{{Name: "node4"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress)
+	err := migrator.Run(context.TODO())
+	if _, tolerated := err.(*ErrToleratedFailures); err == nil || tolerated {
+		t.Errorf("expected the migration to fail, got %v", err)
+	}
+}
+
+func TestRunStopsWhenSuspended(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	client.Fake.PrependReactor("list", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		chunk := newNodeList(5)
+		chunk.Continue = "next"
+		return true, toUnstructuredListOrDie(chunk), nil
+	})
+
+	progress := &suspendingProgress{}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress, WithChunkSize(5))
+	if err := migrator.Run(context.TODO()); err != ErrSuspended {
+		t.Fatalf("expected ErrSuspended, got %v", err)
+	}
+	if progress.token != "next" {
+		t.Errorf("expected the continue token to be saved, got %q", progress.token)
+	}
+	if progress.migrated != 5 {
+		t.Errorf("expected the migration to stop after the first chunk, got %d migrated objects", progress.migrated)
+	}
+}
+
+func TestRunStopsWhenCancelled(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	ctx, cancel := context.WithCancel(context.TODO())
+	client.Fake.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		// Without cancellation, every object would be retried after a
+		// minute.
+		cancel()
+		return true, nil, errors.NewTooManyRequests("slow down", 60)
+	})
+
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &fakeProgress{})
+	start := time.Now()
+	if err := migrator.Run(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected Run to stop promptly, took %v", elapsed)
+	}
+}
+
+func TestRunSavesTokenWhenCancelled(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	lists := 0
+	client.Fake.PrependReactor("list", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		lists++
+		chunk := newNodeList(5)
+		if lists == 1 {
+			chunk.Continue = "next"
+		}
+		return true, toUnstructuredListOrDie(chunk), nil
+	})
+	ctx, cancel := context.WithCancel(context.TODO())
+	updates := 0
+	client.Fake.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates <= 5 {
+			return false, nil, nil
+		}
+		// The migrator loses its leadership during the second chunk.
+		cancel()
+		return true, nil, errors.NewTooManyRequests("slow down", 60)
+	})
+
+	progress := &stoppedProgress{}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress, WithChunkSize(5))
+	if err := migrator.Run(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// The token is saved after the first chunk, and again once stopped.
+	if len(progress.tokens) != 2 || progress.tokens[1] != "next" {
+		t.Errorf("expected the continue token of the first chunk to be saved once stopped, got %v", progress.tokens)
+	}
+}
+
+func TestRunDoesNotSaveTokenWhenObsolete(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	lists := 0
+	client.Fake.PrependReactor("list", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		lists++
+		chunk := newNodeList(5)
+		if lists == 1 {
+			chunk.Continue = "next"
+		}
+		return true, toUnstructuredListOrDie(chunk), nil
+	})
+	ctx, cancel := context.WithCancelCause(context.TODO())
+	updates := 0
+	client.Fake.PrependReactor("update", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates <= 5 {
+			return false, nil, nil
+		}
+		// The migration is retargeted at another resource during the
+		// second chunk.
+		cancel(ErrObsolete)
+		return true, nil, errors.NewTooManyRequests("slow down", 60)
+	})
+
+	progress := &stoppedProgress{}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, progress, WithChunkSize(5))
+	if err := migrator.Run(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// The token is only saved after the first chunk.
+	if len(progress.tokens) != 1 {
+		t.Errorf("expected the continue token not to be saved once obsolete, got %v", progress.tokens)
+	}
+}
+
+func TestRunMigratesNamespacesInOrder(t *testing.T) {
+	metrics.Metrics.Reset()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, map[schema.GroupVersionResource]string{
+		v1.SchemeGroupVersion.WithResource("pods"): "PodList",
+	})
+	var listed []string
+	client.Fake.PrependReactor("list", "pods", func(a clitesting.Action) (bool, runtime.Object, error) {
+		restrictions := a.(clitesting.ListAction).GetListRestrictions()
+		if restrictions.Labels.String() != "app=web" || restrictions.Fields.String() != "status.phase=Running" {
+			t.Errorf("unexpected selectors %v", restrictions)
+		}
+		listed = append(listed, a.GetNamespace())
+		return true, toUnstructuredListOrDie(v1.PodList{
+			TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+			Items:    []v1.Pod{newPod("pod", a.GetNamespace())},
+		}), nil
+	})
+
+	progress := &namespaceProgress{completed: []string{"a"}}
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("pods"), client, progress, WithScope(Scope{
+		Namespaces:    []string{"a", "b", "c"},
+		LabelSelector: "app=web",
+		FieldSelector: "status.phase=Running",
+	}))
+	if err := migrator.Run(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"b", "c"}, listed; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected to list namespaces %v, got %v", e, a)
+	}
+	if e, a := []string{"a", "b", "c"}, progress.completed; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected completed namespaces %v, got %v", e, a)
+	}
+}
+
+// namespaceProgress records the completed namespaces.
+type namespaceProgress struct {
+	fakeProgress
+	completed []string
+}
+
+func (p *namespaceProgress) CompletedNamespaces(context.Context) ([]string, error) {
+	return p.completed, nil
+}
+
+func (p *namespaceProgress) CompleteNamespace(_ context.Context, namespace string) error {
+	p.completed = append(p.completed, namespace)
+	return nil
+}
+
+// suspendingProgress suspends the migration after the first chunk.
+type suspendingProgress struct {
+	recordingProgress
+	token string
+}
+
+func (p *suspendingProgress) Save(_ context.Context, token string) error {
+	p.token = token
+	return nil
+}
+
+func (p *suspendingProgress) Suspended(context.Context) (bool, error) {
+	return p.migrated > 0, nil
+}
+
+// stoppedProgress records the continue tokens saved with a live context.
+type stoppedProgress struct {
+	fakeProgress
+	tokens []string
+}
+
+func (p *stoppedProgress) Save(ctx context.Context, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p.tokens = append(p.tokens, token)
+	return nil
+}
+
+type recordingProgress struct {
+	fakeProgress
+	migrated int64
+	failures []migrationv1alpha1.FailedObject
+}
+
+func (p *recordingProgress) Observe(_ context.Context, result ChunkResult) error {
+	p.migrated += result.Migrated
+	p.failures = append(p.failures, result.Failures...)
+	return nil
+}
+
 type fakeProgress struct{}
 
-func (f *fakeProgress) load(ctx context.Context) (string, error) {
-	return "", nil
+func (f *fakeProgress) Load(ctx context.Context) (string, *migrationv1alpha1.MigrationProgress, error) {
+	return "", nil, nil
+}
+
+func (f *fakeProgress) Save(context.Context, string) error {
+	return nil
+}
+
+func (f *fakeProgress) Observe(context.Context, ChunkResult) error {
+	return nil
+}
+
+func (f *fakeProgress) Suspended(context.Context) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeProgress) CompletedNamespaces(context.Context) ([]string, error) {
+	return nil, nil
 }
 
-func (f *fakeProgress) save(context.Context, string) error {
+func (f *fakeProgress) CompleteNamespace(context.Context, string) error {
 	return nil
 }
 
@@ -17,10 +17,15 @@ limitations under the License.
 package migrator
 
 import (
+	goerrors "errors"
+	"fmt"
 	"strings"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/net"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 )
 
 // ErrRetriable is a wrapper for an error that a migrator may use to indicate the
@@ -46,12 +51,89 @@ type TemporaryError interface {
 	Temporary() bool
 }
 
+// ErrToleratedFailures is returned by a migrator that has processed all
+// objects, when the objects that failed to migrate are within the tolerance
+// of the failure policy.
+type ErrToleratedFailures struct {
+	Failed    int64
+	Processed int64
+}
+
+func (e *ErrToleratedFailures) Error() string {
+	return fmt.Sprintf("%d of %d objects failed to migrate", e.Failed, e.Processed)
+}
+
+// ErrSuspended is returned by a migrator that stopped because the migration
+// was suspended, or because its maintenance window closed. The continue token
+// has been saved, so the next Run resumes where this one stopped.
+var ErrSuspended = goerrors.New("the migration is suspended")
+
+// ErrObsolete is the cause the context of a Run is cancelled with when the
+// migration is obsolete, e.g., because it has been deleted, recreated or
+// retargeted at another resource, or because another replica took it over.
+// The migrator then stops without saving its continue token, which would not
+// be valid for the migration anymore.
+var ErrObsolete = goerrors.New("the migration is obsolete")
+
+// objectError is an error migrating a specific object.
+type objectError struct {
+	namespace string
+	name      string
+	error
+}
+
+// objectFailures returns the objects that failed to migrate, given the error
+// returned by migrateList. It returns an error if err contains an error that
+// is not about a specific object.
+func objectFailures(err error) ([]migrationv1alpha1.FailedObject, error) {
+	if err == nil {
+		return nil, nil
+	}
+	agg, ok := err.(utilerrors.Aggregate)
+	if !ok {
+		return nil, err
+	}
+	var failures []migrationv1alpha1.FailedObject
+	for _, e := range agg.Errors() {
+		oe, ok := e.(*objectError)
+		if !ok {
+			return nil, err
+		}
+		failures = append(failures, migrationv1alpha1.FailedObject{
+			Namespace: oe.namespace,
+			Name:      oe.name,
+			Reason:    oe.Error(),
+		})
+	}
+	return failures, nil
+}
+
 // isConnectionRefusedError checks if the error string include "connection refused"
 // TODO: find a "go-way" to detect this error, probably using *os.SyscallError
 func isConnectionRefusedError(err error) bool {
 	return strings.Contains(err.Error(), "connection refused")
 }
 
+// isChunkTooLarge returns true if the error indicates that the list request
+// might succeed with a smaller limit.
+func isChunkTooLarge(err error) bool {
+	switch {
+	case errors.IsServerTimeout(err):
+		return true
+	case errors.IsTimeout(err):
+		return true
+	case errors.IsRequestEntityTooLargeError(err):
+		return true
+	case net.IsTimeout(err):
+		return true
+	// etcd rejects responses larger than its gRPC message size limit.
+	case strings.Contains(err.Error(), "larger than max"):
+		return true
+	default:
+		return false
+	}
+}
+
 // interpret adds retry information to the provided error. And it might change
 // the error to nil.
 func interpret(err error) error {
@@ -63,6 +145,14 @@ func interpret(err error) error {
 		return nil
 	case errors.IsMethodNotSupported(err):
 		return ErrNotRetriable{err}
+	// An admission webhook or the validation rejects the object the same
+	// way every time.
+	case errors.IsForbidden(err):
+		return ErrNotRetriable{err}
+	case errors.IsInvalid(err):
+		return ErrNotRetriable{err}
+	case errors.IsBadRequest(err):
+		return ErrNotRetriable{err}
 	case errors.IsConflict(err):
 		return ErrRetriable{err}
 	case errors.IsServerTimeout(err):
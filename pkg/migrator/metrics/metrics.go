@@ -17,6 +17,8 @@ limitations under the License.
 package metrics
 
 import (
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -26,19 +28,28 @@ const (
 )
 
 var (
-	// Metrics provides access to all core migrator metrics.
-	Metrics = newCoreMigratorMetrics()
+	// Metrics provides access to all core migrator metrics, registered
+	// with the default prometheus registerer.
+	Metrics = NewCoreMigratorMetrics(prometheus.DefaultRegisterer)
 )
 
 // CoreMigratorMetrics instruments core migrator with prometheus metrics.
 type CoreMigratorMetrics struct {
-	objectsMigrated  *prometheus.CounterVec
-	objectsRemaining *prometheus.GaugeVec
-	migration        *prometheus.CounterVec
+	objectsMigrated     *prometheus.CounterVec
+	objectsRemaining    *prometheus.GaugeVec
+	objectsFailed       *prometheus.CounterVec
+	objectsRewritten    *prometheus.CounterVec
+	objectsSkipped      *prometheus.CounterVec
+	migration           *prometheus.CounterVec
+	throttled           *prometheus.CounterVec
+	backpressureRate    prometheus.Gauge
+	backpressureWindow  prometheus.Gauge
+	backpressureSignals *prometheus.CounterVec
 }
 
-// newCoreMigratorMetrics create a new CoreMigratorMetrics, configured with default metric names.
-func newCoreMigratorMetrics() *CoreMigratorMetrics {
+// NewCoreMigratorMetrics creates a new CoreMigratorMetrics, configured with
+// default metric names, and registers the metrics with registerer.
+func NewCoreMigratorMetrics(registerer prometheus.Registerer) *CoreMigratorMetrics {
 	objectsMigrated := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
@@ -46,7 +57,7 @@ func newCoreMigratorMetrics() *CoreMigratorMetrics {
 			Name:      "migrated_objects",
 			Help:      "The number of objects that have been migrated, labeled with the full resource name.",
 		}, []string{"resource"})
-	prometheus.MustRegister(objectsMigrated)
+	registerer.MustRegister(objectsMigrated)
 
 	objectsRemaining := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -55,28 +66,105 @@ func newCoreMigratorMetrics() *CoreMigratorMetrics {
 			Name:      "remaining_objects",
 			Help:      "The number of objects that still require migration, labeled with the full resource name",
 		}, []string{"resource"})
-	prometheus.MustRegister(objectsRemaining)
+	registerer.MustRegister(objectsRemaining)
+
+	objectsFailed := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "failed_objects",
+			Help:      "The number of objects that failed to migrate, labeled with the full resource name.",
+		}, []string{"resource"})
+	registerer.MustRegister(objectsFailed)
+
+	objectsRewritten := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rewritten_objects",
+			Help:      "The number of migrated objects that have been written to the apiserver, labeled with the full resource name.",
+		}, []string{"resource"})
+	registerer.MustRegister(objectsRewritten)
+
+	objectsSkipped := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "skipped_objects",
+			Help:      "The number of migrated objects that have not been written because they were already stored in the current storage version, labeled with the full resource name.",
+		}, []string{"resource"})
+	registerer.MustRegister(objectsSkipped)
 
 	migration := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
 			Name:      "migrations",
-			Help:      "The number of completed migration, labeled with the full resource name, and the status of the migration (failed or succeeded)",
+			Help:      "The number of completed migration, labeled with the full resource name, and the status of the migration (failed, succeeded or succeeded with errors)",
 		}, []string{"resource", "status"})
-	prometheus.MustRegister(migration)
+	registerer.MustRegister(migration)
+
+	throttled := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "throttled_seconds",
+			Help:      "The total time writes have been delayed by the client-side rate limiters, labeled with the full resource name.",
+		}, []string{"resource"})
+	registerer.MustRegister(throttled)
+
+	backpressureRate := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backpressure_rate",
+			Help:      "The number of objects per second the adaptive backpressure currently permits to write.",
+		})
+	registerer.MustRegister(backpressureRate)
+
+	backpressureWindow := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backpressure_window",
+			Help:      "The number of concurrent writes the adaptive backpressure currently permits.",
+		})
+	registerer.MustRegister(backpressureWindow)
+
+	backpressureSignals := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "backpressure_signals",
+			Help:      "The number of apiserver congestion signals observed by the adaptive backpressure, labeled with the reason (latency, throttled or error).",
+		}, []string{"reason"})
+	registerer.MustRegister(backpressureSignals)
 
 	return &CoreMigratorMetrics{
-		objectsMigrated:  objectsMigrated,
-		objectsRemaining: objectsRemaining,
-		migration:        migration,
+		objectsMigrated:     objectsMigrated,
+		objectsRemaining:    objectsRemaining,
+		objectsFailed:       objectsFailed,
+		objectsRewritten:    objectsRewritten,
+		objectsSkipped:      objectsSkipped,
+		migration:           migration,
+		throttled:           throttled,
+		backpressureRate:    backpressureRate,
+		backpressureWindow:  backpressureWindow,
+		backpressureSignals: backpressureSignals,
 	}
 }
 
 func (m *CoreMigratorMetrics) Reset() {
 	m.objectsMigrated.Reset()
 	m.objectsRemaining.Reset()
+	m.objectsFailed.Reset()
+	m.objectsRewritten.Reset()
+	m.objectsSkipped.Reset()
 	m.migration.Reset()
+	m.throttled.Reset()
+	m.backpressureRate.Set(0)
+	m.backpressureWindow.Set(0)
+	m.backpressureSignals.Reset()
 }
 
 // ObserveObjectsMigrated adds the number of migrated objects for a resource type..
@@ -89,12 +177,51 @@ func (m *CoreMigratorMetrics) ObserveObjectsRemaining(count int, resource string
 	m.objectsRemaining.WithLabelValues(resource).Set(float64(count))
 }
 
+// ObserveObjectRewritten counts a migrated object of a resource type that has
+// been written to the apiserver.
+func (m *CoreMigratorMetrics) ObserveObjectRewritten(resource string) {
+	m.objectsRewritten.WithLabelValues(resource).Inc()
+}
+
+// ObserveObjectSkipped counts a migrated object of a resource type that has
+// not been written because it was already stored in the current storage
+// version.
+func (m *CoreMigratorMetrics) ObserveObjectSkipped(resource string) {
+	m.objectsSkipped.WithLabelValues(resource).Inc()
+}
+
+// ObserveObjectsFailed adds the number of objects of a resource type that failed to migrate.
+func (m *CoreMigratorMetrics) ObserveObjectsFailed(added int, resource string) {
+	m.objectsFailed.WithLabelValues(resource).Add(float64(added))
+}
+
 // ObserveSucceededMigration increments the number of successful migrations for a resource type..
 func (m *CoreMigratorMetrics) ObserveSucceededMigration(resource string) {
 	m.migration.WithLabelValues(resource, "Succeeded").Add(float64(1))
 }
 
+// ObserveSucceededWithErrorsMigration increments the number of migrations for a resource type that completed with tolerated failures.
+func (m *CoreMigratorMetrics) ObserveSucceededWithErrorsMigration(resource string) {
+	m.migration.WithLabelValues(resource, "SucceededWithErrors").Add(float64(1))
+}
+
 // ObserveFailedMigration increments the number of failed migrations for a resource type..
 func (m *CoreMigratorMetrics) ObserveFailedMigration(resource string) {
 	m.migration.WithLabelValues(resource, "Failed").Add(float64(1))
 }
+
+// ObserveThrottled adds the time a write to a resource type was delayed by the rate limiters.
+func (m *CoreMigratorMetrics) ObserveThrottled(delay time.Duration, resource string) {
+	m.throttled.WithLabelValues(resource).Add(delay.Seconds())
+}
+
+// ObserveBackpressure records the write rate and concurrency currently permitted by the adaptive backpressure.
+func (m *CoreMigratorMetrics) ObserveBackpressure(rate float64, window int) {
+	m.backpressureRate.Set(rate)
+	m.backpressureWindow.Set(float64(window))
+}
+
+// ObserveBackpressureSignal increments the number of apiserver congestion signals for a reason.
+func (m *CoreMigratorMetrics) ObserveBackpressureSignal(reason string) {
+	m.backpressureSignals.WithLabelValues(reason).Inc()
+}
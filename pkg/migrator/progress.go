@@ -17,35 +17,96 @@ limitations under the License.
 package migrator
 
 import (
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/typed/migration/v1alpha1"
 
 	"context"
+	"time"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
 )
 
-type progressInterface interface {
-	save(ctx context.Context, continueToken string) error
-	load(ctx context.Context) (continueToken string, err error)
+// ProgressStore persists the progress of a Migrator, so that a migration
+// that stops, e.g., because it is suspended or its process exits, resumes
+// where it stopped. A ProgressStore is used by a single Migrator at a time.
+type ProgressStore interface {
+	// Save records the continue token of the next chunk of objects to
+	// migrate.
+	Save(ctx context.Context, continueToken string) error
+	// Load returns the continue token last saved, or an empty token if
+	// the migration has not started, and the progress observed so far,
+	// which is nil if no chunk has been observed.
+	Load(ctx context.Context) (continueToken string, progress *migrationv1alpha1.MigrationProgress, err error)
+	// Observe adds the result of migrating a chunk of objects to the
+	// progress.
+	Observe(ctx context.Context, result ChunkResult) error
+	// Suspended returns true if the migration has been asked to pause,
+	// or is outside its maintenance windows.
+	Suspended(ctx context.Context) (bool, error)
+	// CompletedNamespaces returns the namespaces whose objects have all
+	// been migrated.
+	CompletedNamespaces(ctx context.Context) ([]string, error)
+	// CompleteNamespace records that the objects in the namespace have all
+	// been migrated.
+	CompleteNamespace(ctx context.Context, namespace string) error
+}
+
+// ChunkResult summarizes the migration of a chunk of objects.
+type ChunkResult struct {
+	// Migrated is the number of objects migrated.
+	Migrated int64
+	// Remaining is the estimated number of objects after the chunk. It is
+	// nil if the apiserver did not provide an estimate.
+	Remaining *int64
+	// Failures are the objects that failed to migrate.
+	Failures []migrationv1alpha1.FailedObject
 }
 
 type progressTracker struct {
 	client migrationclient.StorageVersionMigrationInterface
 	name   string
+	// defaultSchedule applies to a migration that does not set
+	// .spec.schedule.
+	defaultSchedule *migrationv1alpha1.MaintenanceSchedule
+	now             func() time.Time
+	// uid is the UID of the migration when the progress was loaded. The
+	// tracker does not update a migration that has been recreated since.
+	uid types.UID
 }
 
-// NewProgressTracker returns a progress tracker.
-func NewProgressTracker(client migrationclient.StorageVersionMigrationInterface, name string) progressInterface {
-	return &progressTracker{
+// ProgressOption configures a progress tracker.
+type ProgressOption func(*progressTracker)
+
+// WithDefaultSchedule pauses the migration outside the maintenance windows of
+// the schedule, unless the migration sets .spec.schedule.
+func WithDefaultSchedule(s *migrationv1alpha1.MaintenanceSchedule) ProgressOption {
+	return func(p *progressTracker) {
+		p.defaultSchedule = s
+	}
+}
+
+// NewProgressTracker returns a ProgressStore that records the progress in the
+// StorageVersionMigration named name: the continue token in .spec, and the
+// progress in .status.
+func NewProgressTracker(client migrationclient.StorageVersionMigrationInterface, name string, opts ...ProgressOption) ProgressStore {
+	p := &progressTracker{
 		client: client,
 		name:   name,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	return p
 }
 
-func (p *progressTracker) save(ctx context.Context, continueToken string) error {
+func (p *progressTracker) Save(ctx context.Context, continueToken string) error {
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		migration, err := p.client.Get(ctx, p.name, metav1.GetOptions{})
+		migration, err := p.get(ctx)
 		if err != nil {
 			return err
 		}
@@ -55,10 +116,123 @@ func (p *progressTracker) save(ctx context.Context, continueToken string) error
 	})
 }
 
-func (p *progressTracker) load(ctx context.Context) (continueToken string, err error) {
+func (p *progressTracker) Load(ctx context.Context) (string, *migrationv1alpha1.MigrationProgress, error) {
+	migration, err := p.client.Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+	p.uid = migration.UID
+	return migration.Spec.ContinueToken, migration.Status.Progress, nil
+}
+
+// get returns the migration. It returns a NotFound error if the migration
+// has been recreated since the progress was loaded.
+func (p *progressTracker) get(ctx context.Context) (*migrationv1alpha1.StorageVersionMigration, error) {
+	migration, err := p.client.Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if len(p.uid) != 0 && migration.UID != p.uid {
+		return nil, errors.NewNotFound(migrationv1alpha1.Resource("storageversionmigrations"), p.name)
+	}
+	return migration, nil
+}
+
+func (p *progressTracker) Observe(ctx context.Context, result ChunkResult) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		migration, err := p.get(ctx)
+		if err != nil {
+			return err
+		}
+		migration.Status.Progress = addProgress(migration.Status.Progress, result)
+		migration.Status.FailedObjects = addFailedObjects(migration.Status.FailedObjects, result)
+		_, err = p.client.UpdateStatus(ctx, migration, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// Suspended returns true if the migration is suspended, or if its maintenance
+// window is closed. A schedule that cannot be parsed, e.g., because it was
+// edited while the migration runs, stops the migration too; the controller
+// then fails the migration with the parse error.
+func (p *progressTracker) Suspended(ctx context.Context) (bool, error) {
+	migration, err := p.client.Get(ctx, p.name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	if migration.Spec.Suspend {
+		return true, nil
+	}
+	schedule := migration.Spec.Schedule
+	if schedule == nil {
+		schedule = p.defaultSchedule
+	}
+	s, err := NewSchedule(schedule)
+	if err != nil {
+		klog.Warningf("%s: stopping the migration, the schedule is invalid: %v", p.name, err)
+		return true, nil
+	}
+	return !s.Open(p.now()), nil
+}
+
+func (p *progressTracker) CompletedNamespaces(ctx context.Context) ([]string, error) {
 	migration, err := p.client.Get(ctx, p.name, metav1.GetOptions{})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if migration.Status.Scope == nil {
+		return nil, nil
+	}
+	return migration.Status.Scope.CompletedNamespaces, nil
+}
+
+func (p *progressTracker) CompleteNamespace(ctx context.Context, namespace string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		migration, err := p.get(ctx)
+		if err != nil {
+			return err
+		}
+		if migration.Status.Scope == nil {
+			migration.Status.Scope = &migrationv1alpha1.MigrationScope{}
+		}
+		migration.Status.Scope.CompletedNamespaces = append(migration.Status.Scope.CompletedNamespaces, namespace)
+		_, err = p.client.UpdateStatus(ctx, migration, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// addProgress returns the progress after the chunk of objects, given the
+// progress before, which may be nil.
+func addProgress(before *migrationv1alpha1.MigrationProgress, result ChunkResult) *migrationv1alpha1.MigrationProgress {
+	var progress migrationv1alpha1.MigrationProgress
+	if before != nil {
+		progress.Migrated = before.Migrated
+		progress.Failed = before.Failed
+	}
+	progress.Migrated += result.Migrated
+	progress.Failed += int64(len(result.Failures))
+	if result.Remaining != nil {
+		processed := progress.Migrated + progress.Failed
+		total := processed + *result.Remaining
+		percent := int32(100)
+		if total > 0 {
+			percent = int32(processed * 100 / total)
+		}
+		progress.Remaining = result.Remaining
+		progress.EstimatedTotal = &total
+		progress.Percent = &percent
+	}
+	return &progress
+}
+
+// addFailedObjects appends the objects that failed to migrate in the chunk
+// to failed, up to migrationv1alpha1.MaxFailedObjects.
+func addFailedObjects(failed []migrationv1alpha1.FailedObject, result ChunkResult) []migrationv1alpha1.FailedObject {
+	for _, f := range result.Failures {
+		if len(failed) >= migrationv1alpha1.MaxFailedObjects {
+			break
+		}
+		failed = append(failed, f)
 	}
-	return migration.Spec.ContinueToken, nil
+	return failed
 }
@@ -0,0 +1,229 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+// The keys of the ConfigMap a configMapProgressStore records the progress in.
+const (
+	ConfigMapContinueTokenKey       = "continueToken"
+	ConfigMapProgressKey            = "progress"
+	ConfigMapFailedObjectsKey       = "failedObjects"
+	ConfigMapCompletedNamespacesKey = "completedNamespaces"
+	// Setting ConfigMapSuspendKey to "true" suspends the migration.
+	ConfigMapSuspendKey = "suspend"
+	// ConfigMapResourceKey and ConfigMapScopeKey record the resource and
+	// the scope of the migration. The continue token and the completed
+	// namespaces are only valid for them.
+	ConfigMapResourceKey = "resource"
+	ConfigMapScopeKey    = "scope"
+)
+
+type configMapProgressStore struct {
+	client   corev1client.ConfigMapInterface
+	name     string
+	resource string
+	scope    Scope
+}
+
+// configMapScope is the JSON encoding of a Scope.
+type configMapScope struct {
+	Namespaces    []string `json:"namespaces,omitempty"`
+	LabelSelector string   `json:"labelSelector,omitempty"`
+	FieldSelector string   `json:"fieldSelector,omitempty"`
+}
+
+// NewConfigMapProgressStore returns a ProgressStore that records the progress
+// of the migration of resource in scope in the ConfigMap named name, which it
+// creates if needed, e.g., for migrations run by an operator without the
+// StorageVersionMigration API. The progress and the objects that failed to
+// migrate are encoded in JSON. Loading the progress fails if the ConfigMap
+// records the progress of another resource, or of another scope.
+func NewConfigMapProgressStore(client corev1client.ConfigMapInterface, name string, resource schema.GroupResource, scope Scope) ProgressStore {
+	return &configMapProgressStore{
+		client:   client,
+		name:     name,
+		resource: resource.String(),
+		scope:    scope,
+	}
+}
+
+// get returns the data of the ConfigMap, which is empty if the ConfigMap does
+// not exist.
+func (s *configMapProgressStore) get(ctx context.Context) (map[string]string, error) {
+	cm, err := s.client.Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// getRecorded returns the data of the ConfigMap, and an error if it records
+// the progress of another resource or scope.
+func (s *configMapProgressStore) getRecorded(ctx context.Context) (map[string]string, error) {
+	data, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if resource, ok := data[ConfigMapResourceKey]; ok && resource != s.resource {
+		return nil, fmt.Errorf("the ConfigMap %s records the migration of %s, not %s", s.name, resource, s.resource)
+	}
+	var recorded configMapScope
+	if err := unmarshalKey(data, ConfigMapScopeKey, &recorded); err != nil {
+		return nil, err
+	}
+	if _, ok := data[ConfigMapScopeKey]; ok && !sameScope(Scope(recorded), s.scope) {
+		return nil, fmt.Errorf("the ConfigMap %s records the migration of %s in %s, not in %s; delete it to start the migration over", s.name, s.resource, describeScope(Scope(recorded)), describeScope(s.scope))
+	}
+	return data, nil
+}
+
+// update applies f to the data of the ConfigMap, and creates the ConfigMap if
+// it does not exist.
+func (s *configMapProgressStore) update(ctx context.Context, f func(data map[string]string) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.client.Get(ctx, s.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: s.name}}
+			if err := s.applyToData(cm, f); err != nil {
+				return err
+			}
+			_, err = s.client.Create(ctx, cm, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				// Retry as an update.
+				return errors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.applyToData(cm, f); err != nil {
+			return err
+		}
+		_, err = s.client.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (s *configMapProgressStore) applyToData(cm *corev1.ConfigMap, f func(data map[string]string) error) error {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[ConfigMapResourceKey] = s.resource
+	if err := marshalKey(cm.Data, ConfigMapScopeKey, configMapScope(s.scope)); err != nil {
+		return err
+	}
+	return f(cm.Data)
+}
+
+func (s *configMapProgressStore) Save(ctx context.Context, continueToken string) error {
+	return s.update(ctx, func(data map[string]string) error {
+		data[ConfigMapContinueTokenKey] = continueToken
+		return nil
+	})
+}
+
+func (s *configMapProgressStore) Load(ctx context.Context) (string, *migrationv1alpha1.MigrationProgress, error) {
+	data, err := s.getRecorded(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	var progress *migrationv1alpha1.MigrationProgress
+	if err := unmarshalKey(data, ConfigMapProgressKey, &progress); err != nil {
+		return "", nil, err
+	}
+	return data[ConfigMapContinueTokenKey], progress, nil
+}
+
+func (s *configMapProgressStore) Observe(ctx context.Context, result ChunkResult) error {
+	return s.update(ctx, func(data map[string]string) error {
+		var progress *migrationv1alpha1.MigrationProgress
+		if err := unmarshalKey(data, ConfigMapProgressKey, &progress); err != nil {
+			return err
+		}
+		var failed []migrationv1alpha1.FailedObject
+		if err := unmarshalKey(data, ConfigMapFailedObjectsKey, &failed); err != nil {
+			return err
+		}
+		if err := marshalKey(data, ConfigMapProgressKey, addProgress(progress, result)); err != nil {
+			return err
+		}
+		return marshalKey(data, ConfigMapFailedObjectsKey, addFailedObjects(failed, result))
+	})
+}
+
+func (s *configMapProgressStore) Suspended(ctx context.Context) (bool, error) {
+	data, err := s.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	return data[ConfigMapSuspendKey] == "true", nil
+}
+
+func (s *configMapProgressStore) CompletedNamespaces(ctx context.Context) ([]string, error) {
+	data, err := s.getRecorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var completed []string
+	err = unmarshalKey(data, ConfigMapCompletedNamespacesKey, &completed)
+	return completed, err
+}
+
+func (s *configMapProgressStore) CompleteNamespace(ctx context.Context, namespace string) error {
+	return s.update(ctx, func(data map[string]string) error {
+		var completed []string
+		if err := unmarshalKey(data, ConfigMapCompletedNamespacesKey, &completed); err != nil {
+			return err
+		}
+		return marshalKey(data, ConfigMapCompletedNamespacesKey, append(completed, namespace))
+	})
+}
+
+func unmarshalKey(data map[string]string, key string, v interface{}) error {
+	value, ok := data[key]
+	if !ok || len(value) == 0 {
+		return nil
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+func marshalKey(data map[string]string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	data[key] = string(value)
+	return nil
+}
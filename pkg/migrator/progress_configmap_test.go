@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+func TestConfigMapProgressStore(t *testing.T) {
+	ctx := context.TODO()
+	client := kubefake.NewSimpleClientset()
+	configMaps := client.CoreV1().ConfigMaps("default")
+	store := NewConfigMapProgressStore(configMaps, "progress", schema.GroupResource{Resource: "pods"}, Scope{})
+
+	// The ConfigMap does not exist yet.
+	if token, _, err := store.Load(ctx); err != nil || token != "" {
+		t.Fatalf("expected an empty continue token, got %q, %v", token, err)
+	}
+	if err := store.Save(ctx, "next"); err != nil {
+		t.Fatal(err)
+	}
+	if token, _, err := store.Load(ctx); err != nil || token != "next" {
+		t.Errorf("expected the continue token to be saved, got %q, %v", token, err)
+	}
+
+	failed := migrationv1alpha1.FailedObject{Name: "a", Reason: "Forbidden"}
+	if err := store.Observe(ctx, ChunkResult{Migrated: 4, Failures: []migrationv1alpha1.FailedObject{failed}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Observe(ctx, ChunkResult{Migrated: 5}); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := configMaps.Get(ctx, "progress", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var progress migrationv1alpha1.MigrationProgress
+	if err := unmarshalKey(cm.Data, ConfigMapProgressKey, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Migrated != 9 || progress.Failed != 1 {
+		t.Errorf("expected 9 migrated and 1 failed objects, got %+v", progress)
+	}
+	var failures []migrationv1alpha1.FailedObject
+	if err := unmarshalKey(cm.Data, ConfigMapFailedObjectsKey, &failures); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failures, []migrationv1alpha1.FailedObject{failed}) {
+		t.Errorf("expected the failed object to be recorded, got %v", failures)
+	}
+
+	for _, namespace := range []string{"a", "b"} {
+		if err := store.CompleteNamespace(ctx, namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if completed, err := store.CompletedNamespaces(ctx); err != nil || !reflect.DeepEqual(completed, []string{"a", "b"}) {
+		t.Errorf("expected namespaces a and b to be completed, got %v, %v", completed, err)
+	}
+
+	if suspended, err := store.Suspended(ctx); err != nil || suspended {
+		t.Errorf("expected the migration not to be suspended, got %v, %v", suspended, err)
+	}
+	cm.Data[ConfigMapSuspendKey] = "true"
+	if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if suspended, err := store.Suspended(ctx); err != nil || !suspended {
+		t.Errorf("expected the migration to be suspended, got %v, %v", suspended, err)
+	}
+}
+
+func TestConfigMapProgressStoreMismatch(t *testing.T) {
+	ctx := context.TODO()
+	client := kubefake.NewSimpleClientset()
+	configMaps := client.CoreV1().ConfigMaps("default")
+	pods := schema.GroupResource{Resource: "pods"}
+	scope := Scope{Namespaces: []string{"a", "b"}, LabelSelector: "app=web"}
+	if err := NewConfigMapProgressStore(configMaps, "progress", pods, scope).Save(ctx, "next"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		resource schema.GroupResource
+		scope    Scope
+		wantErr  bool
+	}{
+		{name: "same resource and scope", resource: pods, scope: scope},
+		{name: "another resource", resource: schema.GroupResource{Group: "apps", Resource: "deployments"}, scope: scope, wantErr: true},
+		{name: "other namespaces", resource: pods, scope: Scope{Namespaces: []string{"a"}, LabelSelector: "app=web"}, wantErr: true},
+		{name: "another selector", resource: pods, scope: Scope{Namespaces: []string{"a", "b"}}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewConfigMapProgressStore(configMaps, "progress", tc.resource, tc.scope)
+			token, _, err := store.Load(ctx)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !tc.wantErr && token != "next" {
+				t.Errorf("expected to resume from the saved continue token, got %q", token)
+			}
+			if _, err := store.CompletedNamespaces(ctx); (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+// checkpoint is the content of the file of a FileProgressStore.
+type checkpoint struct {
+	Resource string `json:"resource"`
+	// Namespaces, LabelSelector and FieldSelector are the scope of the
+	// migration. The continue token and the completed namespaces are only
+	// valid in that scope.
+	Namespaces          []string                             `json:"namespaces,omitempty"`
+	LabelSelector       string                               `json:"labelSelector,omitempty"`
+	FieldSelector       string                               `json:"fieldSelector,omitempty"`
+	ContinueToken       string                               `json:"continueToken,omitempty"`
+	Progress            *migrationv1alpha1.MigrationProgress `json:"progress,omitempty"`
+	FailedObjects       []migrationv1alpha1.FailedObject     `json:"failedObjects,omitempty"`
+	CompletedNamespaces []string                             `json:"completedNamespaces,omitempty"`
+}
+
+// FileProgressStore is a MemoryProgressStore that also writes the progress to
+// a local file every time it changes, so that a migration run from the
+// command line can be resumed after it was interrupted.
+type FileProgressStore struct {
+	*MemoryProgressStore
+	// mu orders the writes to the file.
+	mu       sync.Mutex
+	path     string
+	resource string
+	scope    Scope
+}
+
+// NewFileProgressStore returns a FileProgressStore that records the progress
+// of the migration of resource in scope in the file at path. If the file
+// exists, the store resumes from the progress it records, and it returns an
+// error if the file records the progress of another resource, or of another
+// scope.
+func NewFileProgressStore(path string, resource schema.GroupResource, scope Scope) (*FileProgressStore, error) {
+	s := &FileProgressStore{
+		MemoryProgressStore: NewMemoryProgressStore(),
+		path:                path,
+		resource:            resource.String(),
+		scope:               scope,
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode the checkpoint %s: %v", path, err)
+	}
+	if c.Resource != s.resource {
+		return nil, fmt.Errorf("the checkpoint %s records the migration of %s, not %s", path, c.Resource, s.resource)
+	}
+	recorded := Scope{Namespaces: c.Namespaces, LabelSelector: c.LabelSelector, FieldSelector: c.FieldSelector}
+	if !sameScope(recorded, scope) {
+		return nil, fmt.Errorf("the checkpoint %s records the migration of %s in %s, not in %s; remove it to start the migration over", path, c.Resource, describeScope(recorded), describeScope(scope))
+	}
+	s.continueToken = c.ContinueToken
+	s.progress = c.Progress
+	s.failedObjects = c.FailedObjects
+	s.completedNamespaces = c.CompletedNamespaces
+	return s, nil
+}
+
+func (s *FileProgressStore) Save(ctx context.Context, continueToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.MemoryProgressStore.Save(ctx, continueToken); err != nil {
+		return err
+	}
+	return s.write()
+}
+
+func (s *FileProgressStore) Observe(ctx context.Context, result ChunkResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.MemoryProgressStore.Observe(ctx, result); err != nil {
+		return err
+	}
+	return s.write()
+}
+
+func (s *FileProgressStore) CompleteNamespace(ctx context.Context, namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.MemoryProgressStore.CompleteNamespace(ctx, namespace); err != nil {
+		return err
+	}
+	return s.write()
+}
+
+// write replaces the file with the current progress. The file is written
+// next to it first, and renamed, so that it is never left half written.
+func (s *FileProgressStore) write() error {
+	s.MemoryProgressStore.mu.Lock()
+	c := checkpoint{
+		Resource:            s.resource,
+		Namespaces:          s.scope.Namespaces,
+		LabelSelector:       s.scope.LabelSelector,
+		FieldSelector:       s.scope.FieldSelector,
+		ContinueToken:       s.continueToken,
+		Progress:            s.progress,
+		FailedObjects:       s.failedObjects,
+		CompletedNamespaces: s.completedNamespaces,
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	s.MemoryProgressStore.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// sameScope returns true if the scopes select the same objects, in the same
+// order.
+func sameScope(a, b Scope) bool {
+	if len(a.Namespaces) != len(b.Namespaces) {
+		return false
+	}
+	for i := range a.Namespaces {
+		if a.Namespaces[i] != b.Namespaces[i] {
+			return false
+		}
+	}
+	return a.LabelSelector == b.LabelSelector && a.FieldSelector == b.FieldSelector
+}
+
+// describeScope describes the scope for an error message.
+func describeScope(s Scope) string {
+	namespaces := "all namespaces"
+	if len(s.Namespaces) != 0 {
+		namespaces = "namespaces " + strings.Join(s.Namespaces, ",")
+	}
+	return fmt.Sprintf("%s with label selector %q and field selector %q", namespaces, s.LabelSelector, s.FieldSelector)
+}
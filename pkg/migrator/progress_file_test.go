@@ -0,0 +1,83 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+func TestFileProgressStore(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	pods := schema.GroupResource{Resource: "pods"}
+	scope := Scope{Namespaces: []string{"a", "b"}, LabelSelector: "app=web"}
+	store, err := NewFileProgressStore(path, pods, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := migrationv1alpha1.FailedObject{Namespace: "a", Name: "b", Reason: "Forbidden"}
+	if err := store.Observe(ctx, ChunkResult{Migrated: 4, Failures: []migrationv1alpha1.FailedObject{failed}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "next"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CompleteNamespace(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new store resumes from the file.
+	resumed, err := NewFileProgressStore(path, pods, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, _, _ := resumed.Load(ctx); token != "next" {
+		t.Errorf("expected the continue token to be resumed, got %q", token)
+	}
+	if completed, _ := resumed.CompletedNamespaces(ctx); !reflect.DeepEqual(completed, []string{"a"}) {
+		t.Errorf("expected namespace a to be completed, got %v", completed)
+	}
+	progress, failures := resumed.Progress()
+	if progress.Migrated != 4 || progress.Failed != 1 || !reflect.DeepEqual(failures, []migrationv1alpha1.FailedObject{failed}) {
+		t.Errorf("expected the progress to be resumed, got %+v and failed objects %v", progress, failures)
+	}
+
+	_, err = NewFileProgressStore(path, schema.GroupResource{Group: "apps", Resource: "deployments"}, scope)
+	if err == nil || !strings.Contains(err.Error(), "not deployments.apps") {
+		t.Errorf("expected the checkpoint of another resource to be rejected, got %v", err)
+	}
+
+	for _, other := range []Scope{
+		{LabelSelector: "app=web"},
+		{Namespaces: []string{"b", "a"}, LabelSelector: "app=web"},
+		{Namespaces: []string{"a", "b"}},
+		{Namespaces: []string{"a", "b"}, LabelSelector: "app=web", FieldSelector: "metadata.name=x"},
+	} {
+		_, err = NewFileProgressStore(path, pods, other)
+		if err == nil || !strings.Contains(err.Error(), "remove it to start the migration over") {
+			t.Errorf("%+v: expected the checkpoint of another scope to be rejected, got %v", other, err)
+		}
+	}
+}
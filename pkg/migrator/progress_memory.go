@@ -0,0 +1,102 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"sync"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+// MemoryProgressStore is a ProgressStore that keeps the progress in memory,
+// for migrations that do not need to survive their process. It is safe for
+// concurrent use, e.g., to report the progress while the migration runs.
+type MemoryProgressStore struct {
+	mu                  sync.Mutex
+	continueToken       string
+	progress            *migrationv1alpha1.MigrationProgress
+	failedObjects       []migrationv1alpha1.FailedObject
+	completedNamespaces []string
+	suspended           bool
+}
+
+// NewMemoryProgressStore returns an empty MemoryProgressStore.
+func NewMemoryProgressStore() *MemoryProgressStore {
+	return &MemoryProgressStore{}
+}
+
+func (s *MemoryProgressStore) Save(_ context.Context, continueToken string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.continueToken = continueToken
+	return nil
+}
+
+func (s *MemoryProgressStore) Load(context.Context) (string, *migrationv1alpha1.MigrationProgress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.continueToken, s.progress.DeepCopy(), nil
+}
+
+func (s *MemoryProgressStore) Observe(_ context.Context, result ChunkResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = addProgress(s.progress, result)
+	s.failedObjects = addFailedObjects(s.failedObjects, result)
+	return nil
+}
+
+func (s *MemoryProgressStore) Suspended(context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.suspended, nil
+}
+
+func (s *MemoryProgressStore) CompletedNamespaces(context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.completedNamespaces...), nil
+}
+
+func (s *MemoryProgressStore) CompleteNamespace(_ context.Context, namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completedNamespaces = append(s.completedNamespaces, namespace)
+	return nil
+}
+
+// Suspend pauses the migration after the chunk it is migrating, if suspend
+// is true. Run then returns ErrSuspended, and the next Run resumes the
+// migration.
+func (s *MemoryProgressStore) Suspend(suspend bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suspended = suspend
+}
+
+// Progress returns the progress of the migration, and the objects that
+// failed to migrate.
+func (s *MemoryProgressStore) Progress() (migrationv1alpha1.MigrationProgress, []migrationv1alpha1.FailedObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var progress migrationv1alpha1.MigrationProgress
+	if s.progress != nil {
+		progress = *s.progress.DeepCopy()
+	}
+	return progress, append([]migrationv1alpha1.FailedObject(nil), s.failedObjects...)
+}
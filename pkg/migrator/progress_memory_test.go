@@ -0,0 +1,88 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	clitesting "k8s.io/client-go/testing"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
+)
+
+func TestMemoryProgressStore(t *testing.T) {
+	nodeList := newNodeList(10)
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	store := NewMemoryProgressStore()
+	lists := 0
+	client.Fake.PrependReactor("list", "nodes", func(a clitesting.Action) (bool, runtime.Object, error) {
+		lists++
+		chunk := newNodeList(5)
+		if lists == 1 {
+			chunk.Continue = "next"
+			// The migration is paused after the first chunk.
+			store.Suspend(true)
+		}
+		return true, toUnstructuredListOrDie(chunk), nil
+	})
+
+	registry := prometheus.NewRegistry()
+	m := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, store,
+		WithChunkSize(5),
+		WithMetrics(metrics.NewCoreMigratorMetrics(registry)),
+	)
+	if err := m.Run(context.TODO()); err != ErrSuspended {
+		t.Fatalf("expected ErrSuspended, got %v", err)
+	}
+	if token, _, _ := store.Load(context.TODO()); token != "next" {
+		t.Errorf("expected the continue token to be saved, got %q", token)
+	}
+	store.Suspend(false)
+	if err := m.Run(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if lists != 2 {
+		t.Errorf("expected the second Run to resume with the second chunk, got %d lists", lists)
+	}
+	progress, failed := store.Progress()
+	if progress.Migrated != 10 || len(failed) != 0 {
+		t.Errorf("expected 10 migrated objects, got %+v and failed objects %v", progress, failed)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := 0.0
+	for _, mf := range families {
+		if mf.GetName() != "storage_migrator_core_migrator_migrated_objects" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			migrated += metric.GetCounter().GetValue()
+		}
+	}
+	if migrated != 10 {
+		t.Errorf("expected the dedicated registry to count 10 migrated objects, got %v", migrated)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+)
+
+func TestProgressTrackerObserve(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(&migrationv1alpha1.StorageVersionMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "m"},
+		Status: migrationv1alpha1.StorageVersionMigrationStatus{
+			Progress: &migrationv1alpha1.MigrationProgress{Migrated: 10},
+		},
+	})
+	migrations := client.MigrationV1alpha1().StorageVersionMigrations()
+	p := NewProgressTracker(migrations, "m")
+
+	remaining := int64(5)
+	if err := p.Observe(ctx, ChunkResult{Migrated: 5, Remaining: &remaining}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := migrations.Get(ctx, "m", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := m.Status.Progress
+	if progress.Migrated != 15 || *progress.Remaining != 5 || *progress.EstimatedTotal != 20 || *progress.Percent != 75 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	// Without an estimate from the apiserver only the migrated count is
+	// known.
+	if err := p.Observe(ctx, ChunkResult{Migrated: 5}); err != nil {
+		t.Fatal(err)
+	}
+	m, err = migrations.Get(ctx, "m", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress = m.Status.Progress
+	if progress.Migrated != 20 || progress.Remaining != nil || progress.EstimatedTotal != nil || progress.Percent != nil {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+}
+
+func TestProgressTrackerCompleteNamespace(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(&migrationv1alpha1.StorageVersionMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "m"},
+	})
+	p := NewProgressTracker(client.MigrationV1alpha1().StorageVersionMigrations(), "m")
+
+	for _, namespace := range []string{"a", "b"} {
+		if err := p.CompleteNamespace(ctx, namespace); err != nil {
+			t.Fatal(err)
+		}
+	}
+	completed, err := p.CompletedNamespaces(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(completed) != 2 || completed[0] != "a" || completed[1] != "b" {
+		t.Errorf("expected namespaces a and b to be completed, got %v", completed)
+	}
+}
+
+func TestProgressTrackerSuspended(t *testing.T) {
+	ctx := context.TODO()
+	// Sundays from 12:00 to 14:00 UTC.
+	sundays := &migrationv1alpha1.MaintenanceSchedule{
+		Windows: []migrationv1alpha1.MaintenanceWindow{
+			{Start: "0 12 * * 0", Duration: metav1.Duration{Duration: 2 * time.Hour}},
+		},
+	}
+	always := &migrationv1alpha1.MaintenanceSchedule{
+		Windows: []migrationv1alpha1.MaintenanceWindow{
+			{Start: "0 * * * *", Duration: metav1.Duration{Duration: time.Hour}},
+		},
+	}
+	invalid := &migrationv1alpha1.MaintenanceSchedule{
+		Windows: []migrationv1alpha1.MaintenanceWindow{
+			{Start: "not a cron expression", Duration: metav1.Duration{Duration: time.Hour}},
+		},
+	}
+	// 2019-07-01 is a Monday.
+	monday := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	sunday := time.Date(2019, 7, 7, 13, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name            string
+		spec            migrationv1alpha1.StorageVersionMigrationSpec
+		defaultSchedule *migrationv1alpha1.MaintenanceSchedule
+		now             time.Time
+		expected        bool
+	}{
+		{name: "no schedule", now: monday, expected: false},
+		{name: "suspended", spec: migrationv1alpha1.StorageVersionMigrationSpec{Suspend: true}, now: sunday, expected: true},
+		{name: "default schedule closed", defaultSchedule: sundays, now: monday, expected: true},
+		{name: "default schedule open", defaultSchedule: sundays, now: sunday, expected: false},
+		{name: "spec schedule closed", spec: migrationv1alpha1.StorageVersionMigrationSpec{Schedule: sundays}, now: monday, expected: true},
+		{name: "spec schedule overrides the default", spec: migrationv1alpha1.StorageVersionMigrationSpec{Schedule: always}, defaultSchedule: sundays, now: monday, expected: false},
+		{name: "invalid spec schedule", spec: migrationv1alpha1.StorageVersionMigrationSpec{Schedule: invalid}, now: sunday, expected: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(&migrationv1alpha1.StorageVersionMigration{
+				ObjectMeta: metav1.ObjectMeta{Name: "m"},
+				Spec:       tc.spec,
+			})
+			p := NewProgressTracker(client.MigrationV1alpha1().StorageVersionMigrations(), "m", WithDefaultSchedule(tc.defaultSchedule)).(*progressTracker)
+			p.now = func() time.Time { return tc.now }
+			suspended, err := p.Suspended(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if suspended != tc.expected {
+				t.Errorf("expected suspended to be %v, got %v", tc.expected, suspended)
+			}
+		})
+	}
+}
+
+func TestProgressTrackerRecreated(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(&migrationv1alpha1.StorageVersionMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "m", UID: "1"},
+	})
+	migrations := client.MigrationV1alpha1().StorageVersionMigrations()
+	p := NewProgressTracker(migrations, "m")
+	if _, _, err := p.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations.Delete(ctx, "m", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrations.Create(ctx, &migrationv1alpha1.StorageVersionMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: "m", UID: "2"},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Save(ctx, "stale"); !errors.IsNotFound(err) {
+		t.Errorf("expected NotFound, got %v", err)
+	}
+	m, err := migrations.Get(ctx, "m", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Spec.ContinueToken) != 0 {
+		t.Errorf("expected the recreated migration to be left alone, got continue token %q", m.Spec.ContinueToken)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter throttles the writes of migrators, both by the number of
+// objects and by the serialized size of the objects. A RateLimiter can be
+// shared by several migrators to enforce a combined limit.
+type RateLimiter struct {
+	objects *rate.Limiter
+	bytes   *rate.Limiter
+}
+
+// NewRateLimiter returns a token bucket RateLimiter. Non-positive values
+// disable the corresponding limit. It returns nil if both limits are disabled.
+func NewRateLimiter(objectsPerSecond, bytesPerSecond float64) *RateLimiter {
+	if objectsPerSecond <= 0 && bytesPerSecond <= 0 {
+		return nil
+	}
+	l := &RateLimiter{}
+	if objectsPerSecond > 0 {
+		l.objects = rate.NewLimiter(rate.Limit(objectsPerSecond), burst(objectsPerSecond))
+	}
+	if bytesPerSecond > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(bytesPerSecond), burst(bytesPerSecond))
+	}
+	return l
+}
+
+// burst allows up to one second worth of tokens to be spent at once.
+func burst(perSecond float64) int {
+	if perSecond >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(math.Max(1, math.Ceil(perSecond)))
+}
+
+// limitsBytes returns true if the limiter needs the size of the objects.
+func (l *RateLimiter) limitsBytes() bool {
+	return l != nil && l.bytes != nil
+}
+
+// Wait blocks until the limiter permits writing one object of the given
+// size, or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context, size int) error {
+	_, err := l.wait(ctx, size)
+	return err
+}
+
+// wait is Wait, and also returns true if the write was delayed.
+func (l *RateLimiter) wait(ctx context.Context, size int) (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+	delayed := false
+	if l.objects != nil {
+		d, err := waitN(ctx, l.objects, 1)
+		if err != nil {
+			return delayed, err
+		}
+		delayed = delayed || d
+	}
+	if l.bytes == nil {
+		return delayed, nil
+	}
+	// WaitN refuses requests larger than the burst, so objects larger
+	// than the burst are paid for in installments.
+	for size > 0 {
+		n := size
+		if b := l.bytes.Burst(); n > b {
+			n = b
+		}
+		d, err := waitN(ctx, l.bytes, n)
+		if err != nil {
+			return delayed, err
+		}
+		delayed = delayed || d
+		size -= n
+	}
+	return delayed, nil
+}
+
+// waitN takes n tokens from the limiter, and returns true if it had to wait
+// for them.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) (bool, error) {
+	if limiter.AllowN(time.Now(), n) {
+		return false, nil
+	}
+	return true, limiter.WaitN(ctx, n)
+}
+
+// ConcurrencyLimit bounds the number of objects several migrators migrate
+// concurrently. A ConcurrencyLimit shared by all migrators enforces a ceiling
+// on their combined concurrency, whatever the concurrency of each migrator.
+type ConcurrencyLimit struct {
+	slots chan struct{}
+}
+
+// NewConcurrencyLimit returns a ConcurrencyLimit that permits max objects to
+// be migrated concurrently. It returns nil if max is not positive.
+func NewConcurrencyLimit(max int) *ConcurrencyLimit {
+	if max <= 0 {
+		return nil
+	}
+	return &ConcurrencyLimit{slots: make(chan struct{}, max)}
+}
+
+// acquire blocks until an object can be migrated, or the context is done. The
+// returned function must be called once the object is migrated. It is safe to
+// call acquire on a nil ConcurrencyLimit.
+func (l *ConcurrencyLimit) acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
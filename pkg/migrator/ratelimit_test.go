@@ -0,0 +1,67 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	l := NewRateLimiter(0, 0)
+	if l != nil {
+		t.Fatalf("expected a nil limiter, got %#v", l)
+	}
+	// A nil limiter never blocks.
+	if err := l.Wait(context.TODO(), 1<<30); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	l := NewRateLimiter(0, 1000)
+	if !l.limitsBytes() {
+		t.Fatalf("expected the limiter to limit bytes")
+	}
+	// The first 1000 bytes are the burst, the remaining 100 bytes take
+	// about 100ms.
+	start := time.Now()
+	delayed, err := l.wait(context.TODO(), 1100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || !delayed {
+		t.Errorf("expected the write of an object larger than the burst to be delayed, waited %v", elapsed)
+	}
+}
+
+func TestRateLimiterObjectsCancelled(t *testing.T) {
+	l := NewRateLimiter(0.001, 0)
+	if l.limitsBytes() {
+		t.Fatalf("expected the limiter to not limit bytes")
+	}
+	ctx, cancel := context.WithCancel(context.TODO())
+	// The first object is the burst.
+	if delayed, err := l.wait(ctx, 0); err != nil || delayed {
+		t.Fatalf("expected the first object to be permitted right away, got %v, %v", delayed, err)
+	}
+	cancel()
+	if err := l.Wait(ctx, 0); err == nil {
+		t.Errorf("expected an error once the context is cancelled")
+	}
+}
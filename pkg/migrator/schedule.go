@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+// Schedule tells whether migrations may run at a given time. A nil Schedule
+// is always open.
+type Schedule struct {
+	windows  []scheduleWindow
+	location *time.Location
+}
+
+type scheduleWindow struct {
+	start    cron.Schedule
+	duration time.Duration
+}
+
+// NewSchedule parses a maintenance schedule. It returns nil if s is nil.
+func NewSchedule(s *migrationv1alpha1.MaintenanceSchedule) (*Schedule, error) {
+	if s == nil {
+		return nil, nil
+	}
+	if len(s.Windows) == 0 {
+		return nil, fmt.Errorf("the maintenance schedule has no windows")
+	}
+	location := time.UTC
+	if len(s.TimeZone) > 0 {
+		var err error
+		location, err = time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone of the maintenance schedule: %v", err)
+		}
+	}
+	schedule := &Schedule{location: location}
+	for _, w := range s.Windows {
+		start, err := cron.ParseStandard(w.Start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start %q of a maintenance window: %v", w.Start, err)
+		}
+		if start.Next(time.Now().In(location)).IsZero() {
+			return nil, fmt.Errorf("the maintenance window starting at %q never opens", w.Start)
+		}
+		if w.Duration.Duration <= 0 {
+			return nil, fmt.Errorf("the maintenance window starting at %q must have a positive duration", w.Start)
+		}
+		schedule.windows = append(schedule.windows, scheduleWindow{start: start, duration: w.Duration.Duration})
+	}
+	return schedule, nil
+}
+
+// Open returns true if a window is open at t.
+func (s *Schedule) Open(t time.Time) bool {
+	return !s.NextOpen(t).After(t)
+}
+
+// NextOpen returns t if a window is open at t, and the time the next window
+// opens otherwise.
+func (s *Schedule) NextOpen(t time.Time) time.Time {
+	if s == nil {
+		return t
+	}
+	t = t.In(s.location)
+	var next time.Time
+	for _, w := range s.windows {
+		// The first window that opens after t - duration is still open
+		// at t if it has opened by then.
+		start := w.start.Next(t.Add(-w.duration))
+		if start.IsZero() {
+			continue
+		}
+		if !start.After(t) {
+			return t
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
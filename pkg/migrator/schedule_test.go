@@ -0,0 +1,96 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+)
+
+func TestSchedule(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("the time zone database is not available: %v", err)
+	}
+	s, err := NewSchedule(&migrationv1alpha1.MaintenanceSchedule{
+		Windows: []migrationv1alpha1.MaintenanceWindow{
+			// Weeknights from 22:00 to 06:00.
+			{Start: "0 22 * * 1-5", Duration: metav1.Duration{Duration: 8 * time.Hour}},
+			// Sundays from 12:00 to 14:00.
+			{Start: "0 12 * * 0", Duration: metav1.Duration{Duration: 2 * time.Hour}},
+		},
+		TimeZone: "Europe/Paris",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time {
+		// 2019-07-01 is a Monday.
+		return time.Date(2019, 7, day, hour, minute, 0, 0, paris)
+	}
+	for _, tc := range []struct {
+		name     string
+		t        time.Time
+		expected time.Time
+	}{
+		{name: "monday noon", t: at(1, 12, 0), expected: at(1, 22, 0)},
+		{name: "monday night", t: at(1, 23, 0), expected: at(1, 23, 0)},
+		{name: "tuesday early morning", t: at(2, 5, 59), expected: at(2, 5, 59)},
+		{name: "window closes", t: at(2, 6, 0), expected: at(2, 22, 0)},
+		{name: "saturday", t: at(6, 3, 0), expected: at(6, 3, 0)},
+		{name: "saturday noon", t: at(6, 12, 0), expected: at(7, 12, 0)},
+		{name: "sunday", t: at(7, 13, 0), expected: at(7, 13, 0)},
+		{name: "sunday evening", t: at(7, 18, 0), expected: at(8, 22, 0)},
+		{name: "other time zone", t: at(1, 20, 30).UTC(), expected: at(1, 22, 0)},
+	} {
+		next := s.NextOpen(tc.t)
+		if !next.Equal(tc.expected) {
+			t.Errorf("%s: expected the next window to open at %v, got %v", tc.name, tc.expected, next)
+		}
+		if e, a := next.Equal(tc.t), s.Open(tc.t); e != a {
+			t.Errorf("%s: expected open %v, got %v", tc.name, e, a)
+		}
+	}
+}
+
+func TestNilSchedule(t *testing.T) {
+	s, err := NewSchedule(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Open(time.Now()) {
+		t.Errorf("expected a nil schedule to be open")
+	}
+}
+
+func TestInvalidSchedule(t *testing.T) {
+	for name, s := range map[string]*migrationv1alpha1.MaintenanceSchedule{
+		"no windows":   {},
+		"bad cron":     {Windows: []migrationv1alpha1.MaintenanceWindow{{Start: "at night", Duration: metav1.Duration{Duration: time.Hour}}}},
+		"no duration":  {Windows: []migrationv1alpha1.MaintenanceWindow{{Start: "0 22 * * *"}}},
+		"never opens":  {Windows: []migrationv1alpha1.MaintenanceWindow{{Start: "0 22 30 2 *", Duration: metav1.Duration{Duration: time.Hour}}}},
+		"bad timezone": {Windows: []migrationv1alpha1.MaintenanceWindow{{Start: "0 22 * * *", Duration: metav1.Duration{Duration: time.Hour}}}, TimeZone: "Mars/Olympus"},
+	} {
+		if _, err := NewSchedule(s); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
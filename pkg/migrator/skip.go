@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Checker decides whether an object has to be written to be stored in the
+// current storage version. A Checker may only tell an object does not need to
+// be written if it knows for sure, because a skipped object that is still
+// encoded in an old storage version makes it unsafe to upgrade.
+type Checker interface {
+	// NeedsMigration returns false if obj is known to be stored in the
+	// current storage version.
+	NeedsMigration(obj *unstructured.Unstructured) bool
+}
+
+// NewAnnotationChecker returns a Checker that skips the objects whose
+// annotation key is set to value, e.g., by a mutating webhook that records
+// the storage version objects are written in.
+func NewAnnotationChecker(key, value string) Checker {
+	return annotationChecker{key: key, value: value}
+}
+
+type annotationChecker struct {
+	key   string
+	value string
+}
+
+func (c annotationChecker) NeedsMigration(obj *unstructured.Unstructured) bool {
+	value, ok := obj.GetAnnotations()[c.key]
+	return !ok || value != c.value
+}
+
+// NewManagedFieldsChecker returns a Checker that skips the objects that have
+// been written after the given time, by a manager using the version whose
+// storage version hash is storageVersionHash.
+//
+// This is unsafe unless all the apiservers stored the resource in that storage
+// version at the given time. The managed fields record the version of the
+// request, not the storage version the object was encoded in, which is the one
+// of the apiserver that served the write. An object written during a rolling
+// upgrade of the apiservers, or before they switched storage versions, might
+// still be encoded in an old storage version. It is only used by migrations
+// that opt in.
+//
+// The time a manager wrote an object is only updated when the manager changes
+// a field, so objects written without changes are not skipped, even though
+// they are stored in the current storage version.
+func NewManagedFieldsChecker(storageVersionHash string, since time.Time) Checker {
+	return managedFieldsChecker{storageVersionHash: storageVersionHash, since: since}
+}
+
+type managedFieldsChecker struct {
+	storageVersionHash string
+	since              time.Time
+}
+
+func (c managedFieldsChecker) NeedsMigration(obj *unstructured.Unstructured) bool {
+	kind := obj.GetKind()
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Time == nil || !entry.Time.After(c.since) {
+			continue
+		}
+		gv, err := schema.ParseGroupVersion(entry.APIVersion)
+		if err != nil {
+			continue
+		}
+		if StorageVersionHash(gv.Group, gv.Version, kind) == c.storageVersionHash {
+			return false
+		}
+	}
+	return true
+}
+
+// StorageVersionHash computes the storage version hash the apiserver
+// publishes in the discovery document for a storage version.
+func StorageVersionHash(group, version, kind string) string {
+	gvk := group + "/" + version + "/" + kind
+	bytes := sha256.Sum256([]byte(gvk))
+	// Assuming there are N kinds in the cluster, and the hash is X-byte long,
+	// the chance of colliding hash P(N,X) approximates to 1-e^(-(N^2)/2^(8X+1)).
+	// P(10,000, 8) ~= 2.7*10^(-12), which is low enough.
+	// See https://en.wikipedia.org/wiki/Birthday_problem#Approximations.
+	return base64.StdEncoding.EncodeToString(bytes[:8])
+}
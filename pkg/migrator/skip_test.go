@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	clitesting "k8s.io/client-go/testing"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator/metrics"
+)
+
+func TestStorageVersionHash(t *testing.T) {
+	// The hash of pods served by the apiserver.
+	if e, a := "xPOwRZ+Yhw8=", StorageVersionHash("", "v1", "Pod"); e != a {
+		t.Errorf("expected %s, got %s", e, a)
+	}
+}
+
+func TestAnnotationChecker(t *testing.T) {
+	c := NewAnnotationChecker("example.com/storage-version", "v2")
+	obj := &unstructured.Unstructured{}
+	if !c.NeedsMigration(obj) {
+		t.Errorf("expected an object without the annotation to need migration")
+	}
+	obj.SetAnnotations(map[string]string{"example.com/storage-version": "v1"})
+	if !c.NeedsMigration(obj) {
+		t.Errorf("expected an object written in v1 to need migration")
+	}
+	obj.SetAnnotations(map[string]string{"example.com/storage-version": "v2"})
+	if c.NeedsMigration(obj) {
+		t.Errorf("expected an object written in v2 to be skipped")
+	}
+}
+
+func TestManagedFieldsChecker(t *testing.T) {
+	created := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewManagedFieldsChecker(StorageVersionHash("", "v1", "Pod"), created)
+	for _, tc := range []struct {
+		name       string
+		apiVersion string
+		time       time.Time
+		want       bool
+	}{
+		{name: "written before the migration", apiVersion: "v1", time: created.Add(-time.Second), want: true},
+		{name: "written in another version", apiVersion: "v2", time: created.Add(time.Second), want: true},
+		{name: "written since the migration", apiVersion: "v1", time: created.Add(time.Second), want: false},
+	} {
+		obj := &unstructured.Unstructured{}
+		obj.SetKind("Pod")
+		obj.SetManagedFields([]metav1.ManagedFieldsEntry{
+			{Manager: "kubelet", APIVersion: tc.apiVersion, Time: &metav1.Time{Time: tc.time}},
+		})
+		if got := c.NeedsMigration(obj); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestMigrateListSkipsObjects(t *testing.T) {
+	metrics.Metrics.Reset()
+	nodeList := newNodeList(10)
+	nodeList.Items[3].Annotations = map[string]string{"skip": "true"}
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme, nil, &nodeList)
+	migrator := NewMigrator(v1.SchemeGroupVersion.WithResource("nodes"), client, &fakeProgress{},
+		WithChecker(NewAnnotationChecker("skip", "true")))
+	if err := migrator.migrateList(context.TODO(), toUnstructuredListOrDie(nodeList)); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range client.Actions() {
+		name, err := metadataAccessor.Name(a.(clitesting.UpdateAction).GetObject())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "node3" {
+			t.Errorf("expected node3 to be skipped")
+		}
+	}
+	if n := len(client.Actions()); n != 9 {
+		t.Errorf("expected 9 updates, got %d", n)
+	}
+	labels := map[string]string{"resource": "/v1, Resource=nodes"}
+	expectCounterCount(t, "storage_migrator_core_migrator_skipped_objects", labels, 1)
+	expectCounterCount(t, "storage_migrator_core_migrator_rewritten_objects", labels, 9)
+}
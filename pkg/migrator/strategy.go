@@ -0,0 +1,106 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// DefaultFieldManager is the field manager of the server-side apply strategy.
+const DefaultFieldManager = "storage-version-migrator"
+
+// Strategy writes an object back to the apiserver without changing it, so
+// that the apiserver stores the object in the current storage version.
+type Strategy interface {
+	// Write writes obj, as listed or got from the client. A conflict
+	// error makes the migrator get the object again and retry.
+	Write(ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured) error
+}
+
+// NewUpdateStrategy returns a strategy that updates the object with its full
+// content. The update fails with a conflict if the object has changed since
+// it was read.
+func NewUpdateStrategy() Strategy {
+	return updateStrategy{}
+}
+
+type updateStrategy struct{}
+
+func (updateStrategy) Write(ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	_, err := client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+// NewMergePatchStrategy returns a strategy that sends an empty JSON merge
+// patch. The apiserver applies the patch to the latest version of the
+// object, so the write never conflicts, and admission webhooks see an update
+// that changes nothing.
+func NewMergePatchStrategy() Strategy {
+	return mergePatchStrategy{}
+}
+
+type mergePatchStrategy struct{}
+
+func (mergePatchStrategy) Write(ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	_, err := client.Patch(ctx, obj.GetName(), types.MergePatchType, []byte("{}"), metav1.PatchOptions{})
+	return err
+}
+
+// NewApplyStrategy returns a strategy that server-side applies a
+// configuration without fields, owned by the field manager. The
+// configuration carries the UID and resourceVersion of the object, so the
+// apply conflicts if the object has been replaced or modified since it was
+// read. Such a conflict means the object has been written since, hence
+// stored in the current storage version, so it is not an error.
+func NewApplyStrategy(fieldManager string) Strategy {
+	if len(fieldManager) == 0 {
+		fieldManager = DefaultFieldManager
+	}
+	return applyStrategy{fieldManager: fieldManager}
+}
+
+type applyStrategy struct {
+	fieldManager string
+}
+
+func (s applyStrategy) Write(ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"apiVersion": obj.GetAPIVersion(),
+		"kind":       obj.GetKind(),
+		"metadata": map[string]interface{}{
+			"name":            obj.GetName(),
+			"namespace":       obj.GetNamespace(),
+			"uid":             obj.GetUID(),
+			"resourceVersion": obj.GetResourceVersion(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{FieldManager: s.fieldManager})
+	if errors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
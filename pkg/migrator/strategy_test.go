@@ -0,0 +1,103 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migrator
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	clitesting "k8s.io/client-go/testing"
+)
+
+func newStrategyTestObject() *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName("cm")
+	obj.SetUID("uid")
+	obj.SetResourceVersion("42")
+	return obj
+}
+
+func TestStrategies(t *testing.T) {
+	configmaps := v1.SchemeGroupVersion.WithResource("configmaps")
+	for _, tc := range []struct {
+		name      string
+		strategy  Strategy
+		verb      string
+		patchType types.PatchType
+	}{
+		{name: "update", strategy: NewUpdateStrategy(), verb: "update"},
+		{name: "merge patch", strategy: NewMergePatchStrategy(), verb: "patch", patchType: types.MergePatchType},
+		{name: "apply", strategy: NewApplyStrategy(""), verb: "patch", patchType: types.ApplyPatchType},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleDynamicClient(scheme.Scheme)
+			var action clitesting.Action
+			client.Fake.PrependReactor("*", "configmaps", func(a clitesting.Action) (bool, runtime.Object, error) {
+				action = a
+				return true, newStrategyTestObject(), nil
+			})
+			if err := tc.strategy.Write(context.TODO(), client.Resource(configmaps).Namespace("default"), newStrategyTestObject()); err != nil {
+				t.Fatal(err)
+			}
+			if action.GetVerb() != tc.verb {
+				t.Fatalf("expected a %s, got %v", tc.verb, action)
+			}
+			if tc.verb != "patch" {
+				return
+			}
+			patch := action.(clitesting.PatchAction)
+			if patch.GetPatchType() != tc.patchType || patch.GetName() != "cm" {
+				t.Errorf("expected a %s patch of cm, got %v", tc.patchType, action)
+			}
+			if tc.patchType != types.ApplyPatchType {
+				if string(patch.GetPatch()) != "{}" {
+					t.Errorf("expected an empty patch, got %s", patch.GetPatch())
+				}
+				return
+			}
+			var config unstructured.Unstructured
+			if err := json.Unmarshal(patch.GetPatch(), &config.Object); err != nil {
+				t.Fatal(err)
+			}
+			if config.GetUID() != "uid" || config.GetResourceVersion() != "42" || config.GetKind() != "ConfigMap" {
+				t.Errorf("expected the configuration to identify the object, got %s", patch.GetPatch())
+			}
+		})
+	}
+}
+
+func TestApplyStrategyIgnoresConflicts(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(scheme.Scheme)
+	client.Fake.PrependReactor("patch", "configmaps", func(a clitesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewConflict(v1.Resource("configmaps"), "cm", nil)
+	})
+	err := NewApplyStrategy("").Write(context.TODO(), client.Resource(v1.SchemeGroupVersion.WithResource("configmaps")).Namespace("default"), newStrategyTestObject())
+	if err != nil {
+		t.Errorf("expected a conflict to mean the object has been written since, got %v", err)
+	}
+}
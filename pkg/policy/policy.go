@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy decides which resources the storage version migrator
+// migrates.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy selects the resources that are migrated. A resource is migrated if
+// it matches a rule of Include, or Include is empty, and it matches no rule
+// of Exclude.
+type Policy struct {
+	Include []Rule `json:"include,omitempty"`
+	Exclude []Rule `json:"exclude,omitempty"`
+}
+
+// Rule matches the resources of the listed groups with the listed names.
+// Groups and resources are glob patterns as understood by path.Match, e.g.,
+// "*.example.com". "*" matches all of them, and "" is the core group.
+type Rule struct {
+	Groups    []string `json:"groups"`
+	Resources []string `json:"resources"`
+}
+
+// DefaultPolicy is used when no policy is configured. It excludes events,
+// which are short-lived and numerous.
+var DefaultPolicy = &Policy{
+	Exclude: []Rule{
+		{Groups: []string{"*"}, Resources: []string{"events"}},
+	},
+}
+
+// Load reads a policy from a YAML or JSON file. An empty path returns the
+// DefaultPolicy.
+func Load(file string) (*Policy, error) {
+	if len(file) == 0 {
+		return DefaultPolicy, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("failed to parse the policy in %s: %v", file, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy in %s: %v", file, err)
+	}
+	return p, nil
+}
+
+// Validate returns an error if a rule lists no group or no resource, or has
+// a malformed pattern.
+func (p *Policy) Validate() error {
+	for _, rules := range [][]Rule{p.Include, p.Exclude} {
+		for i, r := range rules {
+			if len(r.Groups) == 0 || len(r.Resources) == 0 {
+				return fmt.Errorf("rule %d lists no groups or no resources", i)
+			}
+			for _, pattern := range append(append([]string{}, r.Groups...), r.Resources...) {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %d: invalid pattern %q: %v", i, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Allows returns true if the resource is migrated. A nil policy allows all
+// resources.
+func (p *Policy) Allows(gr schema.GroupResource) bool {
+	if p == nil {
+		return true
+	}
+	if len(p.Include) > 0 && !matchesAny(p.Include, gr) {
+		return false
+	}
+	return !matchesAny(p.Exclude, gr)
+}
+
+func matchesAny(rules []Rule, gr schema.GroupResource) bool {
+	for _, r := range rules {
+		if matches(r.Groups, gr.Group) && matches(r.Resources, gr.Resource) {
+			return true
+		}
+	}
+	return false
+}
+
+func matches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// Patterns are validated when the policy is loaded.
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
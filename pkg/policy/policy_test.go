@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const testPolicy = `
+include:
+- groups: ["", "apps", "*.example.com"]
+  resources: ["*"]
+exclude:
+- groups: [""]
+  resources: ["events"]
+- groups: ["*.example.com"]
+  resources: ["*reports"]
+`
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(file, []byte(testPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		resource schema.GroupResource
+		allowed  bool
+	}{
+		{schema.GroupResource{Resource: "pods"}, true},
+		{schema.GroupResource{Resource: "events"}, false},
+		{schema.GroupResource{Group: "apps", Resource: "deployments"}, true},
+		{schema.GroupResource{Group: "batch", Resource: "jobs"}, false},
+		{schema.GroupResource{Group: "widgets.example.com", Resource: "widgets"}, true},
+		{schema.GroupResource{Group: "widgets.example.com", Resource: "widgetreports"}, false},
+		{schema.GroupResource{Group: "example.com", Resource: "widgets"}, false},
+	} {
+		if a := p.Allows(tc.resource); a != tc.allowed {
+			t.Errorf("%v: expected allowed %v, got %v", tc.resource, tc.allowed, a)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"unknown field": "exclude:\n- group: apps\n  resources: [\"*\"]\n",
+		"no resources":  "exclude:\n- groups: [apps]\n",
+		"bad pattern":   "exclude:\n- groups: [\"[\"]\n  resources: [\"*\"]\n",
+	} {
+		file := filepath.Join(dir, "policy.yaml")
+		if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(file); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	p, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Allows(schema.GroupResource{Resource: "events"}) || p.Allows(schema.GroupResource{Group: "events.k8s.io", Resource: "events"}) {
+		t.Errorf("expected events to be excluded")
+	}
+	if !p.Allows(schema.GroupResource{Resource: "pods"}) {
+		t.Errorf("expected pods to be allowed")
+	}
+}
+
+func TestNilPolicyAllowsAll(t *testing.T) {
+	var p *Policy
+	if !p.Allows(schema.GroupResource{Resource: "events"}) {
+		t.Errorf("expected a nil policy to allow events")
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package readiness
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The formats a Report can be written in.
+const (
+	TableFormat = "table"
+	JSONFormat  = "json"
+	JUnitFormat = "junit"
+)
+
+// junitSuiteName is the name of the JUnit test suite, and the class name of
+// its test cases.
+const junitSuiteName = "storage-version-migration"
+
+// ValidateFormat returns an error unless format is one of TableFormat,
+// JSONFormat and JUnitFormat.
+func ValidateFormat(format string) error {
+	switch format {
+	case TableFormat, JSONFormat, JUnitFormat:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, must be %s, %s or %s", format, TableFormat, JSONFormat, JUnitFormat)
+	}
+}
+
+// Write writes the report in format, one of TableFormat, JSONFormat and
+// JUnitFormat. The heartbeats are shown relative to now in a table.
+func (report *Report) Write(w io.Writer, format string, now time.Time) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	switch format {
+	case JSONFormat:
+		return report.WriteJSON(w)
+	case JUnitFormat:
+		return report.WriteJUnit(w)
+	default:
+		return report.WriteTable(w, now)
+	}
+}
+
+// WriteTable writes the report as a table, one resource per row.
+func (report *Report) WriteTable(w io.Writer, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE\tREADY\tMIGRATED\tHEARTBEAT\tPENDING MIGRATIONS")
+	for _, r := range report.Resources {
+		heartbeat := "<none>"
+		if !r.LastHeartbeatTime.IsZero() {
+			heartbeat = now.Sub(r.LastHeartbeatTime.Time).Round(time.Second).String() + " ago"
+			if !r.HeartbeatFresh {
+				heartbeat += " (stale)"
+			}
+		}
+		pending := "<none>"
+		if len(r.PendingMigrations) != 0 {
+			pending = strings.Join(r.PendingMigrations, ",")
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%t\t%s\t%s\n", r.Resource, r.Ready, r.Migrated, heartbeat, pending)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%d of %d resources are ready\n", len(report.Resources)-report.NotReady(), len(report.Resources)); err != nil {
+		return err
+	}
+	for _, reason := range report.Reasons {
+		if _, err := fmt.Fprintf(w, "not ready: %s\n", reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the report in JSON.
+func (report *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as a JUnit test suite, with a test case per
+// resource that fails if the resource is not ready. The other reasons the
+// cluster is not ready fail a test case named after the suite.
+func (report *Report) WriteJUnit(w io.Writer) error {
+	suite := junitTestSuite{
+		Name:     junitSuiteName,
+		Tests:    len(report.Resources),
+		Failures: report.NotReady(),
+	}
+	if len(report.Reasons) != 0 {
+		suite.Tests++
+		suite.Failures++
+		suite.TestCases = append(suite.TestCases, junitTestCase{
+			Name:      junitSuiteName,
+			ClassName: junitSuiteName,
+			Failure: &junitFailure{
+				Message: "the cluster is not ready",
+				Text:    strings.Join(report.Reasons, "; "),
+			},
+		})
+	}
+	for _, r := range report.Resources {
+		tc := junitTestCase{
+			Name:      r.Resource,
+			ClassName: junitSuiteName,
+		}
+		if !r.Ready {
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%s is not ready", r.Resource),
+				Text:    strings.Join(r.Reasons, "; "),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
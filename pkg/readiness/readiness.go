@@ -0,0 +1,225 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package readiness reports whether the resources of a cluster are stored in
+// their current storage version, i.e., whether it is safe to upgrade or
+// downgrade the API servers.
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
+)
+
+// Report is the readiness of all resources.
+type Report struct {
+	// Ready is true if all resources are ready, and there is no other
+	// reason the cluster is not ready.
+	Ready     bool             `json:"ready"`
+	Resources []ResourceReport `json:"resources"`
+	// Reasons explain why the cluster is not ready, other than the
+	// resources that are not ready.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// ResourceReport is the readiness of a resource.
+type ResourceReport struct {
+	// Resource is the name of the storage state of the resource,
+	// resource.group.
+	Resource                      string   `json:"resource"`
+	CurrentStorageVersionHash     string   `json:"currentStorageVersionHash,omitempty"`
+	PersistedStorageVersionHashes []string `json:"persistedStorageVersionHashes,omitempty"`
+	// Migrated is true if the objects are only persisted in the current
+	// storage version.
+	Migrated          bool        `json:"migrated"`
+	LastHeartbeatTime metav1.Time `json:"lastHeartbeatTime,omitempty"`
+	// HeartbeatFresh is true if the trigger controller checked the storage
+	// version of the resource recently.
+	HeartbeatFresh bool `json:"heartbeatFresh"`
+	// PendingMigrations are the migrations of the resource that have not
+	// completed.
+	PendingMigrations []string `json:"pendingMigrations,omitempty"`
+	Ready             bool     `json:"ready"`
+	// Reasons explain why the resource is not ready.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// Check reads all storage states and migrations, and reports the readiness of
+// the resources resourcePolicy allows. A heartbeat older than heartbeatTimeout
+// is stale. The resources disco does not find are no longer served, e.g.,
+// the resources of a deleted CustomResourceDefinition, and are ignored; with a
+// nil disco, all resources are reported.
+func Check(ctx context.Context, client migrationclient.Interface, disco discovery.DiscoveryInterface, resourcePolicy *policy.Policy, heartbeatTimeout time.Duration) (*Report, error) {
+	states, err := client.MigrationV1alpha1().StorageStates().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := client.MigrationV1alpha1().StorageVersionMigrations().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if disco == nil {
+		return Evaluate(states.Items, migrations.Items, resourcePolicy, heartbeatTimeout, time.Now()), nil
+	}
+	served, err := servedResources(disco)
+	if err != nil {
+		return nil, err
+	}
+	var servedStates []migrationv1alpha1.StorageState
+	for _, ss := range states.Items {
+		if served(schema.GroupResource{Group: ss.Spec.Resource.Group, Resource: ss.Spec.Resource.Resource}) {
+			servedStates = append(servedStates, ss)
+		}
+	}
+	var servedMigrations []migrationv1alpha1.StorageVersionMigration
+	for _, m := range migrations.Items {
+		if served(schema.GroupResource{Group: m.Spec.Resource.Group, Resource: m.Spec.Resource.Resource}) {
+			servedMigrations = append(servedMigrations, m)
+		}
+	}
+	return Evaluate(servedStates, servedMigrations, resourcePolicy, heartbeatTimeout, time.Now()), nil
+}
+
+// servedResources returns a function that returns true if the apiserver serves
+// the resource in any version. The resources of the groups whose discovery
+// fails are assumed to be served.
+func servedResources(disco discovery.DiscoveryInterface) (func(schema.GroupResource) bool, error) {
+	_, lists, err := disco.ServerGroupsAndResources()
+	failedGroups := sets.NewString()
+	if failed, ok := err.(*discovery.ErrGroupDiscoveryFailed); ok {
+		for gv := range failed.Groups {
+			failedGroups.Insert(gv.Group)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	served := map[schema.GroupResource]bool{}
+	for _, l := range lists {
+		gv, err := schema.ParseGroupVersion(l.GroupVersion)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range l.APIResources {
+			served[gv.WithResource(r.Name).GroupResource()] = true
+		}
+	}
+	return func(gr schema.GroupResource) bool {
+		return served[gr] || failedGroups.Has(gr.Group)
+	}, nil
+}
+
+// Evaluate reports the readiness of the resources of the storage states and
+// the migrations at now. A resource is ready if its objects are only persisted
+// in the current storage version, the trigger controller checked its storage
+// version within heartbeatTimeout, and none of its migrations is pending. A
+// resource without a storage state is only reported if it has a pending
+// migration, in which case it is not ready. The resources resourcePolicy
+// excludes are not migrated by the trigger controller, and are ignored; a nil
+// policy allows all resources. Without any storage state of an allowed
+// resource, nothing proves that the resources are migrated, so the report is
+// not ready.
+func Evaluate(states []migrationv1alpha1.StorageState, migrations []migrationv1alpha1.StorageVersionMigration, resourcePolicy *policy.Policy, heartbeatTimeout time.Duration, now time.Time) *Report {
+	pending := map[string][]string{}
+	for i := range migrations {
+		m := &migrations[i]
+		if controller.IsCompleted(m) || !resourcePolicy.Allows(schema.GroupResource{Group: m.Spec.Resource.Group, Resource: m.Spec.Resource.Resource}) {
+			continue
+		}
+		name := controller.StorageStateName(m.Spec.Resource)
+		pending[name] = append(pending[name], m.Name)
+	}
+
+	report := &Report{Ready: true}
+	allowed := 0
+	for _, ss := range states {
+		if !resourcePolicy.Allows(schema.GroupResource{Group: ss.Spec.Resource.Group, Resource: ss.Spec.Resource.Resource}) {
+			continue
+		}
+		allowed++
+		r := ResourceReport{
+			Resource:                      ss.Name,
+			CurrentStorageVersionHash:     ss.Status.CurrentStorageVersionHash,
+			PersistedStorageVersionHashes: ss.Status.PersistedStorageVersionHashes,
+			LastHeartbeatTime:             ss.Status.LastHeartbeatTime,
+			PendingMigrations:             pending[ss.Name],
+		}
+		delete(pending, ss.Name)
+		persisted := ss.Status.PersistedStorageVersionHashes
+		current := ss.Status.CurrentStorageVersionHash
+		r.Migrated = len(current) != 0 && len(persisted) == 1 && persisted[0] == current
+		if !r.Migrated {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("objects might be persisted in storage versions %v, not only in the current one %q", persisted, current))
+		}
+		r.HeartbeatFresh = !ss.Status.LastHeartbeatTime.IsZero() && now.Sub(ss.Status.LastHeartbeatTime.Time) <= heartbeatTimeout
+		if !r.HeartbeatFresh {
+			r.Reasons = append(r.Reasons, fmt.Sprintf("the storage version was last checked at %v, more than %v ago", ss.Status.LastHeartbeatTime.UTC().Format(time.RFC3339), heartbeatTimeout))
+		}
+		report.add(r)
+	}
+	if allowed == 0 {
+		report.Ready = false
+		report.Reasons = append(report.Reasons, "no storage state was found: the trigger controller has not run yet, or cannot create storage states")
+	}
+	// The migrations of resources without a storage state, e.g., created
+	// by hand.
+	for name, migrations := range pending {
+		report.add(ResourceReport{
+			Resource:          name,
+			PendingMigrations: migrations,
+		})
+	}
+	sort.Slice(report.Resources, func(i, j int) bool {
+		return report.Resources[i].Resource < report.Resources[j].Resource
+	})
+	return report
+}
+
+// add adds the report of a resource, which is ready unless there is a reason
+// it is not, or one of its migrations is pending.
+func (report *Report) add(r ResourceReport) {
+	sort.Strings(r.PendingMigrations)
+	if len(r.PendingMigrations) != 0 {
+		r.Reasons = append(r.Reasons, fmt.Sprintf("migrations %v are pending", r.PendingMigrations))
+	}
+	r.Ready = len(r.Reasons) == 0
+	if !r.Ready {
+		report.Ready = false
+	}
+	report.Resources = append(report.Resources, r)
+}
+
+// NotReady returns the number of resources that are not ready.
+func (report *Report) NotReady() int {
+	n := 0
+	for _, r := range report.Resources {
+		if !r.Ready {
+			n++
+		}
+	}
+	return n
+}
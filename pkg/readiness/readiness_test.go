@@ -0,0 +1,270 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package readiness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
+)
+
+const heartbeatTimeout = 20 * time.Minute
+
+// storageState returns the storage state of the resource named
+// resource.group.
+func storageState(name, current string, persisted []string, heartbeat time.Duration) *v1alpha1.StorageState {
+	resource, group, _ := strings.Cut(name, ".")
+	return &v1alpha1.StorageState{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1alpha1.StorageStateSpec{
+			Resource: v1alpha1.GroupResource{Group: group, Resource: resource},
+		},
+		Status: v1alpha1.StorageStateStatus{
+			CurrentStorageVersionHash:     current,
+			PersistedStorageVersionHashes: persisted,
+			LastHeartbeatTime:             metav1.NewTime(time.Now().Add(-heartbeat)),
+		},
+	}
+}
+
+func migration(name string, resource v1alpha1.GroupVersionResource, conditions ...v1alpha1.MigrationConditionType) *v1alpha1.StorageVersionMigration {
+	m := &v1alpha1.StorageVersionMigration{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1alpha1.StorageVersionMigrationSpec{Resource: resource},
+	}
+	for _, c := range conditions {
+		m.Status.Conditions = append(m.Status.Conditions, v1alpha1.MigrationCondition{Type: c, Status: "True"})
+	}
+	return m
+}
+
+func TestCheck(t *testing.T) {
+	pods := v1alpha1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	deployments := v1alpha1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	client := fake.NewSimpleClientset(
+		storageState("pods", "new", []string{"new"}, time.Minute),
+		storageState("deployments.apps", "new", []string{"old", "new"}, time.Minute),
+		storageState("services", "new", []string{"new"}, time.Hour),
+		storageState("secrets", "new", []string{v1alpha1.Unknown}, time.Minute),
+		migration("pods-1", pods, v1alpha1.MigrationSucceeded),
+		migration("deployments-1", deployments, v1alpha1.MigrationRunning),
+		migration("widgets-1", v1alpha1.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}),
+	)
+	report, err := Check(context.TODO(), client, nil, nil, heartbeatTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Ready {
+		t.Errorf("expected the report not to be ready")
+	}
+	type result struct {
+		ready, migrated, fresh bool
+		pending                []string
+	}
+	expected := map[string]result{
+		"deployments.apps":    {false, false, true, []string{"deployments-1"}},
+		"pods":                {true, true, true, nil},
+		"secrets":             {false, false, true, nil},
+		"services":            {false, true, false, nil},
+		"widgets.example.com": {false, false, false, []string{"widgets-1"}},
+	}
+	var names []string
+	for _, r := range report.Resources {
+		names = append(names, r.Resource)
+		e, ok := expected[r.Resource]
+		if !ok {
+			t.Errorf("unexpected resource %s", r.Resource)
+			continue
+		}
+		if a := (result{r.Ready, r.Migrated, r.HeartbeatFresh, r.PendingMigrations}); !reflect.DeepEqual(e, a) {
+			t.Errorf("%s: expected %+v, got %+v", r.Resource, e, a)
+		}
+		if r.Ready != (len(r.Reasons) == 0) {
+			t.Errorf("%s: expected reasons only if the resource is not ready, got %v", r.Resource, r.Reasons)
+		}
+	}
+	if e := []string{"deployments.apps", "pods", "secrets", "services", "widgets.example.com"}; !reflect.DeepEqual(e, names) {
+		t.Errorf("expected the resources %v in order, got %v", e, names)
+	}
+	if n := report.NotReady(); n != 4 {
+		t.Errorf("expected 4 resources not to be ready, got %d", n)
+	}
+}
+
+func TestCheckIgnoresUnservedResources(t *testing.T) {
+	widgets := v1alpha1.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "widgets"}
+	client := fake.NewSimpleClientset(
+		storageState("pods", "new", []string{"new"}, time.Minute),
+		// The CustomResourceDefinition of widgets has been deleted.
+		storageState("widgets.example.com", "new", []string{"old", "new"}, time.Hour),
+		migration("widgets-1", widgets),
+		// The discovery of gadgets fails.
+		storageState("gadgets.example.org", "new", []string{"new"}, time.Minute),
+	)
+	client.Resources = []*metav1.APIResourceList{
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: "pods"}, {Name: "pods/status"}}},
+	}
+	disco := &failingDiscovery{DiscoveryInterface: client.Discovery(), failed: schema.GroupVersion{Group: "example.org", Version: "v1"}}
+	report, err := Check(context.TODO(), client, disco, nil, heartbeatTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, r := range report.Resources {
+		names = append(names, r.Resource)
+	}
+	if e := []string{"gadgets.example.org", "pods"}; !reflect.DeepEqual(e, names) {
+		t.Errorf("expected the resources %v, got %v", e, names)
+	}
+	if !report.Ready {
+		t.Errorf("expected the report to be ready, got %+v", report)
+	}
+}
+
+// failingDiscovery fails to discover a group version.
+type failingDiscovery struct {
+	discovery.DiscoveryInterface
+	failed schema.GroupVersion
+}
+
+func (d *failingDiscovery) ServerGroupsAndResources() ([]*metav1.APIGroup, []*metav1.APIResourceList, error) {
+	groups, lists, err := d.DiscoveryInterface.ServerGroupsAndResources()
+	if err != nil {
+		return nil, nil, err
+	}
+	return groups, lists, &discovery.ErrGroupDiscoveryFailed{Groups: map[schema.GroupVersion]error{d.failed: fmt.Errorf("unavailable")}}
+}
+
+func TestEvaluateReady(t *testing.T) {
+	report := Evaluate([]v1alpha1.StorageState{*storageState("pods", "new", []string{"new"}, time.Minute)}, nil, nil, heartbeatTimeout, time.Now())
+	if !report.Ready || report.NotReady() != 0 {
+		t.Errorf("expected the report to be ready, got %+v", report)
+	}
+}
+
+func TestEvaluateWithoutStorageStates(t *testing.T) {
+	report := Evaluate(nil, nil, nil, heartbeatTimeout, time.Now())
+	if report.Ready || len(report.Reasons) != 1 {
+		t.Errorf("expected the report not to be ready without storage states, got %+v", report)
+	}
+
+	// The storage states of excluded resources do not count.
+	resourcePolicy := &policy.Policy{
+		Exclude: []policy.Rule{{Groups: []string{"*"}, Resources: []string{"events"}}},
+	}
+	report = Evaluate([]v1alpha1.StorageState{
+		*storageState("events", "new", []string{"new"}, time.Minute),
+	}, nil, resourcePolicy, heartbeatTimeout, time.Now())
+	if report.Ready {
+		t.Errorf("expected the report not to be ready without storage states of allowed resources, got %+v", report)
+	}
+
+	var buf bytes.Buffer
+	if err := report.Write(&buf, JUnitFormat, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("failed to decode %s: %v", buf.String(), err)
+	}
+	if suite := suites.Suites[0]; suite.Tests != 1 || suite.Failures != 1 {
+		t.Errorf("expected a failed test case, got %s", buf.String())
+	}
+}
+
+func TestEvaluateIgnoresExcludedResources(t *testing.T) {
+	events := v1alpha1.GroupVersionResource{Group: "events.k8s.io", Version: "v1", Resource: "events"}
+	resourcePolicy := &policy.Policy{
+		Exclude: []policy.Rule{{Groups: []string{"*"}, Resources: []string{"events"}}},
+	}
+	report := Evaluate([]v1alpha1.StorageState{
+		*storageState("pods", "new", []string{"new"}, time.Minute),
+		// The trigger controller stopped checking events once the policy
+		// excluded them.
+		*storageState("events", "new", []string{"new"}, 24*time.Hour),
+		*storageState("events.events.k8s.io", "new", []string{"old", "new"}, 24*time.Hour),
+	}, []v1alpha1.StorageVersionMigration{*migration("events-1", events)}, resourcePolicy, heartbeatTimeout, time.Now())
+	if !report.Ready || len(report.Resources) != 1 || report.Resources[0].Resource != "pods" {
+		t.Errorf("expected only pods to be reported, got %+v", report)
+	}
+
+	report = Evaluate([]v1alpha1.StorageState{
+		*storageState("events", "new", []string{"new"}, 24*time.Hour),
+	}, nil, nil, heartbeatTimeout, time.Now())
+	if report.Ready {
+		t.Errorf("expected the stale events not to be ready without a policy, got %+v", report)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	report := Evaluate([]v1alpha1.StorageState{
+		*storageState("pods", "new", []string{"new"}, time.Minute),
+		*storageState("deployments.apps", "new", []string{"old", "new"}, time.Minute),
+	}, nil, nil, heartbeatTimeout, time.Now())
+	var buf bytes.Buffer
+	if err := report.Write(&buf, JUnitFormat, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("failed to decode %s: %v", buf.String(), err)
+	}
+	if len(suites.Suites) != 1 {
+		t.Fatalf("expected a test suite, got %+v", suites)
+	}
+	suite := suites.Suites[0]
+	if suite.Tests != 2 || suite.Failures != 1 {
+		t.Errorf("expected 2 tests and 1 failure, got %d and %d", suite.Tests, suite.Failures)
+	}
+	for _, tc := range suite.TestCases {
+		if failed := tc.Failure != nil; failed != (tc.Name == "deployments.apps") {
+			t.Errorf("%s: unexpected failure %+v", tc.Name, tc.Failure)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	report := Evaluate([]v1alpha1.StorageState{*storageState("pods", "new", []string{"new"}, time.Minute)}, nil, nil, heartbeatTimeout, time.Now())
+	var buf bytes.Buffer
+	if err := report.Write(&buf, JSONFormat, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Ready || len(decoded.Resources) != 1 || decoded.Resources[0].Resource != "pods" {
+		t.Errorf("unexpected report %s", buf.String())
+	}
+	if err := report.Write(&buf, "yaml", time.Now()); err == nil || !strings.Contains(err.Error(), "unknown format") {
+		t.Errorf("expected an unknown format to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclientv1 "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/typed/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	apiregistrationclientv1 "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/typed/apiregistration/v1"
+)
+
+// groupDiscoveryDelay is how long the trigger waits after a
+// CustomResourceDefinition or an APIService changes before it discovers the
+// group again, to give the apiserver time to update its discovery document.
+const groupDiscoveryDelay = 5 * time.Second
+
+// WithAPIWatches makes the MigrationTrigger watch CustomResourceDefinitions
+// and APIServices, and discover the resources of a group again as soon as
+// one of them changes, instead of waiting for the next periodic discovery.
+func WithAPIWatches(crds apiextensionsclientv1.CustomResourceDefinitionInterface, apiServices apiregistrationclientv1.APIServiceInterface) Option {
+	return func(mt *MigrationTrigger) {
+		mt.crdInformer = cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					return crds.List(context.TODO(), options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					return crds.Watch(context.TODO(), options)
+				},
+			},
+			&apiextensionsv1.CustomResourceDefinition{},
+			0,
+			cache.Indexers{},
+		)
+		mt.crdInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    mt.addCRD,
+			UpdateFunc: mt.updateCRD,
+		})
+		mt.apiServiceInformer = cache.NewSharedIndexInformer(
+			&cache.ListWatch{
+				ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+					return apiServices.List(context.TODO(), options)
+				},
+				WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+					return apiServices.Watch(context.TODO(), options)
+				},
+			},
+			&apiregistrationv1.APIService{},
+			0,
+			cache.Indexers{},
+		)
+		mt.apiServiceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    mt.addAPIService,
+			UpdateFunc: mt.updateAPIService,
+		})
+	}
+}
+
+func (mt *MigrationTrigger) enqueueGroup(group string) {
+	mt.groupQueue.AddAfter(group, groupDiscoveryDelay)
+}
+
+func (mt *MigrationTrigger) addCRD(obj interface{}) {
+	crd, ok := obj.(*apiextensionsv1.CustomResourceDefinition)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected CustomResourceDefinition, got %#v", reflect.TypeOf(obj)))
+		return
+	}
+	mt.enqueueGroup(crd.Spec.Group)
+}
+
+func (mt *MigrationTrigger) updateCRD(oldObj, obj interface{}) {
+	old, ok := oldObj.(*apiextensionsv1.CustomResourceDefinition)
+	crd, ok2 := obj.(*apiextensionsv1.CustomResourceDefinition)
+	// Only changes to the versions, e.g., of the storage version, or to
+	// whether the resource is served, affect the discovery document.
+	if ok && ok2 && reflect.DeepEqual(old.Spec, crd.Spec) && reflect.DeepEqual(old.Status.Conditions, crd.Status.Conditions) {
+		return
+	}
+	mt.addCRD(obj)
+}
+
+func (mt *MigrationTrigger) addAPIService(obj interface{}) {
+	apiService, ok := obj.(*apiregistrationv1.APIService)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected APIService, got %#v", reflect.TypeOf(obj)))
+		return
+	}
+	mt.enqueueGroup(apiService.Spec.Group)
+}
+
+func (mt *MigrationTrigger) updateAPIService(oldObj, obj interface{}) {
+	old, ok := oldObj.(*apiregistrationv1.APIService)
+	apiService, ok2 := obj.(*apiregistrationv1.APIService)
+	if ok && ok2 && reflect.DeepEqual(old.Spec, apiService.Spec) && reflect.DeepEqual(old.Status.Conditions, apiService.Status.Conditions) {
+		return
+	}
+	mt.addAPIService(obj)
+}
+
+func (mt *MigrationTrigger) runGroupWorker(ctx context.Context) {
+	for mt.processNextGroup(ctx) {
+	}
+}
+
+func (mt *MigrationTrigger) processNextGroup(ctx context.Context) bool {
+	item, quit := mt.groupQueue.Get()
+	if quit {
+		return false
+	}
+	defer mt.groupQueue.Done(item)
+	group := item.(string)
+	if err := mt.processDiscoveryGroup(ctx, group); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to discover group %q: %v", group, err))
+		mt.groupQueue.AddRateLimited(item)
+		return true
+	}
+	mt.groupQueue.Forget(item)
+	return true
+}
+
+// processDiscoveryGroup discovers the preferred version of a group, and
+// processes its resources.
+func (mt *MigrationTrigger) processDiscoveryGroup(ctx context.Context, group string) error {
+	groups, err := mt.client.Discovery().ServerGroups()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups.Groups {
+		if g.Name != group {
+			continue
+		}
+		klog.V(2).Infof("discovering group %q", group)
+		l, err := mt.client.Discovery().ServerResourcesForGroupVersion(g.PreferredVersion.GroupVersion)
+		if err != nil {
+			return err
+		}
+		mt.processResourceList(ctx, l)
+		return nil
+	}
+	// The group is not served (anymore), there is nothing to migrate.
+	return nil
+}
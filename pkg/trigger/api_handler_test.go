@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	crdfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	core "k8s.io/client-go/testing"
+	apiservicefake "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/fake"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+)
+
+func TestProcessDiscoveryGroup(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{newAPIResource()},
+		},
+		{
+			GroupVersion: "example.com/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "widgets", Kind: "Widget", StorageVersionHash: "widgethash"},
+				{Name: "widgets/status", Kind: "Widget"},
+			},
+		},
+	}
+	trigger := NewMigrationTrigger(client)
+	trigger.heartbeat = metav1.Now()
+	if err := trigger.processDiscoveryGroup(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if e, a := 1, len(trigger.discovered); e != a {
+		t.Fatalf("expected %d discovered resource, got %v", e, trigger.discovered)
+	}
+	if _, ok := trigger.discovered[schema.GroupResource{Group: "example.com", Resource: "widgets"}]; !ok {
+		t.Fatalf("expected widgets to be discovered, got %v", trigger.discovered)
+	}
+	var launched []string
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "create" && a.GetResource().Resource == "storageversionmigrations" {
+			m := expectCreateStorageVersionMigrationAction(t, a)
+			launched = append(launched, m.Spec.Resource.Resource+"."+m.Spec.Resource.Group)
+		}
+	}
+	if len(launched) != 1 || launched[0] != "widgets.example.com" {
+		t.Errorf("expected a migration of widgets.example.com, got %v", launched)
+	}
+}
+
+func TestRunDiscoversWithoutAPIWatches(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{newAPIResource()},
+		},
+	}
+	// The trigger may not list CustomResourceDefinitions.
+	crds := crdfake.NewSimpleClientset()
+	crds.PrependReactor("list", "customresourcedefinitions", func(core.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewForbidden(schema.GroupResource{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"}, "", fmt.Errorf("forbidden"))
+	})
+	apiServices := apiservicefake.NewSimpleClientset()
+	trigger := NewMigrationTrigger(&discoveringClientset{Clientset: client}, WithAPIWatches(crds.ApiextensionsV1().CustomResourceDefinitions(), apiServices.ApiregistrationV1().APIServices()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go trigger.Run(ctx)
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		for _, a := range client.Actions() {
+			if a.GetVerb() == "create" && a.GetResource().Resource == "storagestates" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Errorf("expected the periodic discovery to create the storage state of pods, got %v", client.Actions())
+	}
+}
+
+// discoveringClientset serves the resources of the fake Clientset as the
+// preferred resources.
+type discoveringClientset struct {
+	*fake.Clientset
+}
+
+func (c *discoveringClientset) Discovery() discovery.DiscoveryInterface {
+	return &discoveringDiscovery{FakeDiscovery: c.Clientset.Discovery().(*fakediscovery.FakeDiscovery)}
+}
+
+type discoveringDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+func (d *discoveringDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return d.Resources, nil
+}
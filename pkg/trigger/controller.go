@@ -20,16 +20,23 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	migrationclient "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset"
+	migrationinformer "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/informer/migration/v1alpha1"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/verifier"
 )
 
 var (
@@ -42,48 +49,118 @@ var (
 )
 
 const (
-	// The migration trigger controller redo the discovery every discoveryPeriod.
-	discoveryPeriod = 10 * time.Minute
+	// By default, the migration trigger controller redo the discovery
+	// every DefaultDiscoveryPeriod.
+	DefaultDiscoveryPeriod = 10 * time.Minute
+	// migrationWorkers is the number of migrations processed concurrently.
+	migrationWorkers = 5
 )
 
 type MigrationTrigger struct {
 	client            migrationclient.Interface
 	migrationInformer cache.SharedIndexInformer
 	queue             workqueue.RateLimitingInterface
+	// storageStateInformer caches the storageStates, so that forgetting
+	// an excluded resource does not delete a storageState it does not
+	// have.
+	storageStateInformer cache.SharedIndexInformer
+
+	// kubeClient, storageVersionInformer and storageVersionQueue are set
+	// if the storage versions are read from the StorageVersion API.
+	kubeClient             kubernetes.Interface
+	storageVersionInformer cache.SharedIndexInformer
+	storageVersionQueue    workqueue.RateLimitingInterface
+
+	// crdInformer and apiServiceInformer are set if the resources of a
+	// group are discovered again when its CustomResourceDefinitions or
+	// APIServices change. groupQueue holds the groups to discover.
+	crdInformer        cache.SharedIndexInformer
+	apiServiceInformer cache.SharedIndexInformer
+	groupQueue         workqueue.RateLimitingInterface
+
+	// The migration trigger controller redo the discovery every
+	// discoveryPeriod.
+	discoveryPeriod time.Duration
+	// policy selects the resources that are migrated. If nil, all resources
+	// are migrated.
+	policy *policy.Policy
+	// historyLimit is the number of completed migrations recorded in the
+	// history of a storage state.
+	historyLimit int
+
+	// resources serializes processing a discovered resource.
+	resources *resourceLocks
+	// lock guards heartbeat, discovered and excluded.
+	lock sync.Mutex
 	// The timestamp of last time discovery is performed.
 	heartbeat metav1.Time
+	// discovered are the resources found by the discovery routine.
+	discovered map[schema.GroupResource]metav1.APIResource
+	// excluded are the resources the policy excludes whose storageState
+	// and migrations have been forgotten. They are forgotten again if the
+	// policy allows them and excludes them later.
+	excluded sets.String
+	// verifier, if not nil, verifies the storage before the persisted
+	// storage versions are refined.
+	verifier *verifier.Verifier
 }
 
-func NewMigrationTrigger(c migrationclient.Interface) *MigrationTrigger {
+// Option configures a MigrationTrigger.
+type Option func(*MigrationTrigger)
+
+// WithPolicy makes the MigrationTrigger only migrate the resources the policy
+// allows, and forget the StorageStates and the migrations it launched of the
+// resources it excludes. By default, all resources are migrated.
+func WithPolicy(p *policy.Policy) Option {
+	return func(mt *MigrationTrigger) {
+		mt.policy = p
+	}
+}
+
+// WithDiscoveryPeriod sets how often the MigrationTrigger discovers all
+// resources.
+func WithDiscoveryPeriod(period time.Duration) Option {
+	return func(mt *MigrationTrigger) {
+		mt.discoveryPeriod = period
+	}
+}
+
+// WithVerifier makes the MigrationTrigger verify that etcd only contains
+// objects in the current storage version, before it refines the persisted
+// storage versions of a resource after a successful migration.
+func WithVerifier(v *verifier.Verifier) Option {
+	return func(mt *MigrationTrigger) {
+		mt.verifier = v
+	}
+}
+
+func NewMigrationTrigger(c migrationclient.Interface, opts ...Option) *MigrationTrigger {
 	mt := &MigrationTrigger{
 		client: c,
 		// TODO: share one with the kubemigrator.go.
-		migrationInformer: controller.NewStatusAndResourceIndexedInformer(c),
-		queue:             workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "migration_triggering_controller"),
+		migrationInformer:    controller.NewStatusAndResourceIndexedInformer(c),
+		storageStateInformer: migrationinformer.NewStorageStateInformer(c, 0, cache.Indexers{}),
+		queue:                workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "migration_triggering_controller"),
+		storageVersionQueue:  workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "migration_triggering_controller_storage_versions"),
+		groupQueue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "migration_triggering_controller_groups"),
+		discovered:           make(map[schema.GroupResource]metav1.APIResource),
+		excluded:             sets.NewString(),
+		resources:            newResourceLocks(),
+		discoveryPeriod:      DefaultDiscoveryPeriod,
+		historyLimit:         DefaultHistoryLimit,
 	}
 	mt.migrationInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    mt.addResource,
 		UpdateFunc: mt.updateResource,
 		DeleteFunc: mt.deleteResource,
 	})
+	for _, opt := range opts {
+		opt(mt)
+	}
 
 	return mt
 }
 
-func (mt *MigrationTrigger) dequeue() <-chan interface{} {
-	work := make(chan interface{})
-	go func() {
-		for {
-			item, quit := mt.queue.Get()
-			if quit {
-				return
-			}
-			work <- item
-		}
-	}()
-	return work
-}
-
 // queueItem is the object in the workqueue.
 type queueItem struct {
 	// the namespace of the storageVersionMigration object.
@@ -125,7 +202,7 @@ func (mt *MigrationTrigger) updateResource(oldObj interface{}, obj interface{})
 }
 
 func (mt *MigrationTrigger) enqueueResource(migration *migrationv1alpha1.StorageVersionMigration) {
-	it := &queueItem{
+	it := queueItem{
 		namespace: migration.Namespace,
 		name:      migration.Name,
 		resource:  migration.Spec.Resource,
@@ -135,53 +212,77 @@ func (mt *MigrationTrigger) enqueueResource(migration *migrationv1alpha1.Storage
 
 func (mt *MigrationTrigger) Run(ctx context.Context) {
 	defer utilruntime.HandleCrash()
+	defer mt.queue.ShutDown()
+	defer mt.storageVersionQueue.ShutDown()
+	defer mt.groupQueue.ShutDown()
 	go mt.migrationInformer.Run(ctx.Done())
-	if !cache.WaitForCacheSync(ctx.Done(), mt.migrationInformer.HasSynced) {
+	go mt.storageStateInformer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), mt.migrationInformer.HasSynced, mt.storageStateInformer.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Unable to sync caches"))
 		return
 	}
-	work := mt.dequeue()
-
-	// We need to run the discovery routine and the migration management
-	// routine in serial. Otherwise, they can corrupt
-	// storageState.status.persistedStorageVersions.
-	//
-	// The discovery routine does the following for each resource:
-	// a. checks if storageState.status.currentStorageVersion == discovered.storageVersion
-	// b. if not, cleans existing migrations
-	// c. launches a new migration
-	// d. updates the storageState.status.currentStorageVersion and .persistedStorageVersions.
-	//
-	// The migration management routine does the following:
-	// 1. gets a migration object from the workqueue
-	// 2. gets the latest migration object from the apiserver
-	// 3. if the latest migration object shows the migration has completed
-	// successfully, updates the storageState.status.persistedStorageVersions
-	// to only contain storageState.status.currentStorageVersion.
-	//
-	// The PersistedStorageVersions will be corrupted if the above steps
-	// interleave in this order: 2, b, c, d, 3
-	//
-	// TODO: if we let the migration note down the currentStorageVersion,
-	// we can avoid the race.
-	ticker := time.NewTicker(discoveryPeriod)
-	// Do a discovery once started.
-	mt.processDiscovery(ctx)
-	for {
-		select {
-		case <-ticker.C:
-			mt.processDiscovery(ctx)
-		case w := <-work:
-			defer mt.queue.Done(w)
-			err := mt.processQueue(ctx, w)
-			if err == nil {
-				mt.queue.Forget(w)
-				break
-			}
-			utilruntime.HandleError(fmt.Errorf("failed to process %v: %v", w, err))
-			mt.queue.AddRateLimited(w)
-		case <-ctx.Done():
+	if mt.storageVersionInformer != nil && !mt.servesStorageVersionAPI() {
+		mt.storageVersionInformer = nil
+	}
+	if mt.storageVersionInformer != nil {
+		go mt.storageVersionInformer.Run(ctx.Done())
+		if !cache.WaitForCacheSync(ctx.Done(), mt.storageVersionInformer.HasSynced) {
+			utilruntime.HandleError(fmt.Errorf("Unable to sync caches"))
 			return
 		}
+		go wait.UntilWithContext(ctx, mt.runStorageVersionWorker, time.Second)
+	}
+	if mt.crdInformer != nil {
+		go mt.crdInformer.Run(ctx.Done())
+		go mt.apiServiceInformer.Run(ctx.Done())
+		// The periodic discovery does not wait for the watches, which
+		// never sync if the trigger may not list CustomResourceDefinitions
+		// or APIServices.
+		go func() {
+			if !cache.WaitForCacheSync(ctx.Done(), mt.crdInformer.HasSynced, mt.apiServiceInformer.HasSynced) {
+				utilruntime.HandleError(fmt.Errorf("Unable to sync caches"))
+				return
+			}
+			wait.UntilWithContext(ctx, mt.runGroupWorker, time.Second)
+		}()
+	}
+
+	// The discovery routine and the migration management routine run
+	// concurrently. They used to run in serial, because the discovery
+	// routine might change storageState.status.currentStorageVersionHash
+	// after the migration management routine decided that a migration
+	// succeeded, and before it refined
+	// storageState.status.persistedStorageVersionHashes, making it drop
+	// the old storage version. Migrations now record the storage version
+	// they migrate to in .spec.targetStorageVersionHash, and the
+	// persisted storage versions are only refined if it is still the
+	// current storage version. Both routines update the storage state
+	// with optimistic concurrency.
+	go wait.UntilWithContext(ctx, mt.collectHistory, historyGCPeriod)
+	for i := 0; i < migrationWorkers; i++ {
+		go wait.UntilWithContext(ctx, mt.runWorker, time.Second)
+	}
+	// Do a discovery once started, and every discoveryPeriod after.
+	wait.UntilWithContext(ctx, mt.processDiscovery, mt.discoveryPeriod)
+}
+
+func (mt *MigrationTrigger) runWorker(ctx context.Context) {
+	for mt.processNext(ctx) {
+	}
+}
+
+func (mt *MigrationTrigger) processNext(ctx context.Context) bool {
+	w, quit := mt.queue.Get()
+	if quit {
+		return false
+	}
+	defer mt.queue.Done(w)
+	err := mt.processQueue(ctx, w)
+	if err == nil {
+		mt.queue.Forget(w)
+		return true
 	}
+	utilruntime.HandleError(fmt.Errorf("failed to process %v: %v", w, err))
+	mt.queue.AddRateLimited(w)
+	return true
 }
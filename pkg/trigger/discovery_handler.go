@@ -20,6 +20,8 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -53,22 +55,36 @@ func (mt *MigrationTrigger) processDiscovery(ctx context.Context) {
 			klog.Warningf("failed to discover preferred resources: %v", err2)
 		}
 	}
+	mt.lock.Lock()
 	mt.heartbeat = metav1.Now()
+	mt.lock.Unlock()
 	for _, l := range resources {
-		gv, err := schema.ParseGroupVersion(l.GroupVersion)
-		if err != nil {
-			utilruntime.HandleError(fmt.Errorf("unexpected group version error: %v", err))
+		mt.processResourceList(ctx, l)
+	}
+}
+
+// processResourceList processes the resources of a group version.
+func (mt *MigrationTrigger) processResourceList(ctx context.Context, l *metav1.APIResourceList) {
+	gv, err := schema.ParseGroupVersion(l.GroupVersion)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("unexpected group version error: %v", err))
+		return
+	}
+	for _, r := range l.APIResources {
+		if strings.Contains(r.Name, "/") {
+			// Subresources share the storage of their resource.
 			continue
 		}
-		for _, r := range l.APIResources {
-			if r.Group == "" {
-				r.Group = gv.Group
-			}
-			if r.Version == "" {
-				r.Version = gv.Version
-			}
-			mt.processDiscoveryResource(ctx, r)
+		if r.Group == "" {
+			r.Group = gv.Group
 		}
+		if r.Version == "" {
+			r.Version = gv.Version
+		}
+		mt.lock.Lock()
+		mt.discovered[schema.GroupResource{Group: r.Group, Resource: r.Name}] = r
+		mt.lock.Unlock()
+		mt.processDiscoveryResource(ctx, r)
 	}
 }
 
@@ -80,12 +96,14 @@ func toGroupResource(r metav1.APIResource) migrationv1alpha1.GroupVersionResourc
 	}
 }
 
-// cleanMigrations removes all storageVersionMigrations whose .spec.resource == r.
-func (mt *MigrationTrigger) cleanMigrations(ctx context.Context, r metav1.APIResource) error {
+// cleanMigrations removes the storageVersionMigrations whose .spec.resource ==
+// r. If launchedOnly is true, only the migrations the trigger launched are
+// removed, and the ones created by someone else are kept.
+func (mt *MigrationTrigger) cleanMigrations(ctx context.Context, r metav1.APIResource, launchedOnly bool) error {
 	// Using the cache to find all matching migrations.
 	// The delay of the cache shouldn't matter in practice, because
 	// existing migrations are created by previous discovery cycles, they
-	// have at least discoveryPeriod to enter the informer's cache.
+	// have at least a discovery period to enter the informer's cache.
 	idx := mt.migrationInformer.GetIndexer()
 	l, err := idx.ByIndex(controller.ResourceIndex, controller.ToIndex(toGroupResource(r)))
 	if err != nil {
@@ -96,6 +114,9 @@ func (mt *MigrationTrigger) cleanMigrations(ctx context.Context, r metav1.APIRes
 		if !ok {
 			return fmt.Errorf("expected StorageVersionMigration, got %#v", reflect.TypeOf(m))
 		}
+		if launchedOnly && !launchedByTrigger(mm) {
+			continue
+		}
 		err := mt.client.MigrationV1alpha1().StorageVersionMigrations().Delete(ctx, mm.Name, metav1.DeleteOptions{})
 		if err != nil {
 			return fmt.Errorf("unexpected error deleting migration %s, %v", mm.Name, err)
@@ -104,13 +125,38 @@ func (mt *MigrationTrigger) cleanMigrations(ctx context.Context, r metav1.APIRes
 	return nil
 }
 
-func (mt *MigrationTrigger) launchMigration(ctx context.Context, resource migrationv1alpha1.GroupVersionResource) error {
+// launchedByTrigger returns true if the trigger launched the migration, which
+// it names after the storageState of the resource.
+func launchedByTrigger(m *migrationv1alpha1.StorageVersionMigration) bool {
+	return m.GenerateName == controller.StorageStateName(m.Spec.Resource)+"-"
+}
+
+// forgetResource removes the storageState and the storageVersionMigrations
+// the trigger launched for a resource it no longer migrates, so that they do
+// not report a stale state of the resource.
+func (mt *MigrationTrigger) forgetResource(ctx context.Context, r metav1.APIResource) error {
+	if err := mt.cleanMigrations(ctx, r, true); err != nil {
+		return err
+	}
+	name := controller.StorageStateName(toGroupResource(r))
+	if _, exists, err := mt.storageStateInformer.GetIndexer().GetByKey(name); err != nil || !exists {
+		return err
+	}
+	err := mt.client.MigrationV1alpha1().StorageStates().Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (mt *MigrationTrigger) launchMigration(ctx context.Context, resource migrationv1alpha1.GroupVersionResource, storageVersionHash string) error {
 	m := &migrationv1alpha1.StorageVersionMigration{
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: storageStateName(resource) + "-",
+			GenerateName: controller.StorageStateName(resource) + "-",
 		},
 		Spec: migrationv1alpha1.StorageVersionMigrationSpec{
-			Resource: resource,
+			Resource:                 resource,
+			TargetStorageVersionHash: storageVersionHash,
 		},
 	}
 	_, err := mt.client.MigrationV1alpha1().StorageVersionMigrations().Create(ctx, m, metav1.CreateOptions{})
@@ -119,17 +165,17 @@ func (mt *MigrationTrigger) launchMigration(ctx context.Context, resource migrat
 
 // relaunchMigration cleans existing migrations for the resource, and launch a new one.
 func (mt *MigrationTrigger) relaunchMigration(ctx context.Context, r metav1.APIResource) error {
-	if err := mt.cleanMigrations(ctx, r); err != nil {
+	if err := mt.cleanMigrations(ctx, r, false); err != nil {
 		return err
 	}
-	return mt.launchMigration(ctx, toGroupResource(r))
+	return mt.launchMigration(ctx, toGroupResource(r), r.StorageVersionHash)
 
 }
 
 func (mt *MigrationTrigger) newStorageState(r metav1.APIResource) *migrationv1alpha1.StorageState {
 	return &migrationv1alpha1.StorageState{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: storageStateName(toGroupResource(r)),
+			Name: controller.StorageStateName(toGroupResource(r)),
 		},
 		Spec: migrationv1alpha1.StorageStateSpec{
 			Resource: migrationv1alpha1.GroupResource{
@@ -140,12 +186,15 @@ func (mt *MigrationTrigger) newStorageState(r metav1.APIResource) *migrationv1al
 	}
 }
 
-func (mt *MigrationTrigger) updateStorageState(ctx context.Context, currentHash string, r metav1.APIResource) error {
+// updateStorageState records the current storage version of the resource,
+// and the storage versions of the API servers if they disagree. An empty
+// currentHash leaves the current storage version unchanged.
+func (mt *MigrationTrigger) updateStorageState(ctx context.Context, currentHash string, serverVersions []migrationv1alpha1.ServerStorageVersion, r metav1.APIResource) error {
 	// We will retry on any error, because failing to update the
 	// heartbeat of the storageState can lead to redo migration, which is
 	// costly.
 	return wait.ExponentialBackoff(backoff, func() (bool, error) {
-		ss, err := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, storageStateName(toGroupResource(r)), metav1.GetOptions{})
+		ss, err := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, controller.StorageStateName(toGroupResource(r)), metav1.GetOptions{})
 		if err != nil && !errors.IsNotFound(err) {
 			utilruntime.HandleError(err)
 			return false, nil
@@ -160,7 +209,7 @@ func (mt *MigrationTrigger) updateStorageState(ctx context.Context, currentHash
 				return false, nil
 			}
 		}
-		if ss.Status.CurrentStorageVersionHash != currentHash {
+		if len(currentHash) > 0 && ss.Status.CurrentStorageVersionHash != currentHash {
 			ss.Status.CurrentStorageVersionHash = currentHash
 			if len(ss.Status.PersistedStorageVersionHashes) == 0 {
 				ss.Status.PersistedStorageVersionHashes = []string{migrationv1alpha1.Unknown}
@@ -168,7 +217,8 @@ func (mt *MigrationTrigger) updateStorageState(ctx context.Context, currentHash
 				ss.Status.PersistedStorageVersionHashes = append(ss.Status.PersistedStorageVersionHashes, currentHash)
 			}
 		}
-		ss.Status.LastHeartbeatTime = mt.heartbeat
+		ss.Status.LastHeartbeatTime = mt.lastHeartbeat()
+		ss.Status.ServerStorageVersions = serverVersions
 		_, err = mt.client.MigrationV1alpha1().StorageStates().UpdateStatus(ctx, ss, metav1.UpdateOptions{})
 		if err != nil {
 			utilruntime.HandleError(err)
@@ -179,7 +229,34 @@ func (mt *MigrationTrigger) updateStorageState(ctx context.Context, currentHash
 }
 
 func (mt *MigrationTrigger) staleStorageState(ss *migrationv1alpha1.StorageState) bool {
-	return ss.Status.LastHeartbeatTime.Add(2 * discoveryPeriod).Before(mt.heartbeat.Time)
+	return ss.Status.LastHeartbeatTime.Add(2 * mt.discoveryPeriod).Before(mt.lastHeartbeat().Time)
+}
+
+// lastHeartbeat returns the time of the last discovery.
+func (mt *MigrationTrigger) lastHeartbeat() metav1.Time {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	return mt.heartbeat
+}
+
+// isExcluded returns true if the resource has been forgotten because the
+// policy excludes it.
+func (mt *MigrationTrigger) isExcluded(gr schema.GroupResource) bool {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	return mt.excluded.Has(gr.String())
+}
+
+// setExcluded records whether the resource has been forgotten because the
+// policy excludes it.
+func (mt *MigrationTrigger) setExcluded(gr schema.GroupResource, excluded bool) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	if excluded {
+		mt.excluded.Insert(gr.String())
+	} else {
+		mt.excluded.Delete(gr.String())
+	}
 }
 
 func (mt *MigrationTrigger) processDiscoveryResource(ctx context.Context, r metav1.APIResource) {
@@ -188,7 +265,34 @@ func (mt *MigrationTrigger) processDiscoveryResource(ctx context.Context, r meta
 		klog.V(2).Infof("ignored resource %s/%s because its storageVersionHash is empty", r.Group, r.Name)
 		return
 	}
-	ss, getErr := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, storageStateName(toGroupResource(r)), metav1.GetOptions{})
+	gr := schema.GroupResource{Group: r.Group, Resource: r.Name}
+	// The discovery, the group workers and the storage version workers
+	// might process the same resource at the same time.
+	unlock := mt.resources.lock(gr)
+	defer unlock()
+	if !mt.policy.Allows(gr) {
+		klog.V(4).Infof("ignored resource %s/%s because the policy excludes it", r.Group, r.Name)
+		if mt.isExcluded(gr) {
+			return
+		}
+		if err := mt.forgetResource(ctx, r); err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		mt.setExcluded(gr, true)
+		return
+	}
+	mt.setExcluded(gr, false)
+	hash, serverVersions := mt.storageVersionHash(r)
+	if len(serverVersions) > 0 {
+		// Launching a migration now could migrate objects to a
+		// storage version some API servers are about to stop writing.
+		klog.V(2).Infof("waiting for the API servers to agree on the storage version of %s/%s: %v", r.Group, r.Name, serverVersions)
+		mt.updateStorageState(ctx, "", serverVersions, r)
+		return
+	}
+	r.StorageVersionHash = hash
+	ss, getErr := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, controller.StorageStateName(toGroupResource(r)), metav1.GetOptions{})
 	if getErr != nil && !errors.IsNotFound(getErr) {
 		utilruntime.HandleError(getErr)
 		return
@@ -200,7 +304,7 @@ func (mt *MigrationTrigger) processDiscoveryResource(ctx context.Context, r meta
 	relaunchMigration := stale || !found || storageVersionChanged || needsMigration
 
 	if stale {
-		if err := mt.client.MigrationV1alpha1().StorageStates().Delete(ctx, storageStateName(toGroupResource(r)), metav1.DeleteOptions{}); err != nil {
+		if err := mt.client.MigrationV1alpha1().StorageStates().Delete(ctx, controller.StorageStateName(toGroupResource(r)), metav1.DeleteOptions{}); err != nil {
 			utilruntime.HandleError(err)
 			return
 		}
@@ -214,7 +318,7 @@ func (mt *MigrationTrigger) processDiscoveryResource(ctx context.Context, r meta
 	}
 
 	// always update status.heartbeat, sometimes update the version hashes.
-	mt.updateStorageState(ctx, r.StorageVersionHash, r)
+	mt.updateStorageState(ctx, r.StorageVersionHash, nil, r)
 }
 func (mt *MigrationTrigger) isMigrated(ss *migrationv1alpha1.StorageState) bool {
 	if len(ss.Status.PersistedStorageVersionHashes) != 1 {
@@ -232,11 +336,37 @@ func (mt *MigrationTrigger) hasPendingOrRunningMigration(r metav1.APIResource) b
 	}
 	for _, migration := range migrations {
 		m := migration.(*migrationv1alpha1.StorageVersionMigration)
-		if controller.HasCondition(m, migrationv1alpha1.MigrationSucceeded) || controller.HasCondition(m, migrationv1alpha1.MigrationFailed) {
+		if controller.IsCompleted(m) && !controller.WillRetry(m) {
 			continue
 		}
-		// migration is running or pending
+		// migration is running or pending, or has failed and will be retried
 		return true
 	}
 	return false
 }
+
+// resourceLocks serializes processing each resource, without holding up the
+// other resources.
+type resourceLocks struct {
+	sync.Mutex
+	locks map[schema.GroupResource]*sync.Mutex
+}
+
+func newResourceLocks() *resourceLocks {
+	return &resourceLocks{locks: make(map[schema.GroupResource]*sync.Mutex)}
+}
+
+// lock waits until no one else processes the resource, and returns the
+// function that releases it. The locks of the resources are kept, there are
+// as few of them as the resources of the cluster.
+func (l *resourceLocks) lock(gr schema.GroupResource) func() {
+	l.Lock()
+	m, ok := l.locks[gr]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[gr] = m
+	}
+	l.Unlock()
+	m.Lock()
+	return m.Unlock
+}
@@ -22,12 +22,14 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/discovery"
 	fakediscovery "k8s.io/client-go/discovery/fake"
 	core "k8s.io/client-go/testing"
@@ -35,6 +37,9 @@ import (
 
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/typed/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/policy"
 )
 
 func TestProcessDiscoveryResource(t *testing.T) {
@@ -183,6 +188,157 @@ func TestProcessDiscoveryResourceStorageMigrationMissing(t *testing.T) {
 	verifyStorageStateUpdate(t, actions[len(actions)-1], trigger.heartbeat, discoveredResource.StorageVersionHash, []string{v1alpha1.Unknown})
 }
 
+func TestProcessDiscoveryResourceExcludedByPolicy(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		storageMigration(withGenerateName("pods-")),
+		storageMigration(withName("manual")),
+		storageState(withStaleHeartbeat()),
+	)
+	trigger := NewMigrationTrigger(client, WithPolicy(&policy.Policy{
+		Exclude: []policy.Rule{{Groups: []string{""}, Resources: []string{"pods"}}},
+	}))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go trigger.migrationInformer.Run(stopCh)
+	go trigger.storageStateInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, trigger.migrationInformer.HasSynced, trigger.storageStateInformer.HasSynced) {
+		t.Fatal("unable to sync caches")
+	}
+	trigger.heartbeat = metav1.Now()
+	client.ClearActions()
+	trigger.processDiscoveryResource(context.Background(), newAPIResource())
+
+	var deleted []string
+	for _, a := range client.Actions() {
+		switch a := a.(type) {
+		case core.DeleteAction:
+			deleted = append(deleted, a.GetResource().Resource+"/"+a.GetName())
+		case core.CreateAction, core.UpdateAction:
+			t.Errorf("unexpected action %v", a)
+		}
+	}
+	expected := []string{"storageversionmigrations/pods-abcde", "storagestates/pods"}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("expected to delete %v, got %v", expected, deleted)
+	}
+
+	// The excluded resource is only forgotten once.
+	client.ClearActions()
+	trigger.processDiscoveryResource(context.Background(), newAPIResource())
+	for _, a := range client.Actions() {
+		t.Errorf("unexpected action %v", a)
+	}
+}
+
+func TestProcessDiscoveryResourceExcludedWithoutStorageState(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	trigger := NewMigrationTrigger(client, WithPolicy(&policy.Policy{
+		Exclude: []policy.Rule{{Groups: []string{""}, Resources: []string{"pods"}}},
+	}))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go trigger.migrationInformer.Run(stopCh)
+	go trigger.storageStateInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, trigger.migrationInformer.HasSynced, trigger.storageStateInformer.HasSynced) {
+		t.Fatal("unable to sync caches")
+	}
+	trigger.heartbeat = metav1.Now()
+	client.ClearActions()
+	trigger.processDiscoveryResource(context.Background(), newAPIResource())
+	for _, a := range client.Actions() {
+		t.Errorf("unexpected action %v", a)
+	}
+}
+
+func TestProcessDiscoveryResourceAllowsAllByDefault(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	trigger := NewMigrationTrigger(client)
+	trigger.heartbeat = metav1.Now()
+	r := newAPIResource()
+	r.Name = "events"
+	trigger.processDiscoveryResource(context.Background(), r)
+	created := false
+	for _, a := range client.Actions() {
+		if c, ok := a.(core.CreateAction); ok && c.GetResource().Resource == "storageversionmigrations" {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected a migration of events, got actions %v", client.Actions())
+	}
+}
+
+func TestProcessDiscoveryResourceDoesNotWaitForOtherResources(t *testing.T) {
+	client := &blockingClientset{
+		Clientset: fake.NewSimpleClientset(),
+		name:      "pods",
+		blocked:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	trigger := NewMigrationTrigger(client)
+	trigger.heartbeat = metav1.Now()
+	podsDone := make(chan struct{})
+	go func() {
+		defer close(podsDone)
+		trigger.processDiscoveryResource(context.Background(), newAPIResource())
+	}()
+	<-client.blocked
+
+	events := newAPIResource()
+	events.Name = "events"
+	eventsDone := make(chan struct{})
+	go func() {
+		defer close(eventsDone)
+		trigger.processDiscoveryResource(context.Background(), events)
+	}()
+	select {
+	case <-eventsDone:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Error("expected events to be processed while pods is")
+	}
+	close(client.release)
+	<-podsDone
+}
+
+// blockingClientset blocks getting the storage state with the given name
+// until release is closed.
+type blockingClientset struct {
+	*fake.Clientset
+	name    string
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingClientset) MigrationV1alpha1() migrationv1alpha1.MigrationV1alpha1Interface {
+	return &blockingMigrationV1alpha1{MigrationV1alpha1Interface: c.Clientset.MigrationV1alpha1(), c: c}
+}
+
+type blockingMigrationV1alpha1 struct {
+	migrationv1alpha1.MigrationV1alpha1Interface
+	c *blockingClientset
+}
+
+func (m *blockingMigrationV1alpha1) StorageStates() migrationv1alpha1.StorageStateInterface {
+	return &blockingStorageStates{StorageStateInterface: m.MigrationV1alpha1Interface.StorageStates(), c: m.c}
+}
+
+type blockingStorageStates struct {
+	migrationv1alpha1.StorageStateInterface
+	c *blockingClientset
+}
+
+func (s *blockingStorageStates) Get(ctx context.Context, name string, opts metav1.GetOptions) (*v1alpha1.StorageState, error) {
+	if name == s.c.name {
+		select {
+		case <-s.c.blocked:
+		default:
+			close(s.c.blocked)
+		}
+		<-s.c.release
+	}
+	return s.StorageStateInterface.Get(ctx, name, opts)
+}
+
 func TestProcessDiscoveryResourceStorageMigrationFailed(t *testing.T) {
 	client := fake.NewSimpleClientset(
 		storageMigration(withFailedCondition()),
@@ -211,7 +367,7 @@ func TestProcessDiscoveryResourceStorageMigrationFailed(t *testing.T) {
 func storageState(options ...func(*v1alpha1.StorageState)) *v1alpha1.StorageState {
 	ss := &v1alpha1.StorageState{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: storageStateName(v1alpha1.GroupVersionResource{Resource: "pods"}),
+			Name: controller.StorageStateName(v1alpha1.GroupVersionResource{Resource: "pods"}),
 		},
 		Spec: v1alpha1.StorageStateSpec{
 			Resource: v1alpha1.GroupResource{Resource: "pods"},
@@ -225,13 +381,13 @@ func storageState(options ...func(*v1alpha1.StorageState)) *v1alpha1.StorageStat
 
 func withFreshHeartbeat() func(*v1alpha1.StorageState) {
 	return func(ss *v1alpha1.StorageState) {
-		ss.Status.LastHeartbeatTime = metav1.NewTime(metav1.Now().Add(-1 * discoveryPeriod))
+		ss.Status.LastHeartbeatTime = metav1.NewTime(metav1.Now().Add(-1 * DefaultDiscoveryPeriod))
 	}
 }
 
 func withStaleHeartbeat() func(*v1alpha1.StorageState) {
 	return func(ss *v1alpha1.StorageState) {
-		ss.Status.LastHeartbeatTime = metav1.NewTime(metav1.Now().Add(-3 * discoveryPeriod))
+		ss.Status.LastHeartbeatTime = metav1.NewTime(metav1.Now().Add(-3 * DefaultDiscoveryPeriod))
 	}
 }
 
@@ -281,6 +437,13 @@ func storageMigration(options ...func(*v1alpha1.StorageVersionMigration)) *v1alp
 	return m
 }
 
+func withGenerateName(prefix string) func(*v1alpha1.StorageVersionMigration) {
+	return func(m *v1alpha1.StorageVersionMigration) {
+		m.GenerateName = prefix
+		m.Name = prefix + "abcde"
+	}
+}
+
 func withName(name string) func(*v1alpha1.StorageVersionMigration) {
 	return func(migration *v1alpha1.StorageVersionMigration) {
 		migration.Name = name
@@ -330,7 +493,10 @@ func verifyCleanupAndLaunch(t *testing.T, actions []core.Action) {
 			t.Fatalf("unexpected name %s", d.GetName())
 		}
 	}
-	expectCreateStorageVersionMigrationAction(t, actions[3])
+	m := expectCreateStorageVersionMigrationAction(t, actions[3])
+	if e, a := newAPIResource().StorageVersionHash, m.Spec.TargetStorageVersionHash; e != a {
+		t.Fatalf("expected target storage version hash %s, got %s", e, a)
+	}
 }
 
 func expectCreateStorageVersionMigrationAction(t *testing.T, action core.Action) *v1alpha1.StorageVersionMigration {
@@ -0,0 +1,146 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+)
+
+const (
+	// DefaultHistoryLimit is the default number of completed migrations
+	// recorded in the history of a storage state.
+	DefaultHistoryLimit = 10
+	// The history of the storage states is trimmed every historyGCPeriod.
+	historyGCPeriod = time.Hour
+)
+
+// WithHistoryLimit sets the number of completed migrations recorded in the
+// history of a storage state. Zero disables the history.
+func WithHistoryLimit(limit int) Option {
+	return func(mt *MigrationTrigger) {
+		mt.historyLimit = limit
+	}
+}
+
+// outcome returns the condition a completed migration completed with.
+func outcome(m *migrationv1alpha1.StorageVersionMigration) (migrationv1alpha1.MigrationCondition, bool) {
+	for _, c := range m.Status.Conditions {
+		switch c.Type {
+		case migrationv1alpha1.MigrationSucceeded, migrationv1alpha1.MigrationSucceededWithErrors, migrationv1alpha1.MigrationFailed:
+			if controller.HasCondition(m, c.Type) {
+				return c, true
+			}
+		}
+	}
+	return migrationv1alpha1.MigrationCondition{}, false
+}
+
+// recordHistory records a completed migration in the history of the storage
+// state of its resource, unless it is recorded already.
+func (mt *MigrationTrigger) recordHistory(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) error {
+	if mt.historyLimit <= 0 {
+		return nil
+	}
+	c, ok := outcome(m)
+	if !ok {
+		return nil
+	}
+	client := mt.client.MigrationV1alpha1().StorageStates()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ss, err := client.Get(ctx, controller.StorageStateName(m.Spec.Resource), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			// The next discovery routine creates the storage
+			// state, with a new migration.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, r := range ss.Status.History {
+			if r.MigrationName == m.Name {
+				return nil
+			}
+		}
+		to := m.Spec.TargetStorageVersionHash
+		if len(to) == 0 {
+			to = ss.Status.CurrentStorageVersionHash
+		}
+		ss.Status.History = append(ss.Status.History, migrationv1alpha1.MigrationRecord{
+			MigrationName:            m.Name,
+			FromStorageVersionHashes: ss.Status.PersistedStorageVersionHashes,
+			ToStorageVersionHash:     to,
+			Scoped:                   controller.IsScoped(m),
+			StartTime:                m.CreationTimestamp,
+			FinishTime:               c.LastUpdateTime,
+			Outcome:                  c.Type,
+		})
+		_, err = client.UpdateStatus(ctx, ss, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// collectHistory trims the history of all storage states to the
+// historyLimit latest migrations.
+func (mt *MigrationTrigger) collectHistory(ctx context.Context) {
+	limit := mt.historyLimit
+	if limit < 0 {
+		limit = 0
+	}
+	client := mt.client.MigrationV1alpha1().StorageStates()
+	l, err := client.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, ss := range l.Items {
+		if len(ss.Status.History) <= limit {
+			continue
+		}
+		name := ss.Name
+		err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			ss, err := client.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			n := len(ss.Status.History)
+			if n <= limit {
+				return nil
+			}
+			ss.Status.History = ss.Status.History[n-limit:]
+			if len(ss.Status.History) == 0 {
+				ss.Status.History = nil
+			}
+			_, err = client.UpdateStatus(ctx, ss, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			utilruntime.HandleError(err)
+			continue
+		}
+		klog.V(4).Infof("trimmed the migration history of %s", name)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+)
+
+func getStorageState(t *testing.T, client *fake.Clientset) *v1alpha1.StorageState {
+	ss, err := client.MigrationV1alpha1().StorageStates().Get(context.Background(), controller.StorageStateName(v1alpha1.GroupVersionResource{Resource: "pods"}), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func TestRecordHistory(t *testing.T) {
+	client := fake.NewSimpleClientset(storageState(
+		withFreshHeartbeat(),
+		withCurrentVersion("newhash"),
+		withPersistedVersions("oldhash", "newhash"),
+	))
+	trigger := NewMigrationTrigger(client)
+	m := storageMigration(withSucceededCondition(), withTargetStorageVersionHash("newhash"))
+	// Processing the migration again does not record it twice.
+	for i := 0; i < 2; i++ {
+		if err := trigger.processMigration(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss := getStorageState(t, client)
+	expected := []v1alpha1.MigrationRecord{
+		{
+			MigrationName:            m.Name,
+			FromStorageVersionHashes: []string{"oldhash", "newhash"},
+			ToStorageVersionHash:     "newhash",
+			Outcome:                  v1alpha1.MigrationSucceeded,
+		},
+	}
+	if !reflect.DeepEqual(expected, ss.Status.History) {
+		t.Errorf("expected history %#v, got %#v", expected, ss.Status.History)
+	}
+	if e, a := []string{"newhash"}, ss.Status.PersistedStorageVersionHashes; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected persisted storage versions %v, got %v", e, a)
+	}
+}
+
+func TestRecordHistoryPendingRetry(t *testing.T) {
+	client := fake.NewSimpleClientset(storageState(withFreshHeartbeat(), withCurrentVersion("newhash")))
+	trigger := NewMigrationTrigger(client)
+	m := storageMigration(withFailedCondition())
+	m.Spec.RetryPolicy = &v1alpha1.RetryPolicy{MaxRetries: 1}
+	if err := trigger.processMigration(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if history := getStorageState(t, client).Status.History; len(history) != 0 {
+		t.Errorf("expected no history before the retries are exhausted, got %v", history)
+	}
+}
+
+func TestCollectHistory(t *testing.T) {
+	for _, tc := range []struct {
+		limit    int
+		expected []string
+	}{
+		{limit: 2, expected: []string{"b", "c"}},
+		{limit: 5, expected: []string{"a", "b", "c"}},
+		{limit: 0},
+	} {
+		ss := storageState(withFreshHeartbeat())
+		for _, name := range []string{"a", "b", "c"} {
+			ss.Status.History = append(ss.Status.History, v1alpha1.MigrationRecord{MigrationName: name, Outcome: v1alpha1.MigrationSucceeded})
+		}
+		client := fake.NewSimpleClientset(ss)
+		trigger := NewMigrationTrigger(client, WithHistoryLimit(tc.limit))
+		trigger.collectHistory(context.Background())
+
+		var names []string
+		for _, r := range getStorageState(t, client).Status.History {
+			names = append(names, r.MigrationName)
+		}
+		if !reflect.DeepEqual(tc.expected, names) {
+			t.Errorf("limit %d: expected %v, got %v", tc.limit, tc.expected, names)
+		}
+	}
+}
@@ -21,29 +21,108 @@ import (
 	"fmt"
 	"reflect"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
 	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
 )
 
-func storageStateName(resource migrationv1alpha1.GroupVersionResource) string {
-	// TODO: add this rule to the CRD validation
-	// TODO: we might use ResourceID as the name in the future.
-	if resource.Group == "" {
-		return resource.Resource
+// maxVerificationKeys bounds the number of keys of stale objects the
+// condition of a migration whose verification failed lists.
+const maxVerificationKeys = 5
+
+// verifyStorage returns true if etcd only contains objects of the migrated
+// resource in the storage version the migration migrated them to. It returns
+// an error if the verification could not be carried out, in which case it is
+// retried. If the verification fails, it records the failure on the migration.
+func (mt *MigrationTrigger) verifyStorage(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) (bool, error) {
+	ss, err := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, controller.StorageStateName(m.Spec.Resource), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The next discovery routine creates the storage state.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	gr := schema.GroupResource{Group: m.Spec.Resource.Group, Resource: m.Spec.Resource.Resource}
+	// Migrations created before they recorded their target storage
+	// version migrated to the current one.
+	hash := m.Spec.TargetStorageVersionHash
+	if len(hash) == 0 {
+		hash = ss.Status.CurrentStorageVersionHash
+	}
+	result, err := mt.verifier.Verify(ctx, gr, hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to verify the storage of %s: %v", gr, err)
+	}
+	if result.Objects == 0 && m.Status.Progress != nil && m.Status.Progress.Migrated > 0 {
+		return false, mt.recordVerificationFailure(ctx, m, fmt.Sprintf("the migration migrated %d objects, but none was found in storage, the resource might be stored under an unknown key prefix", m.Status.Progress.Migrated))
+	}
+	if !result.Verified() {
+		klog.Warningf("%s: stale objects %v, undecodable objects %v", gr, result.StaleKeys, result.UndecodableKeys)
+		return false, mt.recordVerificationFailure(ctx, m, fmt.Sprintf("%d of %d objects are stored in another storage version than %s (%v), and the storage version of %d objects is unknown (%v)",
+			result.Stale, result.Objects, hash, firstKeys(result.StaleKeys), result.Undecodable, firstKeys(result.UndecodableKeys)))
+	}
+	if result.Encrypted > 0 {
+		// The storage version of objects encrypted at rest cannot be
+		// told without the encryption keys, so the migration is
+		// trusted for them.
+		klog.Warningf("the storage version of %d of %d objects of %s is not verified: they are encrypted at rest", result.Encrypted, result.Objects, gr)
 	}
-	return resource.Resource + "." + resource.Group
+	klog.V(2).Infof("verified that the %d objects of %s that are not encrypted are stored in the current storage version", result.Objects-result.Encrypted, gr)
+	return true, nil
 }
 
-func (mt *MigrationTrigger) markStorageStateSucceeded(ctx context.Context, resource migrationv1alpha1.GroupVersionResource) error {
+// recordVerificationFailure records on the migration why the verification of
+// the storage failed. The persisted storage versions of the resource are not
+// refined, so the discovery routine launches a new migration of the resource.
+func (mt *MigrationTrigger) recordVerificationFailure(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration, message string) error {
+	klog.Warningf("not refining the persisted storage versions of %s after migration %s: %s", controller.StorageStateName(m.Spec.Resource), m.Name, message)
+	client := mt.client.MigrationV1alpha1().StorageVersionMigrations()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := client.Get(ctx, m.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if controller.HasCondition(latest, migrationv1alpha1.MigrationVerificationFailed) {
+			return nil
+		}
+		latest.Status.Conditions = append(latest.Status.Conditions, migrationv1alpha1.MigrationCondition{
+			Type:           migrationv1alpha1.MigrationVerificationFailed,
+			Status:         corev1.ConditionTrue,
+			LastUpdateTime: metav1.Now(),
+			Message:        message,
+		})
+		_, err = client.UpdateStatus(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// firstKeys returns the first keys of stale objects, for a condition message.
+func firstKeys(keys []string) []string {
+	if len(keys) > maxVerificationKeys {
+		return keys[:maxVerificationKeys]
+	}
+	return keys
+}
+
+// markStorageStateSucceeded records that the resource is only stored in the
+// storage version the migration migrated it to.
+func (mt *MigrationTrigger) markStorageStateSucceeded(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) error {
+	resource := m.Spec.Resource
 	// We will retry on any error. Migrating a resource takes a long time.
 	// It would be a pity to give up just because of an update error.
 	return wait.ExponentialBackoff(backoff, func() (bool, error) {
-		ss, err := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, storageStateName(resource), metav1.GetOptions{})
+		ss, err := mt.client.MigrationV1alpha1().StorageStates().Get(ctx, controller.StorageStateName(resource), metav1.GetOptions{})
 		if err != nil && !errors.IsNotFound(err) {
 			utilruntime.HandleError(err)
 			return false, nil
@@ -55,6 +134,14 @@ func (mt *MigrationTrigger) markStorageStateSucceeded(ctx context.Context, resou
 			// discovery routine to create the storage state.
 			return true, nil
 		}
+		// If the storage version changed after the migration was
+		// created, objects might have been written in the new storage
+		// version while others were migrated to the old one. The
+		// discovery routine launches a new migration.
+		if target := m.Spec.TargetStorageVersionHash; len(target) > 0 && target != ss.Status.CurrentStorageVersionHash {
+			klog.V(2).Infof("not refining the persisted storage versions of %s: migration %s migrated to storage version %s, but the current storage version is %s", controller.StorageStateName(resource), m.Name, target, ss.Status.CurrentStorageVersionHash)
+			return true, nil
+		}
 		ss.Status.PersistedStorageVersionHashes = []string{ss.Status.CurrentStorageVersionHash}
 		_, err = mt.client.MigrationV1alpha1().StorageStates().UpdateStatus(ctx, ss, metav1.UpdateOptions{})
 		if err != nil {
@@ -67,9 +154,32 @@ func (mt *MigrationTrigger) markStorageStateSucceeded(ctx context.Context, resou
 
 func (mt *MigrationTrigger) processMigration(ctx context.Context, m *migrationv1alpha1.StorageVersionMigration) error {
 	klog.V(2).Infof("processing migration %#v", m)
+	if controller.IsCompleted(m) && !controller.WillRetry(m) {
+		if err := mt.recordHistory(ctx, m); err != nil {
+			return fmt.Errorf("failed to record migration %s in the history: %v", m.Name, err)
+		}
+	}
 	switch {
+	case controller.IsScoped(m):
+		// Objects outside the scope of the migration might still be
+		// encoded in the old storage versions.
+		return nil
+	case controller.HasCondition(m, migrationv1alpha1.MigrationVerificationFailed):
+		// The discovery routine launches a new migration.
+		return nil
 	case controller.HasCondition(m, migrationv1alpha1.MigrationSucceeded):
-		return mt.markStorageStateSucceeded(ctx, m.Spec.Resource)
+		if mt.verifier != nil {
+			verified, err := mt.verifyStorage(ctx, m)
+			if err != nil || !verified {
+				return err
+			}
+		}
+		return mt.markStorageStateSucceeded(ctx, m)
+	case controller.HasCondition(m, migrationv1alpha1.MigrationSucceededWithErrors):
+		// Some objects might still be encoded in the old storage
+		// versions, so the persisted storage versions cannot be
+		// refined.
+		return nil
 	case controller.HasCondition(m, migrationv1alpha1.MigrationFailed):
 		// The migration controller should have already tried its best
 		// to complete the migration before marking the migration as
@@ -81,7 +191,7 @@ func (mt *MigrationTrigger) processMigration(ctx context.Context, m *migrationv1
 }
 
 func (mt *MigrationTrigger) processQueue(ctx context.Context, obj interface{}) error {
-	item, ok := obj.(*queueItem)
+	item, ok := obj.(queueItem)
 	if !ok {
 		return fmt.Errorf("expected queueItem, got %#v", reflect.TypeOf(obj))
 	}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/verifier"
+)
+
+func TestMarkStorageStateSucceeded(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		targetHash        string
+		expectedPersisted []string
+	}{
+		{
+			name:              "target is the current storage version",
+			targetHash:        "newhash",
+			expectedPersisted: []string{"newhash"},
+		},
+		{
+			name:              "storage version changed after the migration was created",
+			targetHash:        "oldhash",
+			expectedPersisted: []string{"oldhash", "newhash"},
+		},
+		{
+			name:              "no target",
+			expectedPersisted: []string{"newhash"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(storageState(
+				withFreshHeartbeat(),
+				withCurrentVersion("newhash"),
+				withPersistedVersions("oldhash", "newhash"),
+			))
+			trigger := NewMigrationTrigger(client)
+			m := storageMigration(withSucceededCondition(), withTargetStorageVersionHash(tc.targetHash))
+			if err := trigger.processMigration(context.Background(), m); err != nil {
+				t.Fatal(err)
+			}
+			ss, err := client.MigrationV1alpha1().StorageStates().Get(context.Background(), controller.StorageStateName(m.Spec.Resource), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, a := tc.expectedPersisted, ss.Status.PersistedStorageVersionHashes; !reflect.DeepEqual(e, a) {
+				t.Errorf("expected persisted storage versions %v, got %v", e, a)
+			}
+		})
+	}
+}
+
+// podsKV is a verifier.KV that stores pods encoded in the given versions.
+type podsKV []string
+
+func (kv podsKV) List(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	if prefix != verifier.DefaultPrefix+"/pods/" {
+		return nil
+	}
+	for i, version := range kv {
+		value := []byte(`{"apiVersion":"` + version + `","kind":"Pod","metadata":{"name":"x"}}`)
+		if err := fn(prefix+"default/pod"+string(rune('a'+i)), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestVerifyStorageAgainstTargetHash(t *testing.T) {
+	target := migrator.StorageVersionHash("", "v1", "Pod")
+	for _, tc := range []struct {
+		name              string
+		currentHash       string
+		expectedPersisted []string
+	}{
+		{
+			name:              "target is the current storage version",
+			currentHash:       target,
+			expectedPersisted: []string{target},
+		},
+		{
+			name:              "storage version changed after the migration was created",
+			currentHash:       "newhash",
+			expectedPersisted: []string{"oldhash", "newhash"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := storageMigration(withSucceededCondition(), withTargetStorageVersionHash(target))
+			client := fake.NewSimpleClientset(m, storageState(
+				withFreshHeartbeat(),
+				withCurrentVersion(tc.currentHash),
+				withPersistedVersions("oldhash", tc.currentHash),
+			))
+			trigger := NewMigrationTrigger(client, WithVerifier(verifier.NewVerifier(podsKV{"v1", "v1"}, "")))
+			if err := trigger.processMigration(context.Background(), m); err != nil {
+				t.Fatal(err)
+			}
+			ss, err := client.MigrationV1alpha1().StorageStates().Get(context.Background(), controller.StorageStateName(m.Spec.Resource), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, a := tc.expectedPersisted, ss.Status.PersistedStorageVersionHashes; !reflect.DeepEqual(e, a) {
+				t.Errorf("expected persisted storage versions %v, got %v", e, a)
+			}
+			latest, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.Background(), m.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if controller.HasCondition(latest, v1alpha1.MigrationVerificationFailed) {
+				t.Errorf("expected the objects stored in the target storage version to verify, got conditions %v", latest.Status.Conditions)
+			}
+		})
+	}
+}
+
+func TestVerifyStorageFailureRelaunchesMigration(t *testing.T) {
+	target := migrator.StorageVersionHash("", "v1", "Pod")
+	m := storageMigration(withSucceededCondition(), withTargetStorageVersionHash(target))
+	client := fake.NewSimpleClientset(m, storageState(
+		withFreshHeartbeat(),
+		withCurrentVersion(target),
+		withPersistedVersions("oldhash", target),
+	))
+	trigger := NewMigrationTrigger(client, WithVerifier(verifier.NewVerifier(podsKV{"v1", "v1beta1"}, "")))
+	if err := trigger.processMigration(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := client.MigrationV1alpha1().StorageStates().Get(context.Background(), controller.StorageStateName(m.Spec.Resource), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := []string{"oldhash", target}, ss.Status.PersistedStorageVersionHashes; !reflect.DeepEqual(e, a) {
+		t.Errorf("expected the persisted storage versions to stay %v, got %v", e, a)
+	}
+	failed, err := client.MigrationV1alpha1().StorageVersionMigrations().Get(context.Background(), m.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !controller.HasCondition(failed, v1alpha1.MigrationVerificationFailed) {
+		t.Fatalf("expected the failed verification to be recorded, got conditions %v", failed.Status.Conditions)
+	}
+	if c := failed.Status.Conditions[len(failed.Status.Conditions)-1]; !strings.Contains(c.Message, "1 of 2 objects") || !strings.Contains(c.Message, "default/podb") {
+		t.Errorf("expected the message to count and list the stale objects, got %q", c.Message)
+	}
+
+	// The next discovery launches a new migration.
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go trigger.migrationInformer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, trigger.migrationInformer.HasSynced) {
+		t.Fatal("failed to sync the migration informer")
+	}
+	client.ClearActions()
+	r := newAPIResource()
+	r.StorageVersionHash = target
+	trigger.processDiscoveryResource(context.Background(), r)
+	created := false
+	for _, a := range client.Actions() {
+		if c, ok := a.(core.CreateAction); ok && c.GetResource().Resource == "storageversionmigrations" {
+			created = true
+		}
+	}
+	if !created {
+		t.Errorf("expected a new migration of pods, got actions %v", client.Actions())
+	}
+}
+
+func withSucceededCondition() func(*v1alpha1.StorageVersionMigration) {
+	return func(migration *v1alpha1.StorageVersionMigration) {
+		migration.Status.Conditions = append(migration.Status.Conditions, v1alpha1.MigrationCondition{
+			Type:   v1alpha1.MigrationSucceeded,
+			Status: v1.ConditionTrue,
+		})
+	}
+}
+
+func withTargetStorageVersionHash(hash string) func(*v1alpha1.StorageVersionMigration) {
+	return func(migration *v1alpha1.StorageVersionMigration) {
+		migration.Spec.TargetStorageVersionHash = hash
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	apiserverinternalv1alpha1 "k8s.io/api/apiserverinternal/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	migrationv1alpha1 "sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+)
+
+// WithStorageVersionAPI makes the MigrationTrigger read the storage versions
+// of the resources from the StorageVersion API (internal.apiserver.k8s.io),
+// which reports the storage version of every API server. A migration is only
+// launched once all API servers agree on the storage version. Resources the
+// StorageVersion API does not report, e.g., custom resources, and clusters
+// that do not serve the API, fall back to the storage version hash in the
+// discovery document.
+func WithStorageVersionAPI(c kubernetes.Interface) Option {
+	return func(mt *MigrationTrigger) {
+		mt.kubeClient = c
+		mt.storageVersionInformer = newStorageVersionInformer(c)
+		mt.storageVersionInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    mt.addStorageVersion,
+			UpdateFunc: mt.updateStorageVersion,
+		})
+	}
+}
+
+func newStorageVersionInformer(c kubernetes.Interface) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return c.InternalV1alpha1().StorageVersions().List(context.TODO(), options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return c.InternalV1alpha1().StorageVersions().Watch(context.TODO(), options)
+			},
+		},
+		&apiserverinternalv1alpha1.StorageVersion{},
+		0,
+		cache.Indexers{},
+	)
+}
+
+// servesStorageVersionAPI returns true if the API servers serve the
+// StorageVersion API.
+func (mt *MigrationTrigger) servesStorageVersionAPI() bool {
+	gv := apiserverinternalv1alpha1.SchemeGroupVersion.String()
+	resources, err := mt.kubeClient.Discovery().ServerResourcesForGroupVersion(gv)
+	if err != nil {
+		klog.Warningf("the StorageVersion API is not available, falling back to the discovery document: %v", err)
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "storageversions" {
+			return true
+		}
+	}
+	klog.Warningf("%s does not serve storageversions, falling back to the discovery document", gv)
+	return false
+}
+
+// storageVersionName returns the name of the StorageVersion object of a
+// resource, as named by the API server.
+func storageVersionName(group, resource string) string {
+	if len(group) == 0 {
+		group = "core"
+	}
+	return group + "." + resource
+}
+
+// storageVersionResource is the inverse of storageVersionName.
+func storageVersionResource(name string) (schema.GroupResource, bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return schema.GroupResource{}, false
+	}
+	gr := schema.GroupResource{Group: name[:i], Resource: name[i+1:]}
+	if gr.Group == "core" {
+		gr.Group = ""
+	}
+	return gr, true
+}
+
+// storageVersionHash returns the hash of the storage version the API servers
+// encode the resource in. If the API servers disagree, it returns their
+// storage versions instead.
+func (mt *MigrationTrigger) storageVersionHash(r metav1.APIResource) (string, []migrationv1alpha1.ServerStorageVersion) {
+	if mt.storageVersionInformer == nil {
+		return r.StorageVersionHash, nil
+	}
+	obj, exists, err := mt.storageVersionInformer.GetStore().GetByKey(storageVersionName(r.Group, r.Name))
+	if err != nil {
+		utilruntime.HandleError(err)
+		return r.StorageVersionHash, nil
+	}
+	if !exists {
+		return r.StorageVersionHash, nil
+	}
+	sv, ok := obj.(*apiserverinternalv1alpha1.StorageVersion)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected StorageVersion, got %#v", reflect.TypeOf(obj)))
+		return r.StorageVersionHash, nil
+	}
+	if len(sv.Status.StorageVersions) == 0 {
+		return r.StorageVersionHash, nil
+	}
+	if sv.Status.CommonEncodingVersion == nil {
+		var versions []migrationv1alpha1.ServerStorageVersion
+		for _, v := range sv.Status.StorageVersions {
+			versions = append(versions, migrationv1alpha1.ServerStorageVersion{
+				APIServerID:     v.APIServerID,
+				EncodingVersion: v.EncodingVersion,
+			})
+		}
+		return "", versions
+	}
+	gv, err := schema.ParseGroupVersion(*sv.Status.CommonEncodingVersion)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("unexpected common encoding version of %s: %v", sv.Name, err))
+		return r.StorageVersionHash, nil
+	}
+	// The StorageVersion API does not report the kind objects are
+	// encoded as, which is the kind the resource is served as.
+	return migrator.StorageVersionHash(gv.Group, gv.Version, r.Kind), nil
+}
+
+func (mt *MigrationTrigger) addStorageVersion(obj interface{}) {
+	sv, ok := obj.(*apiserverinternalv1alpha1.StorageVersion)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected StorageVersion, got %#v", reflect.TypeOf(obj)))
+		return
+	}
+	gr, ok := storageVersionResource(sv.Name)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected StorageVersion name %s", sv.Name))
+		return
+	}
+	mt.storageVersionQueue.Add(gr)
+}
+
+func (mt *MigrationTrigger) updateStorageVersion(oldObj, obj interface{}) {
+	old, ok := oldObj.(*apiserverinternalv1alpha1.StorageVersion)
+	if ok && reflect.DeepEqual(old.Status.StorageVersions, obj.(*apiserverinternalv1alpha1.StorageVersion).Status.StorageVersions) {
+		return
+	}
+	mt.addStorageVersion(obj)
+}
+
+func (mt *MigrationTrigger) runStorageVersionWorker(ctx context.Context) {
+	for mt.processNextStorageVersion(ctx) {
+	}
+}
+
+// processNextStorageVersion processes a resource whose storage versions
+// changed, without waiting for the next discovery.
+func (mt *MigrationTrigger) processNextStorageVersion(ctx context.Context) bool {
+	item, quit := mt.storageVersionQueue.Get()
+	if quit {
+		return false
+	}
+	defer mt.storageVersionQueue.Done(item)
+	r, ok := mt.discoveredResource(item.(schema.GroupResource))
+	if !ok {
+		// The resource is processed when it is discovered.
+		return true
+	}
+	mt.processDiscoveryResource(ctx, r)
+	return true
+}
+
+func (mt *MigrationTrigger) discoveredResource(gr schema.GroupResource) (metav1.APIResource, bool) {
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+	r, ok := mt.discovered[gr]
+	return r, ok
+}
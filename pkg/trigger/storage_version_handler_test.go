@@ -0,0 +1,130 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package trigger
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	apiserverinternalv1alpha1 "k8s.io/api/apiserverinternal/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/apis/migration/v1alpha1"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/clients/clientset/fake"
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/controller"
+)
+
+func TestStorageVersionName(t *testing.T) {
+	for _, gr := range []schema.GroupResource{
+		{Resource: "pods"},
+		{Group: "apps", Resource: "deployments"},
+		{Group: "rbac.authorization.k8s.io", Resource: "roles"},
+	} {
+		name := storageVersionName(gr.Group, gr.Resource)
+		actual, ok := storageVersionResource(name)
+		if !ok || actual != gr {
+			t.Errorf("expected %v from %s, got %v", gr, name, actual)
+		}
+	}
+	if e, a := "core.pods", storageVersionName("", "pods"); e != a {
+		t.Errorf("expected %s, got %s", e, a)
+	}
+}
+
+func newStorageVersion(common *string, encodingVersions ...string) *apiserverinternalv1alpha1.StorageVersion {
+	sv := &apiserverinternalv1alpha1.StorageVersion{
+		ObjectMeta: metav1.ObjectMeta{Name: "core.pods"},
+	}
+	for i, v := range encodingVersions {
+		sv.Status.StorageVersions = append(sv.Status.StorageVersions, apiserverinternalv1alpha1.ServerStorageVersion{
+			APIServerID:     string(rune('a' + i)),
+			EncodingVersion: v,
+		})
+	}
+	sv.Status.CommonEncodingVersion = common
+	return sv
+}
+
+func newStorageVersionTrigger(t *testing.T, sv *apiserverinternalv1alpha1.StorageVersion) (*MigrationTrigger, *fake.Clientset) {
+	client := fake.NewSimpleClientset(storageState(
+		withFreshHeartbeat(),
+		withCurrentVersion("oldhash"),
+		withPersistedVersions("oldhash"),
+	))
+	trigger := NewMigrationTrigger(client, WithStorageVersionAPI(kubefake.NewSimpleClientset()))
+	if err := trigger.storageVersionInformer.GetStore().Add(sv); err != nil {
+		t.Fatal(err)
+	}
+	trigger.heartbeat = metav1.Now()
+	return trigger, client
+}
+
+func TestProcessDiscoveryResourceStorageVersionsDisagree(t *testing.T) {
+	trigger, client := newStorageVersionTrigger(t, newStorageVersion(nil, "v1", "v2"))
+	resource := newAPIResource()
+	resource.Kind = "Pod"
+	trigger.processDiscoveryResource(context.Background(), resource)
+
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "create" || a.GetVerb() == "delete" {
+			t.Errorf("unexpected action %v", a)
+		}
+	}
+	ss, err := client.MigrationV1alpha1().StorageStates().Get(context.Background(), controller.StorageStateName(v1alpha1.GroupVersionResource{Resource: "pods"}), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := "oldhash", ss.Status.CurrentStorageVersionHash; e != a {
+		t.Errorf("expected current storage version %s, got %s", e, a)
+	}
+	expected := []v1alpha1.ServerStorageVersion{
+		{APIServerID: "a", EncodingVersion: "v1"},
+		{APIServerID: "b", EncodingVersion: "v2"},
+	}
+	if a := ss.Status.ServerStorageVersions; !reflect.DeepEqual(expected, a) {
+		t.Errorf("expected server storage versions %v, got %v", expected, a)
+	}
+}
+
+func TestProcessDiscoveryResourceStorageVersionsAgree(t *testing.T) {
+	common := "v1"
+	trigger, client := newStorageVersionTrigger(t, newStorageVersion(&common, "v1", "v1"))
+	resource := newAPIResource()
+	resource.Kind = "Pod"
+	trigger.processDiscoveryResource(context.Background(), resource)
+
+	// The hash of pods served by the apiserver.
+	hash := "xPOwRZ+Yhw8="
+	var launched bool
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "create" && a.GetResource().Resource == "storageversionmigrations" {
+			m := expectCreateStorageVersionMigrationAction(t, a)
+			if e, a := hash, m.Spec.TargetStorageVersionHash; e != a {
+				t.Errorf("expected target storage version hash %s, got %s", e, a)
+			}
+			launched = true
+		}
+	}
+	if !launched {
+		t.Errorf("expected a migration to be launched")
+	}
+	actions := client.Actions()
+	verifyStorageStateUpdate(t, actions[len(actions)-1], trigger.heartbeat, hash, []string{"oldhash", hash})
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package verifier
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// listPageSize is the number of keys read from etcd in one request.
+	listPageSize = 500
+	dialTimeout  = 20 * time.Second
+)
+
+// EtcdConfig configures the connection to the etcd of the apiserver.
+type EtcdConfig struct {
+	Servers []string
+	// CAFile, CertFile and KeyFile secure the connection with TLS, if
+	// set.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// NewEtcdClient connects to etcd.
+func NewEtcdClient(config EtcdConfig) (*clientv3.Client, error) {
+	var tlsConfig *tls.Config
+	if len(config.CAFile) > 0 || len(config.CertFile) > 0 || len(config.KeyFile) > 0 {
+		tlsInfo := transport.TLSInfo{
+			TrustedCAFile: config.CAFile,
+			CertFile:      config.CertFile,
+			KeyFile:       config.KeyFile,
+		}
+		var err error
+		tlsConfig, err = tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return clientv3.New(clientv3.Config{
+		Endpoints:   config.Servers,
+		DialTimeout: dialTimeout,
+		TLS:         tlsConfig,
+	})
+}
+
+// NewEtcdKV returns a KV that reads from etcd.
+func NewEtcdKV(client *clientv3.Client) KV {
+	return &etcdKV{client: client}
+}
+
+type etcdKV struct {
+	client clientv3.KV
+}
+
+func (e *etcdKV) List(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	key := prefix
+	// All pages are read at the revision of the first page, so the
+	// listing is consistent.
+	var revision int64
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(listPageSize)}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		resp, err := e.client.Get(ctx, key, opts...)
+		if err != nil {
+			return err
+		}
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+		for _, kv := range resp.Kvs {
+			if err := fn(string(kv.Key), kv.Value); err != nil {
+				return err
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		// Continue right after the last key.
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// pagingKV is a clientv3.KV that returns pageSize keys per Get, and writes
+// a key after every Get, so that pages read at a later revision see it.
+type pagingKV struct {
+	clientv3.KV
+	t        *testing.T
+	pageSize int
+	// revisions maps the keys to the revision they were written at.
+	revisions map[string]int64
+	revision  int64
+	gets      int
+}
+
+func (kv *pagingKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(key, opts...)
+	if e, a := clientv3.GetPrefixRangeEnd("/registry/pods/"), string(op.RangeBytes()); e != a {
+		kv.t.Errorf("expected range end %q, got %q", e, a)
+	}
+	rev := op.Rev()
+	if kv.gets > 0 && rev != 1 {
+		kv.t.Errorf("expected page %d to be read at revision 1, got %d", kv.gets, rev)
+	}
+	if rev == 0 {
+		rev = kv.revision
+	}
+	var keys []string
+	for k, r := range kv.revisions {
+		if k >= key && k < string(op.RangeBytes()) && r <= rev {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	resp := &clientv3.GetResponse{Header: &pb.ResponseHeader{Revision: kv.revision}}
+	if len(keys) > kv.pageSize {
+		keys = keys[:kv.pageSize]
+		resp.More = true
+	}
+	for _, k := range keys {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(k)})
+	}
+	kv.gets++
+	kv.revision++
+	kv.revisions[fmt.Sprintf("/registry/pods/default/new%d", kv.gets)] = kv.revision
+	return resp, nil
+}
+
+func TestEtcdKVListPages(t *testing.T) {
+	kv := &pagingKV{
+		t:        t,
+		pageSize: 2,
+		revisions: map[string]int64{
+			"/registry/pods/default/a":     1,
+			"/registry/pods/default/b":     1,
+			"/registry/pods/default/c":     1,
+			"/registry/pods/kube-system/d": 1,
+			"/registry/pods/kube-system/e": 1,
+			"/registry/podtemplates/f":     1,
+		},
+		revision: 1,
+	}
+	var listed []string
+	err := (&etcdKV{client: kv}).List(context.Background(), "/registry/pods/", func(key string, value []byte) error {
+		if key != string(value) {
+			t.Errorf("expected the value of %s, got %s", key, value)
+		}
+		listed = append(listed, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/registry/pods/default/a",
+		"/registry/pods/default/b",
+		"/registry/pods/default/c",
+		"/registry/pods/kube-system/d",
+		"/registry/pods/kube-system/e",
+	}
+	if !reflect.DeepEqual(expected, listed) {
+		t.Errorf("expected keys %v, got %v", expected, listed)
+	}
+	if e, a := 3, kv.gets; e != a {
+		t.Errorf("expected %d pages, got %d", e, a)
+	}
+}
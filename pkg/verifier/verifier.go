@@ -0,0 +1,243 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+)
+
+const (
+	// DefaultPrefix is the prefix of the keys the apiserver stores objects
+	// under, unless configured otherwise with --etcd-prefix.
+	DefaultPrefix = "/registry"
+	// maxReportedKeys bounds the number of keys a Result lists.
+	maxReportedKeys = 100
+)
+
+var (
+	// protobufPrefix starts the protobuf encoding of the apiserver.
+	protobufPrefix = []byte("k8s\x00")
+	// encryptedPrefix starts the values encrypted at rest.
+	encryptedPrefix = []byte("k8s:enc:")
+
+	// errEncrypted is returned when decoding an object encrypted at rest.
+	errEncrypted = fmt.Errorf("the object is encrypted")
+)
+
+// KV reads the values stored under a key prefix.
+type KV interface {
+	// List calls fn for every key under the prefix, with its value.
+	List(ctx context.Context, prefix string, fn func(key string, value []byte) error) error
+}
+
+// Result is the outcome of verifying the storage of a resource.
+type Result struct {
+	// Objects is the number of objects of the resource found in storage.
+	Objects int
+	// Stale is the number of objects encoded in another storage version.
+	Stale int
+	// Encrypted is the number of objects encrypted at rest. Their storage
+	// version cannot be told, so they are not verified.
+	Encrypted int
+	// Undecodable is the number of objects whose storage version cannot
+	// be told for another reason.
+	Undecodable int
+	// StaleKeys and UndecodableKeys list some of the keys of such objects.
+	StaleKeys       []string
+	UndecodableKeys []string
+}
+
+// Verified returns true if all objects that are not encrypted at rest are
+// known to be encoded in the expected storage version.
+func (r *Result) Verified() bool {
+	return r.Stale == 0 && r.Undecodable == 0
+}
+
+// Verifier verifies that the objects of a resource are stored in a storage
+// version, by reading them directly from etcd.
+type Verifier struct {
+	kv     KV
+	prefix string
+}
+
+// NewVerifier returns a Verifier that reads the objects under the prefix of
+// the apiserver.
+func NewVerifier(kv KV, prefix string) *Verifier {
+	if len(prefix) == 0 {
+		prefix = DefaultPrefix
+	}
+	return &Verifier{kv: kv, prefix: prefix}
+}
+
+// Verify reads all the objects of the resource from storage, and counts the
+// ones that are not encoded in the storage version with the given hash.
+func (v *Verifier) Verify(ctx context.Context, resource schema.GroupResource, storageVersionHash string) (*Result, error) {
+	result := &Result{}
+	for i, prefix := range v.keyPrefixes(resource) {
+		mostLikely := i == 0
+		err := v.kv.List(ctx, prefix, func(key string, value []byte) error {
+			gvk, err := decodeKind(value)
+			if err != nil {
+				// Encrypted objects cannot be attributed to a
+				// resource, so they only count under the
+				// prefix the resource is most likely stored
+				// under.
+				if !mostLikely {
+					return nil
+				}
+				result.Objects++
+				if err == errEncrypted {
+					result.Encrypted++
+					return nil
+				}
+				klog.V(4).Infof("cannot decode %s: %v", key, err)
+				result.Undecodable++
+				result.UndecodableKeys = appendKey(result.UndecodableKeys, key)
+				return nil
+			}
+			if !v.sharesStorage(resource, gvk.Group, prefix) {
+				return nil
+			}
+			result.Objects++
+			if migrator.StorageVersionHash(gvk.Group, gvk.Version, gvk.Kind) != storageVersionHash {
+				result.Stale++
+				result.StaleKeys = appendKey(result.StaleKeys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// sharesStorage returns true if an object of the group found under the prefix
+// is an object of the resource, possibly encoded in an older group, e.g., a
+// deployment stored as extensions/v1beta1. Prefixes are shared by resources
+// of different groups, e.g., /registry/volumesnapshots might store objects of
+// a built-in group and of a custom resource, so an object of another group is
+// only dropped if it belongs to a resource stored under another prefix.
+func (v *Verifier) sharesStorage(resource schema.GroupResource, group, prefix string) bool {
+	if group == resource.Group {
+		return true
+	}
+	if len(resource.Group) > 0 && prefix == path.Join(v.prefix, resource.Group, resource.Resource)+"/" {
+		// Only the resource is stored under the prefix with its
+		// group.
+		return true
+	}
+	// The built-in resources of the same name share the prefix without
+	// the group, whichever group they are served in.
+	return !groupPrefixedStorage(resource.Group) && !groupPrefixedStorage(group)
+}
+
+// keyPrefixes returns the prefixes the objects of the resource might be
+// stored under, most likely first. The apiserver stores custom resources and
+// some built-in resources under a prefix with their group, and most built-in
+// resources under a prefix without it. A few built-in resources are stored
+// under other prefixes; no object is found for them.
+func (v *Verifier) keyPrefixes(resource schema.GroupResource) []string {
+	if len(resource.Group) == 0 {
+		if p, ok := legacyPrefixes[resource.Resource]; ok {
+			return []string{path.Join(v.prefix, p) + "/"}
+		}
+		return []string{path.Join(v.prefix, resource.Resource) + "/"}
+	}
+	withGroup := path.Join(v.prefix, resource.Group, resource.Resource) + "/"
+	withoutGroup := path.Join(v.prefix, resource.Resource) + "/"
+	if !groupPrefixedStorage(resource.Group) {
+		return []string{withoutGroup, withGroup}
+	}
+	return []string{withGroup, withoutGroup}
+}
+
+// groupPrefixedStorage returns true if the apiserver most likely stores the
+// objects of the group under a prefix with the group.
+func groupPrefixedStorage(group string) bool {
+	if len(group) == 0 {
+		return false
+	}
+	builtIn := !strings.Contains(group, ".") || strings.HasSuffix(group, ".k8s.io")
+	return !builtIn || groupPrefixed[group]
+}
+
+// legacyPrefixes are the core resources the apiserver does not store under
+// their own name.
+var legacyPrefixes = map[string]string{
+	"nodes":                  "minions",
+	"services":               "services/specs",
+	"endpoints":              "services/endpoints",
+	"replicationcontrollers": "controllers",
+}
+
+// groupPrefixed are the built-in groups whose objects the apiserver stores
+// under a prefix with the group.
+var groupPrefixed = map[string]bool{
+	"apiextensions.k8s.io":   true,
+	"apiregistration.k8s.io": true,
+}
+
+func appendKey(keys []string, key string) []string {
+	if len(keys) >= maxReportedKeys {
+		return keys
+	}
+	return append(keys, key)
+}
+
+// decodeKind returns the group, version and kind an object is encoded in,
+// from the envelope of its encoding.
+func decodeKind(value []byte) (schema.GroupVersionKind, error) {
+	switch {
+	case bytes.HasPrefix(value, encryptedPrefix):
+		return schema.GroupVersionKind{}, errEncrypted
+	case bytes.HasPrefix(value, protobufPrefix):
+		var unknown runtime.Unknown
+		if err := unknown.Unmarshal(value[len(protobufPrefix):]); err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+		return typeMetaKind(unknown.TypeMeta)
+	default:
+		var typeMeta runtime.TypeMeta
+		if err := json.Unmarshal(value, &typeMeta); err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+		return typeMetaKind(typeMeta)
+	}
+}
+
+func typeMetaKind(typeMeta runtime.TypeMeta) (schema.GroupVersionKind, error) {
+	if len(typeMeta.APIVersion) == 0 || len(typeMeta.Kind) == 0 {
+		return schema.GroupVersionKind{}, fmt.Errorf("the object has no apiVersion or kind")
+	}
+	gv, err := schema.ParseGroupVersion(typeMeta.APIVersion)
+	if err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return gv.WithKind(typeMeta.Kind), nil
+}
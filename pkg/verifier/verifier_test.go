@@ -0,0 +1,204 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package verifier
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"sigs.k8s.io/kube-storage-version-migrator/pkg/migrator"
+)
+
+type fakeKV map[string][]byte
+
+func (kv fakeKV) List(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	var keys []string
+	for k := range kv {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, kv[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jsonObject(apiVersion, kind string) []byte {
+	return []byte(`{"apiVersion":"` + apiVersion + `","kind":"` + kind + `","metadata":{"name":"x"}}`)
+}
+
+func protobufObject(t *testing.T, apiVersion, kind string) []byte {
+	unknown := runtime.Unknown{
+		TypeMeta: runtime.TypeMeta{APIVersion: apiVersion, Kind: kind},
+		Raw:      []byte{0x0a, 0x00},
+	}
+	data, err := unknown.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte("k8s\x00"), data...)
+}
+
+func TestVerify(t *testing.T) {
+	v1Hash := migrator.StorageVersionHash("batch", "v1", "CronJob")
+	kv := fakeKV{
+		"/registry/cronjobs/default/a":        jsonObject("batch/v1", "CronJob"),
+		"/registry/cronjobs/default/b":        protobufObject(t, "batch/v1", "CronJob"),
+		"/registry/cronjobs/default/c":        protobufObject(t, "batch/v1beta1", "CronJob"),
+		"/registry/cronjobs/default/d":        []byte("k8s:enc:aescbc:v1:key1:garbage"),
+		"/registry/cronjobs/default/e":        jsonObject("example.com/v1", "CronJob"),
+		"/registry/cronjobs/default/j":        []byte("garbage"),
+		"/registry/batch/cronjobs/default/f":  jsonObject("batch/v1", "CronJob"),
+		"/registry/batch/cronjobs/default/g":  []byte("k8s:enc:aescbc:v1:key1:garbage"),
+		"/registry/cronjobsandmore/default/h": jsonObject("batch/v1beta1", "CronJob"),
+		"/registry/example.com/cronjobs/ns/i": jsonObject("example.com/v1", "CronJob"),
+	}
+	result, err := NewVerifier(kv, "").Verify(context.Background(), schema.GroupResource{Group: "batch", Resource: "cronjobs"}, v1Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Result{
+		Objects:         6,
+		Stale:           1,
+		Encrypted:       1,
+		Undecodable:     1,
+		StaleKeys:       []string{"/registry/cronjobs/default/c"},
+		UndecodableKeys: []string{"/registry/cronjobs/default/j"},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+	if result.Verified() {
+		t.Errorf("expected the storage not to be verified")
+	}
+}
+
+func TestVerifyVerified(t *testing.T) {
+	kv := fakeKV{
+		"/prefix/pods/default/a": protobufObject(t, "v1", "Pod"),
+		"/prefix/pods/default/b": jsonObject("v1", "Pod"),
+	}
+	result, err := NewVerifier(kv, "/prefix").Verify(context.Background(), schema.GroupResource{Resource: "pods"}, "xPOwRZ+Yhw8=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, a := 2, result.Objects; e != a {
+		t.Errorf("expected %d objects, got %d", e, a)
+	}
+	if !result.Verified() {
+		t.Errorf("expected the storage to be verified, got %#v", result)
+	}
+}
+
+func TestVerifyOlderGroup(t *testing.T) {
+	kv := fakeKV{
+		"/registry/deployments/default/a":        protobufObject(t, "apps/v1", "Deployment"),
+		"/registry/deployments/default/b":        protobufObject(t, "extensions/v1beta1", "Deployment"),
+		"/registry/deployments/default/c":        jsonObject("example.com/v1", "Deployment"),
+		"/registry/apps/deployments/default/d":   jsonObject("extensions/v1beta1", "Deployment"),
+		"/registry/example.com/deployments/ns/e": jsonObject("example.com/v1", "Deployment"),
+	}
+	result, err := NewVerifier(kv, "").Verify(context.Background(), schema.GroupResource{Group: "apps", Resource: "deployments"}, migrator.StorageVersionHash("apps", "v1", "Deployment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Result{
+		Objects:   3,
+		Stale:     2,
+		StaleKeys: []string{"/registry/deployments/default/b", "/registry/apps/deployments/default/d"},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+
+	// A custom resource of the same name is not stored under the prefix
+	// of the built-in resource.
+	result, err = NewVerifier(kv, "").Verify(context.Background(), schema.GroupResource{Group: "example.com", Resource: "deployments"}, migrator.StorageVersionHash("example.com", "v1", "Deployment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = &Result{Objects: 2}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+}
+
+func TestVerifyEncrypted(t *testing.T) {
+	kv := fakeKV{
+		"/registry/secrets/default/a": []byte("k8s:enc:aescbc:v1:key1:garbage"),
+		"/registry/secrets/default/b": []byte("k8s:enc:kms:v2:kms:garbage"),
+		"/registry/secrets/default/c": protobufObject(t, "v1", "Secret"),
+	}
+	result, err := NewVerifier(kv, "").Verify(context.Background(), schema.GroupResource{Resource: "secrets"}, migrator.StorageVersionHash("", "v1", "Secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Result{Objects: 3, Encrypted: 2}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("expected %#v, got %#v", expected, result)
+	}
+	if !result.Verified() {
+		t.Errorf("expected the objects that are not encrypted to be verified")
+	}
+}
+
+func TestKeyPrefixes(t *testing.T) {
+	v := NewVerifier(fakeKV{}, "")
+	for _, tc := range []struct {
+		resource schema.GroupResource
+		expected []string
+	}{
+		{
+			resource: schema.GroupResource{Resource: "pods"},
+			expected: []string{"/registry/pods/"},
+		},
+		{
+			resource: schema.GroupResource{Resource: "nodes"},
+			expected: []string{"/registry/minions/"},
+		},
+		{
+			resource: schema.GroupResource{Group: "apps", Resource: "deployments"},
+			expected: []string{"/registry/deployments/", "/registry/apps/deployments/"},
+		},
+		{
+			resource: schema.GroupResource{Group: "rbac.authorization.k8s.io", Resource: "roles"},
+			expected: []string{"/registry/roles/", "/registry/rbac.authorization.k8s.io/roles/"},
+		},
+		{
+			resource: schema.GroupResource{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"},
+			expected: []string{"/registry/apiextensions.k8s.io/customresourcedefinitions/", "/registry/customresourcedefinitions/"},
+		},
+		{
+			resource: schema.GroupResource{Group: "example.com", Resource: "widgets"},
+			expected: []string{"/registry/example.com/widgets/", "/registry/widgets/"},
+		},
+	} {
+		if a := v.keyPrefixes(tc.resource); !reflect.DeepEqual(tc.expected, a) {
+			t.Errorf("%v: expected %v, got %v", tc.resource, tc.expected, a)
+		}
+	}
+}